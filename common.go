@@ -17,7 +17,7 @@ const (
 	// Next Message
 	MsgNextTcpReq = 1009
 	MsgNextTcpAck = 1010
-	// Create Channel
+	// Declare Channel
 	ChannelCreateTcpReq = 1011
 	ChannelCreateTcpAck = 1012
 	// Join Channel
@@ -32,6 +32,43 @@ const (
 	// distribute
 	MsgDistributeTcpReq = 1019
 	MsgDistributeTcpAck = 1020
+	// Consumer Credit
+	ConsumerCreditTcpReq = 1021
+	ConsumerCreditTcpAck = 1022
+	// Delete Channel
+	ChannelDeleteTcpReq = 1023
+	ChannelDeleteTcpAck = 1024
+	// Purge Channel
+	ChannelPurgeTcpReq = 1025
+	ChannelPurgeTcpAck = 1026
+	// Consumer Cancel
+	ConsumerCancelTcpReq = 1027
+	ConsumerCancelTcpAck = 1028
+	// Declare Exchange
+	ExchangeDeclareTcpReq = 1029
+	ExchangeDeclareTcpAck = 1030
+	// Delete Exchange
+	ExchangeDeleteTcpReq = 1031
+	ExchangeDeleteTcpAck = 1032
+	// Bind Queue
+	ExchangeBindTcpReq = 1033
+	ExchangeBindTcpAck = 1034
+	// Unbind Queue
+	ExchangeUnbindTcpReq = 1035
+	ExchangeUnbindTcpAck = 1036
+	// Publish Batch
+	MsgPublishBatchTcpReq = 1037
+	MsgPublishBatchTcpAck = 1038
+	// Ack Batch
+	MsgAckBatchTcpReq = 1039
+	MsgAckBatchTcpAck = 1040
+	// Transactions
+	TxOpenTcpReq     = 1041
+	TxOpenTcpAck     = 1042
+	TxCommitTcpReq   = 1043
+	TxCommitTcpAck   = 1044
+	TxRollbackTcpReq = 1045
+	TxRollbackTcpAck = 1046
 	// LOGIN
 	// LOGOFF
 )
@@ -39,34 +76,186 @@ const (
 /*
 Message Data will be always encoded in base64
 
+FRAMED PAYLOADS
+Every request can be sent as a frame instead of text on the same opcode:
+  [1]byte(0x00) [1]byte(VERSION) FIELDS...
+the fields of each request are listed on its EncodeFrame in protocol.go.
+A framed request is answered with a framed Response: uint16 CODE | string VALUE,
+and the session then gets framed DISTRIBUTE and CONSUMER CANCEL payloads.
+codes:
+  0 ok, 1 malformed, 2 not found, 3 precondition failed, 4 access refused,
+  5 queue full, 6 unroutable, 7 internal error, 8 invalid request
+A text request which can't be parsed is answered with the error message.
+
 
 MQ PATTERNS
 PUBLISH
-REQUEST DATA: #CHANNEL_NAME []BYTE
-RESPONSE: [28]byte(MQ_MESSAGE_ID)
+REQUEST DATA: #CHANNEL_NAME []BYTE [KEY=VALUE]...
+[]BYTE is a single word, a text request with a word after it which is not KEY=VALUE fails:
+data with spaces has to be framed, or encoded like base64.
+RESPONSE: [28]byte(MQ_MESSAGE_ID), "queue full" when the queue rejects publishes over its limits
+arguments:
+  ttl=MS    the message expires MS milliseconds after it becomes visible
+  delay=MS  the message becomes visible MS milliseconds after the publish
+  at=MS     the message becomes visible at unix time MS, in milliseconds
+  priority=N  higher priorities are distributed first, capped by the queue max priority
+  header.KEY=VALUE  a message header, key and value are query escaped
+  content-type=V, content-encoding=V, correlation-id=V, reply-to=V
+                    message properties, values are query escaped
+  message-id=ID     use ID instead of a generated id, publishing an id already
+                    in the queue fails
+  exchange=NAME  publish to an exchange, the first word is then the routing key.
+                 The response is the error when no queue is bound for the key.
+
+PUBLISH BATCH
+REQUEST DATA: a PUBLISH request per line
+RESPONSE: a line per message: MQ_MESSAGE_ID OK, or MQ_MESSAGE_ID and the error
+The messages for queues are stored before any is waited for, so the batch costs
+one sync per queue whatever the durability. A line which can't be parsed fails
+the whole batch.
+Framed: uint16 COUNT | PUBLISH fields... for each message, answered with
+uint16 CODE | string VALUE | uint16 COUNT | (uint16 CODE | string ID | string VALUE)...
+
+ACK BATCH
+REQUEST DATA: #CHANNEL_NAME ack|nack|reject|requeue [MQ_MESSAGE_ID]... [up-to=MQ_MESSAGE_ID]
+RESPONSE: a line per message like PUBLISH BATCH
+up-to adds the messages held by the session which were distributed before that one,
+that one included, like the ids were listed.
+Framed: string CHANNEL | uint8 MODE 0 ack, 1 nack, 2 reject, 3 requeue | uint16 COUNT |
+string ID... | string UP_TO, answered like PUBLISH BATCH
+
+NEXT
+REQUEST DATA: #CHANNEL_NAME [max=N] [wait=MS]
+RESPONSE: a DISTRIBUTE payload per line for each message taken, nothing when there was none
+Pulls up to max ready messages, 1 by default and at most 1000, waiting up to wait
+milliseconds, at most a minute, for one when there's none. The pulled messages are acked
+like distributed ones and come back to the queue when their ack expires or the session
+closes. Registered consumers are served first. Unless the server runs with -async-router
+the other requests of the session wait behind a pull.
+Framed: uint16 CODE | string VALUE | uint16 COUNT | DISTRIBUTE fields... for each message
+
+REGISTER PUBLISHER
+REQUEST DATA: [confirm=BOOL]
+RESPONSE: [2]byte(OK)
+confirm=true, the default, puts the session in confirm mode, confirm=false takes it out.
+In confirm mode every PUBLISH of the session gets the next sequence number, from 1,
+in the order the server reads them unless it runs with -async-router. A publish is not
+answered right away, so publishers can send the next ones without waiting: once the
+message is on disk, whatever the queue durability, the server sends on the PUBLISH
+response opcode
+  SEQ ack MQ_MESSAGE_ID
+or, when it couldn't be stored,
+  SEQ nack REASON
+Messages of transient queues are confirmed once in memory. A PUBLISH BATCH of a session
+in confirm mode is answered once its messages are on disk, without sequence numbers.
+Framed: bool CONFIRM, confirms are uint64 SEQ | uint16 CODE | string MQ_MESSAGE_ID or error
 
 NACK
 REQUEST DATA: #CHANNEL_NAME [28]BYTE(MQ_MESSAGE_ID)
 RESPONSE: [2]byte(OK)
+The consumer works on the message: it's held without ack timeout, until the
+transaction timeout of the server.
+
+DELIVERY TRANSACTIONS
+Every distribution starts a transaction between the queue and the consumer session,
+see src/mq/transaction.go: DISTRIBUTE, then optionally the DISTRIBUTE ack of the
+consumer and a NACK, then an ACK or REJECT. A NACK, ACK or REJECT from another session
+than the one the message went to, out of order or repeated, is refused with the reason.
+The queue counters of the admin API count the completed, timed out and refused ones.
+
+DISTRIBUTE ACK (consumer to server)
+REQUEST DATA: #CHANNEL_NAME [28]BYTE(MQ_MESSAGE_ID)
+Optional, tells the server the consumer received the message, it's not answered.
 
 ACK
 REQUEST DATA: #CHANNEL_NAME [28]BYTE(MQ_MESSAGE_ID)
 RESPONSE: [2]byte(OK)
 
 REJECT
-REQUEST DATA: #CHANNEL_NAME [28]BYTE(MQ_MESSAGE_ID)
+REQUEST DATA: #CHANNEL_NAME [28]BYTE(MQ_MESSAGE_ID) [requeue=true]
 RESPONSE: [2]byte(OK)
+requeue=true puts the message back in the queue, otherwise it goes to the dead letter queue
 
-CHANNEL CREATE
-REQUEST DATA: #CHANNEL_NAME []BYTE(CREATE)
+TX OPEN / TX COMMIT / TX ROLLBACK
+REQUEST DATA: nothing
 RESPONSE: [2]byte(OK)
+TX OPEN starts a transaction in the session: its PUBLISH, PUBLISH BATCH and ACK, and the
+acks of ACK BATCH, are answered as usual but only staged, the queues see none of them
+until TX COMMIT applies them all, or none when one of them can't be. TX ROLLBACK, or
+closing the session, drops them. Both end the transaction. NACK and REJECT are not
+staged, and a staged ack doesn't stop the ack timeout of its message. A session in
+confirm mode can't open a transaction. A commit is journaled in the data dir, one
+stopped by a crash is completed at startup, it's never seen half applied.
+Framed: nothing, answered with uint16 CODE | string VALUE
+
+CHANNEL DECLARE
+REQUEST DATA: #CHANNEL_NAME [KEY=VALUE]...
+RESPONSE: [2]byte(OK), or the error when the queue exists with other properties
+Declaring an existing queue with the same properties does nothing.
+arguments:
+  durable=BOOL        false keeps the queue in memory only, true by default
+  auto-delete=BOOL    the queue is deleted when its last consumer leaves
+  exclusive=BOOL      only this session can consume, the queue is deleted when it closes
+  ttl=MS              message time to live
+  max-length=N        max stored messages, ready, in flight or scheduled
+  max-bytes=N         max data size of the stored messages
+  overflow=drop-head|dead-letter|reject-publish
+  dead-letter=QUEUE   where rejected, expired and dropped messages go
+  dead-letter-expired=BOOL
+  max-deliveries=N    deliveries before a message is dead lettered
+  max-priority=N      highest priority of the queue
+  durability=always|batch|none
+When the server runs with -implicit-queues=false publishing to or consuming
+from a queue which was not declared fails.
 
 JOIN
 REQUEST DATA: #CHANNEL_NAME []BYTE(JOIN)
 RESPONSE: [2]byte(OK)
 
 REGISTER CONSUMER
-REQUEST DATA: [28]byte
+REQUEST DATA: #CHANNEL_NAME [PREFETCH]
+RESPONSE: []byte(SESSION_ID)
+PREFETCH is how many messages the consumer can hold without acking them, 1 when omitted
+
+DISTRIBUTE (server to consumer)
+REQUEST DATA: [28]byte(MQ_MESSAGE_ID) BASE64_DATA attempt=N redelivered=BOOL [PROPERTY=VALUE]... [header.KEY=VALUE]...
+attempt counts the deliveries of the message, redelivered is true from the second one,
+the properties and headers are written like in PUBLISH
+
+CONSUMER CREDIT
+REQUEST DATA: #CHANNEL_NAME CREDIT
+RESPONSE: [2]byte(OK)
+Widens the consumer window by CREDIT messages, the window stops at 2147483647
+
+CHANNEL DELETE
+REQUEST DATA: #CHANNEL_NAME [if-empty=true] [if-unused=true]
+RESPONSE: [2]byte(OK), or the reason the queue was kept
+if-empty keeps a queue holding messages, if-unused keeps a queue with consumers.
+The consumers of a deleted queue receive a CONSUMER CANCEL.
+
+CHANNEL PURGE
+REQUEST DATA: #CHANNEL_NAME
+RESPONSE: []byte(COUNT) of the messages dropped
+Drops the ready messages, the ones held by consumers and the scheduled ones stay.
+
+EXCHANGE DECLARE
+REQUEST DATA: #EXCHANGE_NAME TYPE
 RESPONSE: [2]byte(OK)
+TYPE is direct, fanout, topic or headers. Topic binding keys are dot separated words,
+* matches one word and # zero or more.
+
+EXCHANGE DELETE
+REQUEST DATA: #EXCHANGE_NAME
+RESPONSE: [2]byte(OK)
+
+EXCHANGE BIND / UNBIND
+REQUEST DATA: #EXCHANGE_NAME #CHANNEL_NAME [BINDING_KEY] [HEADER=VALUE]...
+RESPONSE: [2]byte(OK)
+A headers exchange matches the HEADER=VALUE arguments against the message headers,
+all of them by default, any of them with x-match=any.
+
+CONSUMER CANCEL (server to consumer)
+REQUEST DATA: #CHANNEL_NAME
+The queue was deleted, no more messages will come from it.
 
 */
@@ -1,6 +1,139 @@
 package config
 
-const (
-	DATA_DIR                       = "/home/ozy/GO/toMQServer/data"
-	MAX_TIME_DISTRIBUTED_ACK int64 = 5
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 )
+
+// Config is the runtime configuration of a server instance.
+// Values come from the defaults, then a YAML file, then TOMQ_* env vars, then command line flags.
+type Config struct {
+	Addr          string        `yaml:"addr"`           // TCP bind address
+	WebAddr       string        `yaml:"web_addr"`       // admin web bind address
+	DataDir       string        `yaml:"data_dir"`       // where the queues are stored
+	AckTimeout    time.Duration `yaml:"ack_timeout"`    // time a consumer has to ack a distributed message
+	SweepInterval time.Duration `yaml:"sweep_interval"` // time between two passes removing the expired messages of a queue
+	// publishing to or consuming from a missing queue creates it, otherwise queues must be declared
+	ImplicitQueues bool `yaml:"implicit_queues"`
+	// time a delivery can stay unsettled, nacked ones included, before it times out
+	TransactionTimeout time.Duration `yaml:"transaction_timeout"`
+
+	Server  ServerConfig  `yaml:"server"`
+	Storage StorageConfig `yaml:"storage"`
+}
+
+// ServerConfig holds the tcp server options.
+type ServerConfig struct {
+	SocketReadBufferSize  int           `yaml:"socket_read_buffer_size"`
+	SocketWriteBufferSize int           `yaml:"socket_write_buffer_size"`
+	SocketSendDelay       bool          `yaml:"socket_send_delay"`
+	ReadTimeout           time.Duration `yaml:"read_timeout"`
+	WriteTimeout          time.Duration `yaml:"write_timeout"`
+	RespQueueSize         int           `yaml:"resp_queue_size"`
+	DoNotPrintRoutes      bool          `yaml:"do_not_print_routes"`
+	WriteAttemptTimes     int           `yaml:"write_attempt_times"`
+	AsyncRouter           bool          `yaml:"async_router"`
+}
+
+// StorageConfig holds the queue persistence options.
+type StorageConfig struct {
+	SegmentSize     int64         `yaml:"segment_size"`     // bytes before a segment rolls over
+	Durability      string        `yaml:"durability"`       // default durability of new queues: always, batch or none
+	SyncInterval    time.Duration `yaml:"sync_interval"`    // group commit interval of batch durability
+	SyncBatch       int           `yaml:"sync_batch"`       // group commit size of batch durability
+	CompactInterval time.Duration `yaml:"compact_interval"` // time between two compaction runs of a queue
+	CompactRatio    float64       `yaml:"compact_ratio"`    // sealed segments with less live bytes than this ratio get compacted
+}
+
+// Default returns the configuration used when nothing is set.
+func Default() *Config {
+	return &Config{
+		Addr:           ":5896",
+		WebAddr:        "localhost:15896",
+		DataDir:        "data",
+		AckTimeout:     5 * time.Second,
+		SweepInterval:  time.Second,
+		ImplicitQueues: true,
+		// nacked messages are worked on, they get longer than an ack
+		TransactionTimeout: 10 * time.Minute,
+		Server: ServerConfig{
+			RespQueueSize:     -1,
+			WriteAttemptTimes: 1,
+		},
+		Storage: StorageConfig{
+			SegmentSize:     64 * 1024 * 1024,
+			Durability:      "batch",
+			SyncInterval:    10 * time.Millisecond,
+			SyncBatch:       256,
+			CompactInterval: 30 * time.Second,
+			CompactRatio:    0.5,
+		},
+	}
+}
+
+// Validate checks the configuration values.
+func (c *Config) Validate() error {
+	if c.Addr == "" {
+		return errors.New("addr is required")
+	}
+	if c.WebAddr == "" {
+		return errors.New("web_addr is required")
+	}
+	if c.DataDir == "" {
+		return errors.New("data_dir is required")
+	}
+	if c.AckTimeout <= 0 {
+		return errors.New("ack_timeout must be positive")
+	}
+	if c.TransactionTimeout <= 0 {
+		return errors.New("transaction_timeout must be positive")
+	}
+	if c.SweepInterval <= 0 {
+		return errors.New("sweep_interval must be positive")
+	}
+	if c.Server.SocketReadBufferSize < 0 || c.Server.SocketWriteBufferSize < 0 {
+		return errors.New("socket buffer sizes can't be negative")
+	}
+	if c.Server.ReadTimeout < 0 || c.Server.WriteTimeout < 0 {
+		return errors.New("read and write timeouts can't be negative")
+	}
+	if c.Storage.SegmentSize < 1024 {
+		return fmt.Errorf("segment_size must be at least 1024 bytes, got %d", c.Storage.SegmentSize)
+	}
+	switch c.Storage.Durability {
+	case "always", "batch", "none":
+	default:
+		return fmt.Errorf("unknown durability %q", c.Storage.Durability)
+	}
+	if c.Storage.SyncInterval <= 0 || c.Storage.SyncBatch <= 0 {
+		return errors.New("sync_interval and sync_batch must be positive")
+	}
+	if c.Storage.CompactInterval <= 0 {
+		return errors.New("compact_interval must be positive")
+	}
+	if c.Storage.CompactRatio <= 0 || c.Storage.CompactRatio > 1 {
+		return fmt.Errorf("compact_ratio must be in (0, 1], got %v", c.Storage.CompactRatio)
+	}
+	return nil
+}
+
+var (
+	current = Default()
+	mu      sync.RWMutex
+)
+
+// Get returns the configuration in use.
+func Get() *Config {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+// Set replaces the configuration in use, it's meant to be called once at startup.
+func Set(c *Config) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = c
+}
@@ -0,0 +1,56 @@
+package config
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad_Defaults(t *testing.T) {
+	c, err := Load("tomq", nil, io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), c)
+}
+
+func TestLoad_Precedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tomq.yaml")
+	yml := "addr: \":7000\"\nweb_addr: \"0.0.0.0:17000\"\ndata_dir: /var/lib/tomq\nack_timeout: 30s\n" +
+		"server:\n  async_router: true\nstorage:\n  durability: always\n  sync_batch: 10\n"
+	assert.NoError(t, os.WriteFile(path, []byte(yml), 0644))
+	t.Setenv(EnvConfigFile, path)
+	t.Setenv("TOMQ_DATA_DIR", "/srv/tomq")
+	t.Setenv("TOMQ_SYNC_BATCH", "20")
+
+	c, err := Load("tomq", []string{"-addr", ":8000", "-sync-batch", "30"}, io.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, ":8000", c.Addr)                // flag over file
+	assert.Equal(t, "0.0.0.0:17000", c.WebAddr)     // file
+	assert.Equal(t, "/srv/tomq", c.DataDir)         // env over file
+	assert.Equal(t, 30*time.Second, c.AckTimeout)   // file
+	assert.Equal(t, 30, c.Storage.SyncBatch)        // flag over env
+	assert.Equal(t, "always", c.Storage.Durability) // file
+	assert.True(t, c.Server.AsyncRouter)            // file
+	assert.Equal(t, 1, c.Server.WriteAttemptTimes)  // default
+}
+
+func TestLoad_Errors(t *testing.T) {
+	_, err := Load("tomq", []string{"-durability", "sometimes"}, io.Discard)
+	assert.Error(t, err)
+	_, err = Load("tomq", []string{"-unknown"}, io.Discard)
+	assert.Error(t, err)
+	_, err = Load("tomq", []string{"-transaction-timeout", "0s"}, io.Discard)
+	assert.Error(t, err)
+
+	t.Setenv("TOMQ_ACK_TIMEOUT", "soon")
+	_, err = Load("tomq", nil, io.Discard)
+	assert.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "tomq.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte("adr: typo\n"), 0644))
+	_, err = Load("tomq", []string{"-config", path}, io.Discard)
+	assert.Error(t, err)
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// EnvPrefix prefixes the env var of every flag, -data-dir is TOMQ_DATA_DIR.
+	EnvPrefix = "TOMQ_"
+	// EnvConfigFile is the env var pointing to the config file when -config is not given.
+	EnvConfigFile = EnvPrefix + "CONFIG"
+)
+
+// bindFlags declares a flag for every setting of c.
+func bindFlags(fs *flag.FlagSet, c *Config) {
+	fs.StringVar(&c.Addr, "addr", c.Addr, "TCP bind address")
+	fs.StringVar(&c.WebAddr, "web-addr", c.WebAddr, "admin web bind address")
+	fs.StringVar(&c.DataDir, "data-dir", c.DataDir, "directory where the queues are stored")
+	fs.DurationVar(&c.AckTimeout, "ack-timeout", c.AckTimeout, "time a consumer has to ack a distributed message")
+	fs.DurationVar(&c.TransactionTimeout, "transaction-timeout", c.TransactionTimeout, "time a delivery can stay unsettled, nacked ones included")
+	fs.DurationVar(&c.SweepInterval, "sweep-interval", c.SweepInterval, "time between two passes removing expired messages")
+	fs.BoolVar(&c.ImplicitQueues, "implicit-queues", c.ImplicitQueues, "create missing queues on publish and consume, false requires declaring them")
+
+	fs.IntVar(&c.Server.SocketReadBufferSize, "socket-read-buffer-size", c.Server.SocketReadBufferSize, "socket read buffer size, 0 keeps the OS default")
+	fs.IntVar(&c.Server.SocketWriteBufferSize, "socket-write-buffer-size", c.Server.SocketWriteBufferSize, "socket write buffer size, 0 keeps the OS default")
+	fs.BoolVar(&c.Server.SocketSendDelay, "socket-send-delay", c.Server.SocketSendDelay, "enable Nagle's algorithm")
+	fs.DurationVar(&c.Server.ReadTimeout, "read-timeout", c.Server.ReadTimeout, "connection read timeout, 0 means none")
+	fs.DurationVar(&c.Server.WriteTimeout, "write-timeout", c.Server.WriteTimeout, "connection write timeout, 0 means none")
+	fs.IntVar(&c.Server.RespQueueSize, "resp-queue-size", c.Server.RespQueueSize, "response queue size of a session, < 0 uses the default")
+	fs.BoolVar(&c.Server.DoNotPrintRoutes, "do-not-print-routes", c.Server.DoNotPrintRoutes, "don't print the routes at startup")
+	fs.IntVar(&c.Server.WriteAttemptTimes, "write-attempt-times", c.Server.WriteAttemptTimes, "max attempts of a packet write")
+	fs.BoolVar(&c.Server.AsyncRouter, "async-router", c.Server.AsyncRouter, "handle the requests of a session in goroutines")
+
+	fs.Int64Var(&c.Storage.SegmentSize, "segment-size", c.Storage.SegmentSize, "bytes before a queue segment rolls over")
+	fs.StringVar(&c.Storage.Durability, "durability", c.Storage.Durability, "default durability of new queues: always, batch or none")
+	fs.DurationVar(&c.Storage.SyncInterval, "sync-interval", c.Storage.SyncInterval, "group commit interval of batch durability")
+	fs.IntVar(&c.Storage.SyncBatch, "sync-batch", c.Storage.SyncBatch, "group commit size of batch durability")
+	fs.DurationVar(&c.Storage.CompactInterval, "compact-interval", c.Storage.CompactInterval, "time between two compaction runs of a queue")
+	fs.Float64Var(&c.Storage.CompactRatio, "compact-ratio", c.Storage.CompactRatio, "live ratio under which a sealed segment is compacted")
+}
+
+// EnvName returns the env var of a flag.
+func EnvName(flagName string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Load builds the configuration from args (without the program name)
+// and the environment, then validates it.
+func Load(name string, args []string, output io.Writer) (*Config, error) {
+	// first pass to find the config file, the values are discarded
+	scratch := Default()
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(output)
+	path := fs.String("config", os.Getenv(EnvConfigFile), "YAML config file, also "+EnvConfigFile)
+	bindFlags(fs, scratch)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	c := Default()
+	if *path != "" {
+		if err := c.loadFile(*path); err != nil {
+			return nil, err
+		}
+	}
+
+	// env vars and flags share the flag parsers
+	target := flag.NewFlagSet(name, flag.ContinueOnError)
+	target.SetOutput(io.Discard)
+	bindFlags(target, c)
+	var errEnv error
+	target.VisitAll(func(f *flag.Flag) {
+		if v, ok := os.LookupEnv(EnvName(f.Name)); ok && errEnv == nil {
+			if err := target.Set(f.Name, v); err != nil {
+				errEnv = fmt.Errorf("%s: %s", EnvName(f.Name), err)
+			}
+		}
+	})
+	if errEnv != nil {
+		return nil, errEnv
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name != "config" {
+			target.Set(f.Name, f.Value.String()) // nolint: already parsed once
+		}
+	})
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(c); err != nil && err != io.EOF {
+		return fmt.Errorf("config file %s: %s", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,983 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"tomqserver/src/mq"
+	easytcp "tomqserver/src/server"
+	"tomqserver/src/tomq_codec"
+)
+
+/*
+Every request can be sent as a frame (see src/tomq_codec/codec_frame.go) or as
+the legacy space separated text. A framed request gets a framed Response and,
+once a session sent a framed request, its distributes and cancels are framed too.
+The frame fields of each request are listed on its EncodeFrame method.
+*/
+
+// response codes of a framed Response
+const (
+	CODE_OK              = 0
+	CODE_MALFORMED       = 1 // the request couldn't be decoded
+	CODE_NOT_FOUND       = 2 // queue, exchange, binding, message or consumer
+	CODE_PRECONDITION    = 3 // not empty, in use, declared differently, duplicate message id
+	CODE_ACCESS_REFUSED  = 4 // exclusive queue of another session
+	CODE_QUEUE_FULL      = 5
+	CODE_UNROUTABLE      = 6
+	CODE_INTERNAL        = 7
+	CODE_INVALID_REQUEST = 8 // decoded but with bad values
+)
+
+// errMalformed wraps the errors of a request which couldn't be decoded.
+var errMalformed = errors.New("malformed request")
+
+// errInvalid wraps the errors of a request with bad values.
+var errInvalid = errors.New("invalid request")
+
+// errorCode returns the response code of err.
+func errorCode(err error) uint16 {
+	switch {
+	case err == nil:
+		return CODE_OK
+	case errors.Is(err, errMalformed):
+		return CODE_MALFORMED
+	case errors.Is(err, errInvalid), errors.Is(err, mq.ErrHeaderTooLong):
+		return CODE_INVALID_REQUEST
+	case errors.Is(err, mq.ErrNoQueue), errors.Is(err, mq.ErrNoExchange), errors.Is(err, mq.ErrNoBinding),
+		errors.Is(err, mq.ErrNoMessage), errors.Is(err, mq.ErrNoConsumer):
+		return CODE_NOT_FOUND
+	case errors.Is(err, mq.ErrQueueNotEmpty), errors.Is(err, mq.ErrQueueInUse), errors.Is(err, mq.ErrQueueOptions),
+		errors.Is(err, mq.ErrExchangeType), errors.Is(err, mq.ErrDuplicateId),
+		errors.Is(err, mq.ErrTxOrder), errors.Is(err, mq.ErrTxDuplicate), errors.Is(err, mq.ErrTxNotInFlight),
+		errors.Is(err, mq.ErrNoTx), errors.Is(err, mq.ErrTxOpen):
+		return CODE_PRECONDITION
+	case errors.Is(err, mq.ErrExclusive), errors.Is(err, mq.ErrTxConsumer):
+		return CODE_ACCESS_REFUSED
+	case errors.Is(err, mq.ErrQueueFull):
+		return CODE_QUEUE_FULL
+	case errors.Is(err, mq.ErrUnroutable):
+		return CODE_UNROUTABLE
+	}
+	return CODE_INTERNAL
+}
+
+// request is the payload of an opcode, framed or text.
+type request interface {
+	tomq_codec.FrameDecoder
+	parseText(data []byte) error
+}
+
+// bindRequest decodes the payload of c into req, returns whether it was framed.
+func bindRequest(c easytcp.Context, req request) (bool, error) {
+	data := c.Request().Data()
+	if tomq_codec.IsFrame(data) {
+		sessions.setFramed(c.Session())
+		if err := c.Bind(req); err != nil {
+			return true, fmt.Errorf("%w: %s", errMalformed, err)
+		}
+		return true, nil
+	}
+	if err := req.parseText(data); err != nil {
+		return false, fmt.Errorf("%w: %s", errMalformed, err)
+	}
+	return false, nil
+}
+
+// respond answers c with value, or with err when it's set.
+// Text requests get the bare value or error message.
+func respond(c easytcp.Context, id int, framed bool, value string, err error) {
+	if err != nil {
+		value = err.Error()
+	}
+	if !framed {
+		c.SetResponseTcpMessage(easytcp.NewTcpMessage(id, []byte(value)))
+		return
+	}
+	if err := c.SetResponse(id, &Response{Code: errorCode(err), Value: value}); err != nil {
+		log.Println("[server] response encoding failed:", err)
+	}
+}
+
+// respondNext answers a MsgNextTcpReq with the pulled msgs, or with err when it's set.
+// Text requests get one distribute payload per line, nothing when no message came.
+func respondNext(c easytcp.Context, framed bool, msgs []mq.QMessage, err error) {
+	if !framed {
+		if err != nil {
+			respond(c, MsgNextTcpAck, framed, "", err)
+			return
+		}
+		lines := make([][]byte, len(msgs))
+		for i := range msgs {
+			lines[i] = msgs[i].TcpData()
+		}
+		c.SetResponseTcpMessage(easytcp.NewTcpMessage(MsgNextTcpAck, bytes.Join(lines, []byte("\n"))))
+		return
+	}
+	resp := &NextResponse{Code: errorCode(err)}
+	if err != nil {
+		resp.Value = err.Error()
+	}
+	for _, msg := range msgs {
+		resp.Messages = append(resp.Messages, newDistribute(msg))
+	}
+	if err := c.SetResponse(MsgNextTcpAck, resp); err != nil {
+		log.Println("[server] response encoding failed:", err)
+		c.SetResponse(MsgNextTcpAck, &NextResponse{Code: CODE_INTERNAL, Value: err.Error()}) // nolint: it fits
+	}
+}
+
+// respondBatch answers a batch request with the result of each message id,
+// or with err when the whole request failed.
+// Text requests get a line per message: ID OK, or ID and the error message.
+func respondBatch(c easytcp.Context, id int, framed bool, ids []string, errs []error, err error) {
+	if !framed {
+		if err != nil {
+			respond(c, id, framed, "", err)
+			return
+		}
+		lines := make([]string, len(ids))
+		for i := range ids {
+			result := "OK"
+			if errs[i] != nil {
+				result = errs[i].Error()
+			}
+			lines[i] = ids[i] + " " + result
+		}
+		c.SetResponseTcpMessage(easytcp.NewTcpMessage(id, []byte(strings.Join(lines, "\n"))))
+		return
+	}
+	resp := &BatchResponse{Code: errorCode(err)}
+	if err != nil {
+		resp.Value = err.Error()
+	}
+	for i := range ids {
+		res := BatchResult{Code: errorCode(errs[i]), Id: ids[i]}
+		if errs[i] != nil {
+			res.Value = errs[i].Error()
+		}
+		resp.Results = append(resp.Results, res)
+	}
+	if err := c.SetResponse(id, resp); err != nil {
+		log.Println("[server] response encoding failed:", err)
+		c.SetResponse(id, &BatchResponse{Code: CODE_INTERNAL, Value: err.Error()}) // nolint: it fits
+	}
+}
+
+// invalid marks err as caused by a bad request value.
+func invalid(err error) error {
+	return fmt.Errorf("%w: %s", errInvalid, err)
+}
+
+// textArgs splits the key=value arguments of a text request.
+func textArgs(fields [][]byte) (map[string]string, error) {
+	args := map[string]string{}
+	for _, f := range fields {
+		kv := strings.SplitN(string(f), "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad argument %q", f)
+		}
+		args[kv[0]] = kv[1]
+	}
+	return args, nil
+}
+
+// Response answers every framed request.
+type Response struct {
+	Code  uint16
+	Value string // message id, session id, count... or the error message
+}
+
+// EncodeFrame writes: uint16 code | string value.
+func (r *Response) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.Uint16(r.Code)
+	w.String(r.Value)
+}
+
+func (r *Response) DecodeFrame(fr *tomq_codec.FrameReader) {
+	r.Code = fr.Uint16()
+	r.Value = fr.String()
+}
+
+// PublishRequest is the payload of MsgPublishTcpReq.
+type PublishRequest struct {
+	Channel         string // the routing key when Exchange is set
+	Exchange        string
+	Data            []byte
+	MessageId       string // replaces the generated id when set
+	TTL             uint64 // milliseconds, 0 for none
+	Delay           uint64 // milliseconds
+	At              uint64 // unix milliseconds
+	Priority        uint8
+	ContentType     string
+	ContentEncoding string
+	CorrelationId   string
+	ReplyTo         string
+	Headers         map[string]string
+}
+
+// EncodeFrame writes: string channel | string exchange | bytes data | string message id |
+// uint64 ttl | uint64 delay | uint64 at | uint8 priority | string content type |
+// string content encoding | string correlation id | string reply to | map headers.
+func (p *PublishRequest) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.String(p.Channel)
+	w.String(p.Exchange)
+	w.Bytes(p.Data)
+	w.String(p.MessageId)
+	w.Uint64(p.TTL)
+	w.Uint64(p.Delay)
+	w.Uint64(p.At)
+	w.Uint8(p.Priority)
+	w.String(p.ContentType)
+	w.String(p.ContentEncoding)
+	w.String(p.CorrelationId)
+	w.String(p.ReplyTo)
+	w.Map(p.Headers)
+}
+
+func (p *PublishRequest) DecodeFrame(r *tomq_codec.FrameReader) {
+	p.Channel = r.String()
+	p.Exchange = r.String()
+	p.Data = r.Bytes()
+	p.MessageId = r.String()
+	p.TTL = r.Uint64()
+	p.Delay = r.Uint64()
+	p.At = r.Uint64()
+	p.Priority = r.Uint8()
+	p.ContentType = r.String()
+	p.ContentEncoding = r.String()
+	p.CorrelationId = r.String()
+	p.ReplyTo = r.String()
+	p.Headers = r.Map()
+}
+
+// parseText reads: CHANNEL DATA [KEY=VALUE]...
+// DATA is a single word, the words after it must all be arguments.
+func (p *PublishRequest) parseText(data []byte) error {
+	fields := bytes.Fields(data)
+	if len(fields) < 2 {
+		return errors.New("expected CHANNEL DATA")
+	}
+	p.Channel = string(fields[0])
+	p.Data = fields[1]
+	msg := mq.QMessage{}
+	for _, arg := range fields[2:] {
+		if bytes.HasPrefix(arg, []byte(mq.HEADER_ARG_PREFIX)) {
+			if err := msg.SetHeaderArg(string(arg)); err != nil {
+				return err
+			}
+			continue
+		}
+		kv := strings.SplitN(string(arg), "=", 2)
+		if len(kv) != 2 {
+			return fmt.Errorf("bad argument %q, text data is a single word: frame data with spaces", arg)
+		}
+		if ok, err := msg.SetPropertyArg(kv[0], kv[1]); ok {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		var err error
+		switch kv[0] {
+		case "exchange":
+			p.Exchange = kv[1]
+		case "message-id":
+			p.MessageId, err = url.QueryUnescape(kv[1])
+		case "ttl":
+			p.TTL, err = strconv.ParseUint(kv[1], 10, 64)
+			if err == nil && p.TTL == 0 {
+				err = errors.New("zero")
+			}
+		case "delay":
+			p.Delay, err = strconv.ParseUint(kv[1], 10, 64)
+		case "at":
+			p.At, err = strconv.ParseUint(kv[1], 10, 64)
+		case "priority":
+			var priority uint64
+			priority, err = strconv.ParseUint(kv[1], 10, 8)
+			p.Priority = uint8(priority)
+		default:
+			return fmt.Errorf("unknown argument %q", kv[0])
+		}
+		if err != nil {
+			return fmt.Errorf("bad %s %q", kv[0], kv[1])
+		}
+	}
+	p.ContentType = msg.Header.ContentType
+	p.ContentEncoding = msg.Header.ContentEncoding
+	p.CorrelationId = msg.Header.CorrelationId
+	p.ReplyTo = msg.Header.ReplyTo
+	p.Headers = msg.Header.Headers
+	return nil
+}
+
+// message builds the message to publish.
+func (p *PublishRequest) message() (mq.QMessage, error) {
+	if p.Channel == "" {
+		return mq.QMessage{}, invalid(errors.New("channel is required"))
+	}
+	msg := mq.NewMessage(strings.ToUpper(p.Channel), p.Data)
+	if p.MessageId != "" {
+		if err := msg.SetId(p.MessageId); err != nil {
+			return msg, invalid(err)
+		}
+	}
+	if p.Delay > 0 {
+		msg.SetDelay(time.Duration(p.Delay) * time.Millisecond)
+	}
+	if p.At > 0 {
+		msg.Header.DeliverAt = time.UnixMilli(int64(p.At)).UnixNano()
+	}
+	msg.Header.Priority = int(p.Priority)
+	msg.Header.ContentType = p.ContentType
+	msg.Header.ContentEncoding = p.ContentEncoding
+	msg.Header.CorrelationId = p.CorrelationId
+	msg.Header.ReplyTo = p.ReplyTo
+	msg.Header.Headers = p.Headers
+	if err := msg.CheckHeaders(); err != nil {
+		return msg, invalid(err)
+	}
+	// the ttl counts from the delivery time
+	if p.TTL > 0 {
+		msg.SetTTL(time.Duration(p.TTL) * time.Millisecond)
+	}
+	return msg, nil
+}
+
+// PublisherRequest is the payload of ConsumerPublisherTcpReq.
+type PublisherRequest struct {
+	Confirm bool
+}
+
+// EncodeFrame writes: bool confirm.
+func (p *PublisherRequest) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.Bool(p.Confirm)
+}
+
+func (p *PublisherRequest) DecodeFrame(r *tomq_codec.FrameReader) {
+	p.Confirm = r.Bool()
+}
+
+// parseText reads: [confirm=BOOL], confirm is true when omitted.
+func (p *PublisherRequest) parseText(data []byte) error {
+	p.Confirm = true
+	args, err := textArgs(bytes.Fields(data))
+	if err != nil {
+		return err
+	}
+	for k, v := range args {
+		if k != "confirm" {
+			return fmt.Errorf("unknown argument %q", k)
+		}
+		confirm, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("bad confirm %q", v)
+		}
+		p.Confirm = confirm
+	}
+	return nil
+}
+
+// TxRequest is the payload of TxOpenTcpReq, TxCommitTcpReq and TxRollbackTcpReq.
+type TxRequest struct{}
+
+// EncodeFrame writes nothing.
+func (t *TxRequest) EncodeFrame(w *tomq_codec.FrameWriter) {}
+
+func (t *TxRequest) DecodeFrame(r *tomq_codec.FrameReader) {}
+
+// parseText reads nothing.
+func (t *TxRequest) parseText(data []byte) error {
+	if args := bytes.TrimSpace(data); len(args) > 0 {
+		return fmt.Errorf("unexpected %q", args)
+	}
+	return nil
+}
+
+// Confirm answers a publish of a session in confirm mode once it's stored.
+type Confirm struct {
+	Seq   uint64
+	Code  uint16
+	Value string // message id, or the error message
+}
+
+// EncodeFrame writes: uint64 seq | uint16 code | string value.
+func (c *Confirm) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.Uint64(c.Seq)
+	w.Uint16(c.Code)
+	w.String(c.Value)
+}
+
+func (c *Confirm) DecodeFrame(r *tomq_codec.FrameReader) {
+	c.Seq = r.Uint64()
+	c.Code = r.Uint16()
+	c.Value = r.String()
+}
+
+// PublishBatchRequest is the payload of MsgPublishBatchTcpReq.
+type PublishBatchRequest struct {
+	Messages []*PublishRequest
+}
+
+// EncodeFrame writes: uint16 count | publish fields... for each message.
+func (b *PublishBatchRequest) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.Count(len(b.Messages))
+	for _, p := range b.Messages {
+		p.EncodeFrame(w)
+	}
+}
+
+func (b *PublishBatchRequest) DecodeFrame(r *tomq_codec.FrameReader) {
+	count := int(r.Uint16())
+	b.Messages = nil
+	for i := 0; i < count && r.Err() == nil; i++ {
+		p := &PublishRequest{}
+		p.DecodeFrame(r)
+		b.Messages = append(b.Messages, p)
+	}
+}
+
+// parseText reads a publish request per line.
+func (b *PublishBatchRequest) parseText(data []byte) error {
+	for i, line := range bytes.Split(data, []byte("\n")) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		p := &PublishRequest{}
+		if err := p.parseText(line); err != nil {
+			return fmt.Errorf("line %d: %s", i+1, err)
+		}
+		b.Messages = append(b.Messages, p)
+	}
+	if len(b.Messages) == 0 {
+		return errors.New("expected a publish request per line")
+	}
+	return nil
+}
+
+// settle modes of an AckBatchRequest
+var settleModes = map[string]uint8{
+	"ack":     mq.SETTLE_ACK,
+	"nack":    mq.SETTLE_NACK,
+	"reject":  mq.SETTLE_REJECT,
+	"requeue": mq.SETTLE_REQUEUE,
+}
+
+// AckBatchRequest is the payload of MsgAckBatchTcpReq.
+type AckBatchRequest struct {
+	Channel string
+	Mode    uint8 // one of mq.SETTLE_*
+	Ids     []string
+	UpTo    string // settles too every message of the session distributed until this one
+}
+
+// EncodeFrame writes: string channel | uint8 mode | uint16 count | string id... | string up to.
+func (a *AckBatchRequest) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.String(a.Channel)
+	w.Uint8(a.Mode)
+	w.Count(len(a.Ids))
+	for _, id := range a.Ids {
+		w.String(id)
+	}
+	w.String(a.UpTo)
+}
+
+func (a *AckBatchRequest) DecodeFrame(r *tomq_codec.FrameReader) {
+	a.Channel = r.String()
+	a.Mode = r.Uint8()
+	count := int(r.Uint16())
+	a.Ids = nil
+	for i := 0; i < count && r.Err() == nil; i++ {
+		a.Ids = append(a.Ids, r.String())
+	}
+	a.UpTo = r.String()
+}
+
+// parseText reads: CHANNEL ack|nack|reject|requeue [ID]... [up-to=ID]
+func (a *AckBatchRequest) parseText(data []byte) error {
+	fields := bytes.Fields(data)
+	if len(fields) < 3 {
+		return errors.New("expected CHANNEL MODE ID...")
+	}
+	a.Channel = string(fields[0])
+	mode, ok := settleModes[string(fields[1])]
+	if !ok {
+		return fmt.Errorf("bad mode %q", fields[1])
+	}
+	a.Mode = mode
+	for _, f := range fields[2:] {
+		if bytes.HasPrefix(f, []byte("up-to=")) {
+			a.UpTo = string(f[len("up-to="):])
+			continue
+		}
+		a.Ids = append(a.Ids, string(f))
+	}
+	return nil
+}
+
+// BatchResult is the outcome of a message of a batch.
+type BatchResult struct {
+	Code  uint16
+	Id    string
+	Value string // the error message
+}
+
+// BatchResponse answers a framed batch request.
+type BatchResponse struct {
+	Code    uint16
+	Value   string // the error message when the whole request failed
+	Results []BatchResult
+}
+
+// EncodeFrame writes: uint16 code | string value | uint16 count |
+// (uint16 code | string id | string value)... for each message.
+func (b *BatchResponse) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.Uint16(b.Code)
+	w.String(b.Value)
+	w.Count(len(b.Results))
+	for _, res := range b.Results {
+		w.Uint16(res.Code)
+		w.String(res.Id)
+		w.String(res.Value)
+	}
+}
+
+func (b *BatchResponse) DecodeFrame(r *tomq_codec.FrameReader) {
+	b.Code = r.Uint16()
+	b.Value = r.String()
+	count := int(r.Uint16())
+	b.Results = nil
+	for i := 0; i < count && r.Err() == nil; i++ {
+		b.Results = append(b.Results, BatchResult{Code: r.Uint16(), Id: r.String(), Value: r.String()})
+	}
+}
+
+// MessageRequest is the payload of the ack, nack and reject opcodes.
+type MessageRequest struct {
+	Channel string
+	Id      string
+	Requeue bool // reject only
+}
+
+// EncodeFrame writes: string channel | string id | bool requeue.
+func (m *MessageRequest) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.String(m.Channel)
+	w.String(m.Id)
+	w.Bool(m.Requeue)
+}
+
+func (m *MessageRequest) DecodeFrame(r *tomq_codec.FrameReader) {
+	m.Channel = r.String()
+	m.Id = r.String()
+	m.Requeue = r.Bool()
+}
+
+// parseText reads: CHANNEL ID [requeue=true]
+func (m *MessageRequest) parseText(data []byte) error {
+	fields := bytes.Fields(data)
+	if len(fields) < 2 {
+		return errors.New("expected CHANNEL ID")
+	}
+	m.Channel = string(fields[0])
+	m.Id = string(fields[1])
+	m.Requeue = len(fields) > 2 && string(fields[2]) == "requeue=true"
+	return nil
+}
+
+// ChannelRequest is a payload naming a queue or an exchange: purge, exchange delete
+// and the cancel sent to consumers.
+type ChannelRequest struct {
+	Name string
+}
+
+// EncodeFrame writes: string name.
+func (n *ChannelRequest) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.String(n.Name)
+}
+
+func (n *ChannelRequest) DecodeFrame(r *tomq_codec.FrameReader) {
+	n.Name = r.String()
+}
+
+// parseText reads: NAME
+func (n *ChannelRequest) parseText(data []byte) error {
+	fields := bytes.Fields(data)
+	if len(fields) != 1 {
+		return errors.New("expected NAME")
+	}
+	n.Name = string(fields[0])
+	return nil
+}
+
+// DeclareRequest is the payload of ChannelCreateTcpReq.
+type DeclareRequest struct {
+	Channel string
+	Args    map[string]string // the queue properties, see CHANNEL DECLARE
+}
+
+// EncodeFrame writes: string channel | map args.
+func (d *DeclareRequest) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.String(d.Channel)
+	w.Map(d.Args)
+}
+
+func (d *DeclareRequest) DecodeFrame(r *tomq_codec.FrameReader) {
+	d.Channel = r.String()
+	d.Args = r.Map()
+}
+
+// parseText reads: CHANNEL [KEY=VALUE]...
+func (d *DeclareRequest) parseText(data []byte) error {
+	fields := bytes.Fields(data)
+	if len(fields) == 0 {
+		return errors.New("expected CHANNEL")
+	}
+	d.Channel = string(fields[0])
+	args, err := textArgs(fields[1:])
+	d.Args = args
+	return err
+}
+
+// options returns the queue options of the declaration.
+func (d *DeclareRequest) options() (mq.QueueOptions, error) {
+	args := make([]string, 0, len(d.Args))
+	for k, v := range d.Args {
+		args = append(args, k+"="+v)
+	}
+	sort.Strings(args)
+	opts, err := mq.ParseQueueArgs(args)
+	if err != nil {
+		return opts, invalid(err)
+	}
+	return opts, nil
+}
+
+// RegisterRequest is the payload of ConsumerRegisterTcpReq.
+type RegisterRequest struct {
+	Channel  string
+	Prefetch uint32 // 0 keeps the default
+}
+
+// EncodeFrame writes: string channel | uint32 prefetch.
+func (r *RegisterRequest) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.String(r.Channel)
+	w.Uint32(r.Prefetch)
+}
+
+func (r *RegisterRequest) DecodeFrame(fr *tomq_codec.FrameReader) {
+	r.Channel = fr.String()
+	r.Prefetch = fr.Uint32()
+}
+
+// parseText reads: CHANNEL [PREFETCH]
+func (r *RegisterRequest) parseText(data []byte) error {
+	fields := bytes.Fields(data)
+	if len(fields) == 0 || len(fields) > 2 {
+		return errors.New("expected CHANNEL [PREFETCH]")
+	}
+	r.Channel = string(fields[0])
+	if len(fields) == 2 {
+		prefetch, err := strconv.ParseUint(string(fields[1]), 10, 32)
+		if err != nil || prefetch == 0 {
+			return fmt.Errorf("bad prefetch %q", fields[1])
+		}
+		r.Prefetch = uint32(prefetch)
+	}
+	return nil
+}
+
+// NextRequest is the payload of MsgNextTcpReq.
+type NextRequest struct {
+	Channel string
+	Max     uint32 // messages to take at most, 0 takes one
+	Wait    uint32 // milliseconds to wait for a message when there's none
+}
+
+// EncodeFrame writes: string channel | uint32 max | uint32 wait.
+func (n *NextRequest) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.String(n.Channel)
+	w.Uint32(n.Max)
+	w.Uint32(n.Wait)
+}
+
+func (n *NextRequest) DecodeFrame(r *tomq_codec.FrameReader) {
+	n.Channel = r.String()
+	n.Max = r.Uint32()
+	n.Wait = r.Uint32()
+}
+
+// parseText reads: CHANNEL [max=N] [wait=MS]
+func (n *NextRequest) parseText(data []byte) error {
+	fields := bytes.Fields(data)
+	if len(fields) == 0 {
+		return errors.New("expected CHANNEL")
+	}
+	n.Channel = string(fields[0])
+	args, err := textArgs(fields[1:])
+	if err != nil {
+		return err
+	}
+	for k, v := range args {
+		value, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return fmt.Errorf("bad %s %q", k, v)
+		}
+		switch k {
+		case "max":
+			n.Max = uint32(value)
+		case "wait":
+			n.Wait = uint32(value)
+		default:
+			return fmt.Errorf("unknown argument %q", k)
+		}
+	}
+	return nil
+}
+
+// NextResponse answers a framed MsgNextTcpReq.
+type NextResponse struct {
+	Code     uint16
+	Value    string // the error message
+	Messages []*Distribute
+}
+
+// EncodeFrame writes: uint16 code | string value | uint16 count | distribute fields...
+func (n *NextResponse) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.Uint16(n.Code)
+	w.String(n.Value)
+	w.Count(len(n.Messages))
+	for _, d := range n.Messages {
+		d.EncodeFrame(w)
+	}
+}
+
+func (n *NextResponse) DecodeFrame(r *tomq_codec.FrameReader) {
+	n.Code = r.Uint16()
+	n.Value = r.String()
+	count := int(r.Uint16())
+	n.Messages = nil
+	for i := 0; i < count && r.Err() == nil; i++ {
+		d := &Distribute{}
+		d.DecodeFrame(r)
+		n.Messages = append(n.Messages, d)
+	}
+}
+
+// CreditRequest is the payload of ConsumerCreditTcpReq.
+type CreditRequest struct {
+	Channel string
+	Credit  uint32
+}
+
+// EncodeFrame writes: string channel | uint32 credit.
+func (r *CreditRequest) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.String(r.Channel)
+	w.Uint32(r.Credit)
+}
+
+func (r *CreditRequest) DecodeFrame(fr *tomq_codec.FrameReader) {
+	r.Channel = fr.String()
+	r.Credit = fr.Uint32()
+}
+
+// parseText reads: CHANNEL CREDIT
+func (r *CreditRequest) parseText(data []byte) error {
+	fields := bytes.Fields(data)
+	if len(fields) != 2 {
+		return errors.New("expected CHANNEL CREDIT")
+	}
+	r.Channel = string(fields[0])
+	credit, err := strconv.ParseUint(string(fields[1]), 10, 32)
+	if err != nil {
+		return fmt.Errorf("bad credit %q", fields[1])
+	}
+	r.Credit = uint32(credit)
+	return nil
+}
+
+// DeleteRequest is the payload of ChannelDeleteTcpReq.
+type DeleteRequest struct {
+	Channel  string
+	IfEmpty  bool
+	IfUnused bool
+}
+
+// EncodeFrame writes: string channel | bool if empty | bool if unused.
+func (d *DeleteRequest) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.String(d.Channel)
+	w.Bool(d.IfEmpty)
+	w.Bool(d.IfUnused)
+}
+
+func (d *DeleteRequest) DecodeFrame(r *tomq_codec.FrameReader) {
+	d.Channel = r.String()
+	d.IfEmpty = r.Bool()
+	d.IfUnused = r.Bool()
+}
+
+// parseText reads: CHANNEL [if-empty=BOOL] [if-unused=BOOL]
+func (d *DeleteRequest) parseText(data []byte) error {
+	fields := bytes.Fields(data)
+	if len(fields) == 0 {
+		return errors.New("expected CHANNEL")
+	}
+	d.Channel = string(fields[0])
+	args, err := textArgs(fields[1:])
+	if err != nil {
+		return err
+	}
+	for k, v := range args {
+		flag, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("bad %s %q", k, v)
+		}
+		switch k {
+		case "if-empty":
+			d.IfEmpty = flag
+		case "if-unused":
+			d.IfUnused = flag
+		default:
+			return fmt.Errorf("unknown argument %q", k)
+		}
+	}
+	return nil
+}
+
+// ExchangeRequest is the payload of ExchangeDeclareTcpReq.
+type ExchangeRequest struct {
+	Name string
+	Type string
+}
+
+// EncodeFrame writes: string name | string type.
+func (e *ExchangeRequest) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.String(e.Name)
+	w.String(e.Type)
+}
+
+func (e *ExchangeRequest) DecodeFrame(r *tomq_codec.FrameReader) {
+	e.Name = r.String()
+	e.Type = r.String()
+}
+
+// parseText reads: NAME TYPE
+func (e *ExchangeRequest) parseText(data []byte) error {
+	fields := bytes.Fields(data)
+	if len(fields) != 2 {
+		return errors.New("expected NAME TYPE")
+	}
+	e.Name = string(fields[0])
+	e.Type = string(fields[1])
+	return nil
+}
+
+// BindRequest is the payload of ExchangeBindTcpReq and ExchangeUnbindTcpReq.
+type BindRequest struct {
+	Exchange string
+	Channel  string
+	Key      string
+	Args     map[string]string // headers to match
+}
+
+// EncodeFrame writes: string exchange | string channel | string key | map args.
+func (b *BindRequest) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.String(b.Exchange)
+	w.String(b.Channel)
+	w.String(b.Key)
+	w.Map(b.Args)
+}
+
+func (b *BindRequest) DecodeFrame(r *tomq_codec.FrameReader) {
+	b.Exchange = r.String()
+	b.Channel = r.String()
+	b.Key = r.String()
+	b.Args = r.Map()
+}
+
+// parseText reads: EXCHANGE CHANNEL [KEY] [HEADER=VALUE]...
+func (b *BindRequest) parseText(data []byte) error {
+	fields := bytes.Fields(data)
+	if len(fields) < 2 {
+		return errors.New("expected EXCHANGE CHANNEL")
+	}
+	b.Exchange = string(fields[0])
+	b.Channel = string(fields[1])
+	rest := fields[2:]
+	if len(rest) > 0 && !bytes.Contains(rest[0], []byte("=")) {
+		b.Key = string(rest[0])
+		rest = rest[1:]
+	}
+	args, err := textArgs(rest)
+	b.Args = args
+	return err
+}
+
+// Distribute is the framed payload of MsgDistributeTcpReq.
+type Distribute struct {
+	Channel         string
+	Id              string
+	Data            []byte
+	Attempt         uint32
+	Redelivered     bool
+	Priority        uint8
+	ContentType     string
+	ContentEncoding string
+	CorrelationId   string
+	ReplyTo         string
+	Headers         map[string]string
+}
+
+// newDistribute returns the distribute payload of msg.
+func newDistribute(msg mq.QMessage) *Distribute {
+	return &Distribute{
+		Channel:         msg.Header.Channel,
+		Id:              msg.Id,
+		Data:            msg.Data,
+		Attempt:         uint32(msg.DeliveryCount),
+		Redelivered:     msg.Redelivered(),
+		Priority:        uint8(msg.Header.Priority),
+		ContentType:     msg.Header.ContentType,
+		ContentEncoding: msg.Header.ContentEncoding,
+		CorrelationId:   msg.Header.CorrelationId,
+		ReplyTo:         msg.Header.ReplyTo,
+		Headers:         msg.Header.Headers,
+	}
+}
+
+// EncodeFrame writes: string channel | string id | bytes data | uint32 attempt | bool redelivered |
+// uint8 priority | string content type | string content encoding | string correlation id |
+// string reply to | map headers.
+func (d *Distribute) EncodeFrame(w *tomq_codec.FrameWriter) {
+	w.String(d.Channel)
+	w.String(d.Id)
+	w.Bytes(d.Data)
+	w.Uint32(d.Attempt)
+	w.Bool(d.Redelivered)
+	w.Uint8(d.Priority)
+	w.String(d.ContentType)
+	w.String(d.ContentEncoding)
+	w.String(d.CorrelationId)
+	w.String(d.ReplyTo)
+	w.Map(d.Headers)
+}
+
+func (d *Distribute) DecodeFrame(r *tomq_codec.FrameReader) {
+	d.Channel = r.String()
+	d.Id = r.String()
+	d.Data = r.Bytes()
+	d.Attempt = r.Uint32()
+	d.Redelivered = r.Bool()
+	d.Priority = r.Uint8()
+	d.ContentType = r.String()
+	d.ContentEncoding = r.String()
+	d.CorrelationId = r.String()
+	d.ReplyTo = r.String()
+	d.Headers = r.Map()
+}
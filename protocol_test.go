@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"tomqserver/src/mq"
+	"tomqserver/src/tomq_codec"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishRequest_Text(t *testing.T) {
+	req := PublishRequest{}
+	assert.NoError(t, req.parseText([]byte("orders aGVsbG8= ttl=500 priority=3 content-type=application%2Fjson reply-to=REPLIES message-id=order-42 header.region=eu")))
+	assert.Equal(t, "orders", req.Channel)
+	assert.Equal(t, []byte("aGVsbG8="), req.Data)
+	assert.Equal(t, uint64(500), req.TTL)
+	assert.Equal(t, uint8(3), req.Priority)
+	assert.Equal(t, "application/json", req.ContentType)
+	assert.Equal(t, "REPLIES", req.ReplyTo)
+	assert.Equal(t, map[string]string{"region": "eu"}, req.Headers)
+
+	msg, err := req.message()
+	assert.NoError(t, err)
+	assert.Equal(t, "ORDERS", msg.Header.Channel)
+	assert.Equal(t, "order-42", msg.Id)
+	assert.NotZero(t, msg.Header.Expiration)
+
+	// used to panic or be accepted
+	for _, bad := range []string{"", "orders", "orders data ttl=0", "orders data priority=256", "orders data color=blue", "orders data ttl"} {
+		assert.Error(t, (&PublishRequest{}).parseText([]byte(bad)), bad)
+	}
+	// refused rather than truncated to its first word
+	err = (&PublishRequest{}).parseText([]byte("orders two words ttl=500"))
+	assert.ErrorContains(t, err, "single word")
+}
+
+func TestNextRequest_Text(t *testing.T) {
+	req := NextRequest{}
+	assert.NoError(t, req.parseText([]byte("orders max=10 wait=500")))
+	assert.Equal(t, NextRequest{Channel: "orders", Max: 10, Wait: 500}, req)
+	for _, bad := range []string{"", "orders max=-1", "orders wait", "orders limit=3"} {
+		assert.Error(t, (&NextRequest{}).parseText([]byte(bad)), bad)
+	}
+}
+
+func TestBatchRequests_Text(t *testing.T) {
+	publish := PublishBatchRequest{}
+	assert.NoError(t, publish.parseText([]byte("orders YQ== priority=1\n\naudit Yg==\n")))
+	if assert.Len(t, publish.Messages, 2) {
+		assert.Equal(t, "orders", publish.Messages[0].Channel)
+		assert.Equal(t, uint8(1), publish.Messages[0].Priority)
+		assert.Equal(t, "audit", publish.Messages[1].Channel)
+	}
+	assert.Error(t, (&PublishBatchRequest{}).parseText([]byte("orders YQ==\naudit")), "a bad line fails the batch")
+	assert.Error(t, (&PublishBatchRequest{}).parseText([]byte("\n")))
+
+	ack := AckBatchRequest{}
+	assert.NoError(t, ack.parseText([]byte("orders reject a b up-to=c")))
+	assert.Equal(t, AckBatchRequest{Channel: "orders", Mode: mq.SETTLE_REJECT, Ids: []string{"a", "b"}, UpTo: "c"}, ack)
+	for _, bad := range []string{"", "orders ack", "orders drop a"} {
+		assert.Error(t, (&AckBatchRequest{}).parseText([]byte(bad)), bad)
+	}
+}
+
+func TestPublisherRequest_Text(t *testing.T) {
+	req := PublisherRequest{}
+	assert.NoError(t, req.parseText(nil))
+	assert.True(t, req.Confirm)
+	assert.NoError(t, req.parseText([]byte("confirm=false")))
+	assert.False(t, req.Confirm)
+	assert.Error(t, req.parseText([]byte("confirm=maybe")))
+	assert.Error(t, req.parseText([]byte("mandatory=true")))
+}
+
+func TestTxRequest_Text(t *testing.T) {
+	assert.NoError(t, (&TxRequest{}).parseText(nil))
+	assert.NoError(t, (&TxRequest{}).parseText([]byte(" \n")))
+	assert.Error(t, (&TxRequest{}).parseText([]byte("orders")))
+}
+
+func TestRequests_FrameRoundTrip(t *testing.T) {
+	codec := &tomq_codec.FrameCodec{}
+	requests := []struct {
+		in  tomq_codec.FrameEncoder
+		out tomq_codec.FrameDecoder
+	}{
+		{&PublishRequest{Channel: "orders", Exchange: "events", Data: []byte("two words"), MessageId: "id",
+			TTL: 1, Delay: 2, At: 3, Priority: 4, ContentType: "text/plain", ContentEncoding: "gzip",
+			CorrelationId: "c", ReplyTo: "r", Headers: map[string]string{"region": "eu"}}, &PublishRequest{}},
+		{&MessageRequest{Channel: "orders", Id: "id", Requeue: true}, &MessageRequest{}},
+		{&ChannelRequest{Name: "orders"}, &ChannelRequest{}},
+		{&DeclareRequest{Channel: "orders", Args: map[string]string{"max-length": "10"}}, &DeclareRequest{}},
+		{&RegisterRequest{Channel: "orders", Prefetch: 10}, &RegisterRequest{}},
+		{&CreditRequest{Channel: "orders", Credit: 5}, &CreditRequest{}},
+		{&PublishBatchRequest{Messages: []*PublishRequest{{Channel: "orders", Data: []byte("a")}, {Channel: "audit", Data: []byte("b"), Priority: 2}}}, &PublishBatchRequest{}},
+		{&AckBatchRequest{Channel: "orders", Mode: mq.SETTLE_REQUEUE, Ids: []string{"a", "b"}, UpTo: "c"}, &AckBatchRequest{}},
+		{&BatchResponse{Results: []BatchResult{{Id: "a"}, {Code: CODE_NOT_FOUND, Id: "b", Value: "QMessage not found"}}}, &BatchResponse{}},
+		{&PublisherRequest{Confirm: true}, &PublisherRequest{}},
+		{&TxRequest{}, &TxRequest{}},
+		{&Confirm{Seq: 7, Code: CODE_QUEUE_FULL, Value: "queue full"}, &Confirm{}},
+		{&NextRequest{Channel: "orders", Max: 10, Wait: 500}, &NextRequest{}},
+		{&NextResponse{Messages: []*Distribute{newDistribute(mq.NewMessage("ORDERS", []byte("a"))), newDistribute(mq.NewMessage("ORDERS", []byte("b")))}}, &NextResponse{}},
+		{&DeleteRequest{Channel: "orders", IfEmpty: true}, &DeleteRequest{}},
+		{&ExchangeRequest{Name: "events", Type: "topic"}, &ExchangeRequest{}},
+		{&BindRequest{Exchange: "events", Channel: "orders", Key: "order.#", Args: map[string]string{"x-match": "any"}}, &BindRequest{}},
+		{&Response{Code: CODE_QUEUE_FULL, Value: "queue full"}, &Response{}},
+		{newDistribute(mq.NewMessage("ORDERS", []byte("data"))), &Distribute{}},
+	}
+	for _, r := range requests {
+		data, err := codec.Encode(r.in)
+		assert.NoError(t, err)
+		assert.True(t, tomq_codec.IsFrame(data))
+		assert.NoError(t, codec.Decode(data, r.out))
+		assert.Equal(t, r.in, r.out)
+
+		// every truncation is reported, none panics
+		for n := 2; n < len(data)-1; n++ {
+			assert.Error(t, codec.Decode(data[:n], r.out), "%T truncated at %d", r.in, n)
+		}
+	}
+
+	// too long for their length prefix, they fail instead of going out of sync
+	many := &BatchResponse{Results: make([]BatchResult, tomq_codec.FrameMaxCount+1)}
+	_, err := codec.Encode(many)
+	assert.ErrorIs(t, err, tomq_codec.ErrFrameTooLong)
+	long := &PublishRequest{Channel: "orders", Headers: map[string]string{"region": strings.Repeat("x", mq.MAX_HEADER_SIZE+1)}}
+	_, err = codec.Encode(long)
+	assert.ErrorIs(t, err, tomq_codec.ErrFrameTooLong)
+	_, err = long.message()
+	assert.Equal(t, uint16(CODE_INVALID_REQUEST), errorCode(err), "refused at publish time")
+}
+
+func TestErrorCode(t *testing.T) {
+	assert.Equal(t, uint16(CODE_OK), errorCode(nil))
+	assert.Equal(t, uint16(CODE_NOT_FOUND), errorCode(mq.ErrNoQueue))
+	assert.Equal(t, uint16(CODE_QUEUE_FULL), errorCode(fmt.Errorf("queue BILLING: %w", mq.ErrQueueFull)))
+	assert.Equal(t, uint16(CODE_PRECONDITION), errorCode(mq.ErrQueueNotEmpty))
+	assert.Equal(t, uint16(CODE_ACCESS_REFUSED), errorCode(mq.ErrExclusive))
+	assert.Equal(t, uint16(CODE_ACCESS_REFUSED), errorCode(mq.ErrTxConsumer))
+	assert.Equal(t, uint16(CODE_PRECONDITION), errorCode(fmt.Errorf("%w 1005 for id", mq.ErrTxDuplicate)))
+	assert.Equal(t, uint16(CODE_PRECONDITION), errorCode(mq.ErrNoTx))
+	assert.Equal(t, uint16(CODE_MALFORMED), errorCode(fmt.Errorf("%w: short", errMalformed)))
+	assert.Equal(t, uint16(CODE_INTERNAL), errorCode(fmt.Errorf("disk full")))
+}
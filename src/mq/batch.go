@@ -0,0 +1,151 @@
+package mq
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+A batch appends all its records to the queue logs before waiting for any of them,
+so whatever the durability a batch costs one sync per queue instead of one per message.
+The records of a queue are appended at once with q.m held, the log batch is opened and
+closed under it: a batch which holds back the syncs of a queue never waits for its lock.
+*/
+
+// how SettleBatch settles the messages
+const (
+	SETTLE_ACK     = 0
+	SETTLE_NACK    = 1
+	SETTLE_REJECT  = 2 // to the dead letter queue
+	SETTLE_REQUEUE = 3
+)
+
+// PublishBatch publishes every message to the queue named by its channel, when durable
+// the messages are on disk whatever the queue durability. Returns the result of each
+// message, in order.
+func (qc *queuesControl) PublishBatch(msgs []QMessage, durable bool) []error {
+	errs := make([]error, len(msgs))
+	commits := make([]commit, len(msgs))
+	queues := make([]*queue, len(msgs))
+	batching := []*queue{}
+	batches := map[*queue][]int{}
+	for i, msg := range msgs {
+		q, err := qc.GetOrCreate(msg.Header.Channel)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if _, ok := batches[q]; !ok {
+			batching = append(batching, q)
+		}
+		batches[q] = append(batches[q], i)
+		queues[i] = q
+	}
+	deadLetters := map[*queue][]deadLetter{}
+	for _, q := range batching {
+		q.m.Lock()
+		q.log.begin()
+		for _, i := range batches[q] {
+			c, dls, err := q.store(msgs[i])
+			deadLetters[q] = append(deadLetters[q], dls...)
+			commits[i], errs[i] = c, err
+		}
+		q.log.end()
+		q.m.Unlock()
+	}
+	for i, c := range commits {
+		if errs[i] != nil {
+			continue
+		}
+		if durable {
+			errs[i] = queues[i].durable(c)
+		} else {
+			errs[i] = c.Wait()
+		}
+	}
+	// a dead letter queue may be one of the batch, it can publish now
+	for _, q := range batching {
+		q.sendDeadLetters(deadLetters[q])
+	}
+	return errs
+}
+
+// SettleBatch acks, nacks, rejects or requeues every message of ids for session sid,
+// see the SETTLE_* modes and Ack. Returns the result of each message, in order.
+func (q *queue) SettleBatch(sid string, ids []string, how int) []error {
+	errs := make([]error, len(ids))
+	commits := make([]commit, len(ids))
+	deadLetters := []deadLetter{}
+	q.m.Lock()
+	q.log.begin()
+	for i, id := range ids {
+		switch how {
+		case SETTLE_ACK:
+			commits[i], errs[i] = q.ack(sid, id)
+		case SETTLE_NACK:
+			commits[i], errs[i] = q.unAck(sid, id)
+		case SETTLE_REJECT, SETTLE_REQUEUE:
+			c, dl, err := q.reject(sid, id, how == SETTLE_REQUEUE)
+			if dl != nil {
+				deadLetters = append(deadLetters, *dl)
+			}
+			commits[i], errs[i] = c, err
+		}
+	}
+	q.log.end()
+	q.m.Unlock()
+	for i, c := range commits {
+		if errs[i] == nil {
+			errs[i] = c.Wait()
+		}
+	}
+	q.sendDeadLetters(deadLetters)
+	return errs
+}
+
+// HeldUpTo returns, in distribution order, the messages session sid holds
+// which were distributed no later than message id, id included. The order is
+// the one of their delivery transactions, not of their timestamps.
+func (q *queue) HeldUpTo(sid string, id string) ([]string, error) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	held := []*QMessage{}
+	for _, c := range q.consumers {
+		if sid != fmt.Sprint(c.session.ID()) {
+			continue
+		}
+		for heldId := range c.inFlight {
+			if msg, ok := q.storage[heldId]; ok {
+				held = append(held, msg)
+			}
+		}
+	}
+	for heldId, holder := range q.pulled {
+		if msg, ok := q.storage[heldId]; ok && holder == sid {
+			held = append(held, msg)
+		}
+	}
+	last, ok := q.tm.distributed(id)
+	if !ok || !containsMessage(held, id) {
+		return nil, ErrNoMessage
+	}
+	seqs := map[string]uint64{}
+	ids := []string{}
+	for _, msg := range held {
+		if seq, ok := q.tm.distributed(msg.Id); ok && seq <= last {
+			seqs[msg.Id] = seq
+			ids = append(ids, msg.Id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return seqs[ids[i]] < seqs[ids[j]] })
+	return ids, nil
+}
+
+func containsMessage(msgs []*QMessage, id string) bool {
+	for _, msg := range msgs {
+		if msg.Id == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package mq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueuesControl_PublishBatch(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueue("orders"))
+	assert.NoError(t, qc.NewQueueWithOptions("audit", QueueOptions{MaxLength: 1, Overflow: OVERFLOW_REJECT_PUBLISH}))
+
+	msgs := []QMessage{
+		NewMessage("ORDERS", []byte("1")),
+		NewMessage("AUDIT", []byte("2")),
+		NewMessage("ORDERS", []byte("3")),
+		NewMessage("AUDIT", []byte("4")),
+	}
+	errs := qc.PublishBatch(msgs, false)
+	assert.NoError(t, errs[0])
+	assert.NoError(t, errs[1])
+	assert.NoError(t, errs[2])
+	assert.ErrorIs(t, errs[3], ErrQueueFull)
+
+	orders, _ := qc.GetQueue("ORDERS")
+	assert.Equal(t, []string{msgs[0].Id, msgs[2].Id}, readyIds(orders))
+	audit, _ := qc.GetQueue("AUDIT")
+	assert.Equal(t, []string{msgs[1].Id}, readyIds(audit))
+	for _, q := range []*queue{orders, audit} {
+		assert.Zero(t, q.log.batching)
+		assert.Empty(t, q.log.waiters)
+	}
+}
+
+func TestQueue_SettleBatch(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueueWithOptions("work", QueueOptions{DeadLetter: "dead"}))
+	q, _ := qc.GetQueue("WORK")
+	sent := publishAll(t, q, 5)
+	ch := deliveries(q)
+	c := NewConsumer(&testSession{id: 1})
+	c.SetPrefetch(5)
+	assert.NoError(t, q.RegisterConsumer(*c))
+	for range sent {
+		receive(t, ch)
+	}
+	// distributed in the same instant, and one of them nacked out of the ack deadlines
+	assert.NoError(t, q.UnAck("1", sent[1].Id))
+	q.m.Lock()
+	now := time.Now().UnixNano()
+	for _, msg := range q.storage {
+		msg.Header.Timestamp = now
+	}
+	q.m.Unlock()
+
+	ids, err := q.HeldUpTo("1", sent[2].Id)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{sent[0].Id, sent[1].Id, sent[2].Id}, ids)
+	_, err = q.HeldUpTo("2", sent[2].Id)
+	assert.Equal(t, ErrNoMessage, err)
+
+	errs := q.SettleBatch("1", append(ids, "missing"), SETTLE_ACK)
+	assert.Equal(t, []error{nil, nil, nil, ErrNoMessage}, errs)
+	assert.Equal(t, 2, q.TotalMesssages())
+
+	assert.Equal(t, []error{nil, ErrNoMessage}, q.SettleBatch("1", []string{sent[3].Id, "missing"}, SETTLE_REJECT))
+	dead, err := qc.GetQueue("DEAD")
+	assert.NoError(t, err)
+	waitMessages(t, dead, 1)
+
+	// the consumer has room again, the requeued message comes back to it
+	assert.Equal(t, []error{nil}, q.SettleBatch("1", []string{sent[4].Id}, SETTLE_REQUEUE))
+	assert.Equal(t, sent[4].Id, receive(t, ch).Id)
+}
@@ -0,0 +1,271 @@
+package mq
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+Compaction runs in a goroutine per queue and only touches sealed segments,
+so publishers keep appending to the active segment meanwhile.
+
+A sealed segment is rewritten keeping:
+  - publish records of live messages homed in it
+  - status records of live messages
+  - status records of finished messages homed in an older segment that still exists,
+    otherwise replaying that segment would bring the message back
+
+Kept records are copied byte for byte, so the placement of live messages stays valid.
+A segment left with nothing to keep is deleted.
+*/
+
+const compactExt = ".compact"
+
+// compactionStats is what the compactor of a queue did since startup.
+type compactionStats struct {
+	Runs              int   `json:"runs"`
+	SegmentsRewritten int   `json:"segments_rewritten"`
+	SegmentsRemoved   int   `json:"segments_removed"`
+	BytesReclaimed    int64 `json:"bytes_reclaimed"`
+}
+
+// logStats describes the disk usage of a queue log.
+type logStats struct {
+	Segments   int             `json:"segments"`
+	DiskBytes  int64           `json:"disk_bytes"`
+	LiveBytes  int64           `json:"live_bytes"`
+	Compaction compactionStats `json:"compaction"`
+}
+
+// scannedRecord is a decoded record with its raw bytes.
+type scannedRecord struct {
+	rec logRecord
+	raw []byte
+}
+
+// Stats returns the current disk usage of the log.
+func (l *segmentLog) Stats() logStats {
+	if l == nil {
+		return logStats{}
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	st := logStats{
+		Segments:   len(l.segments),
+		Compaction: l.stats,
+	}
+	for _, seg := range l.segments {
+		st.DiskBytes += seg.size
+		st.LiveBytes += seg.liveBytes
+	}
+	return st
+}
+
+// compact rewrites or removes the sealed segments whose live ratio dropped below ratio.
+func (l *segmentLog) compact(ratio float64) error {
+	for _, seg := range l.compactionCandidates(ratio) {
+		if err := l.compactSegment(seg); err != nil {
+			return err
+		}
+	}
+	l.m.Lock()
+	l.stats.Runs++
+	l.m.Unlock()
+	return nil
+}
+
+// compactionCandidates returns the sealed segments under ratio which changed since
+// their last compaction: they lost live bytes or an older segment was removed.
+func (l *segmentLog) compactionCandidates(ratio float64) []*segment {
+	l.m.Lock()
+	defer l.m.Unlock()
+	candidates := []*segment{}
+	for _, seg := range l.segments[:len(l.segments)-1] {
+		if float64(seg.liveBytes) >= ratio*float64(seg.size) {
+			continue
+		}
+		if seg.compacted && seg.liveBytes >= seg.compactedLive && seg.compactedAt == l.stats.SegmentsRemoved {
+			continue
+		}
+		candidates = append(candidates, seg)
+	}
+	return candidates
+}
+
+func (l *segmentLog) compactSegment(seg *segment) error {
+	records, err := scanSegment(seg.path)
+	if err != nil {
+		return err
+	}
+
+	l.m.Lock()
+	// what kept accounts for, a release after this makes the segment a candidate again
+	live := seg.liveBytes
+	kept := make([]byte, 0, live)
+	count := 0
+	for _, r := range records {
+		if l.keepRecord(seg, r.rec) {
+			kept = append(kept, r.raw...)
+			count++
+		}
+	}
+	l.m.Unlock()
+
+	if len(kept) == 0 {
+		if err := os.Remove(seg.path); err != nil {
+			return err
+		}
+		l.m.Lock()
+		for i, s := range l.segments {
+			if s == seg {
+				l.segments = append(l.segments[:i], l.segments[i+1:]...)
+				break
+			}
+		}
+		l.stats.SegmentsRemoved++
+		l.stats.BytesReclaimed += seg.size
+		l.m.Unlock()
+		return syncDir(filepath.Dir(seg.path))
+	}
+
+	if int64(len(kept)) < seg.size {
+		if err := replaceFile(seg.path, kept); err != nil {
+			return err
+		}
+		if err := syncDir(filepath.Dir(seg.path)); err != nil {
+			return err
+		}
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if reclaimed := seg.size - int64(len(kept)); reclaimed > 0 {
+		l.stats.SegmentsRewritten++
+		l.stats.BytesReclaimed += reclaimed
+	}
+	seg.size = int64(len(kept))
+	seg.records = count
+	seg.compacted = true
+	seg.compactedLive = live
+	seg.compactedAt = l.stats.SegmentsRemoved
+	return nil
+}
+
+// keepRecord tells if a record of seg is still needed, l.m must be held.
+func (l *segmentLog) keepRecord(seg *segment, rec logRecord) bool {
+	home, live := l.homes[rec.id]
+	switch rec.kind {
+	case recordPublish:
+		return live && home.seg == seg
+	case recordStatus:
+		if live {
+			return true
+		}
+		return rec.home != seg.id && l.hasSegment(rec.home)
+	}
+	return false
+}
+
+func (l *segmentLog) hasSegment(id uint64) bool {
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i].id >= id })
+	return i < len(l.segments) && l.segments[i].id == id
+}
+
+// scanSegment reads the valid records of a sealed segment.
+// Records that failed at recovery are left out, they were already reported.
+func scanSegment(path string) ([]scannedRecord, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	records := []scannedRecord{}
+	for pos := int64(0); pos+recordHeaderSize <= int64(len(data)); {
+		hdr := data[pos : pos+recordHeaderSize]
+		kind, size, err := parseRecordHeader(hdr)
+		if err != nil {
+			break
+		}
+		next := pos + recordHeaderSize + size
+		if next > int64(len(data)) {
+			break
+		}
+		body := data[pos+recordHeaderSize : next]
+		if verifyRecord(hdr, body) == nil {
+			if rec, err := decodeRecord(kind, body); err == nil {
+				records = append(records, scannedRecord{rec: rec, raw: data[pos:next]})
+			}
+		}
+		pos = next
+	}
+	return records, nil
+}
+
+// replaceFile atomically replaces the content of path.
+func replaceFile(path string, data []byte) error {
+	tmp := path + compactExt
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// syncDir makes the files created, renamed or removed in dir last.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// removeCompactionLeftovers deletes the files of a compaction stopped by a crash,
+// the original segments are still in place.
+func removeCompactionLeftovers(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), compactExt) {
+			if err := os.Remove(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// compactor compacts the queue log every interval until the queue is closed.
+func (q *queue) compactor(interval time.Duration, ratio float64) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+			if err := q.log.compact(ratio); err != nil {
+				log.Println("[MQ] queue", q.name, "compaction failed:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package mq
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegmentLog_Compact(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openQueue("TEST", dir, &QueueOptions{Durability: DURABILITY_NONE})
+	assert.NoError(t, err)
+	q.log.maxSize = 256
+
+	ids := []string{}
+	for i := 0; i < 12; i++ {
+		msg := NewMessage("TEST", []byte("some data to fill segments"))
+		assert.NoError(t, q.Publish(msg))
+		ids = append(ids, msg.Id)
+	}
+	// ack everything but the first segment messages, except its second one
+	first := q.log.segments[0]
+	pending := []string{}
+	for _, id := range ids {
+		if home := q.log.homes[id]; home.seg != first || id == ids[1] {
+			assert.NoError(t, q.Ack("", id))
+		} else {
+			pending = append(pending, id)
+		}
+	}
+	assert.Greater(t, len(pending), 1)
+	before := q.log.Stats()
+	assert.NoError(t, q.log.compact(0.5))
+	after := q.log.Stats()
+	assert.Less(t, after.DiskBytes, before.DiskBytes)
+	assert.Less(t, after.Segments, before.Segments)
+	assert.Equal(t, before.DiskBytes-after.DiskBytes, after.Compaction.BytesReclaimed)
+	assert.Equal(t, before.LiveBytes, after.LiveBytes)
+	assert.Equal(t, first, q.log.segments[0])
+
+	// nothing changed since, nothing to do
+	assert.Empty(t, q.log.compactionCandidates(0.5))
+	assert.NoError(t, q.Close())
+
+	q2, err := openQueue("TEST", dir, nil)
+	assert.NoError(t, err)
+	defer q2.Close() // nolint
+	assert.Empty(t, q2.recovery.Problems)
+	assert.Equal(t, pending, readyIds(q2))
+}
+
+func TestSegmentLog_CompactKeepsTombstones(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openQueue("TEST", dir, &QueueOptions{Durability: DURABILITY_NONE})
+	assert.NoError(t, err)
+
+	a := NewMessage("TEST", []byte("a"))
+	b := NewMessage("TEST", []byte("b"))
+	assert.NoError(t, q.Publish(a))
+	assert.NoError(t, q.Publish(b))
+	q.log.m.Lock()
+	assert.NoError(t, q.log.roll())
+	q.log.m.Unlock()
+	// the ack of a lives in the second segment, a itself in the first
+	assert.NoError(t, q.Ack("", a.Id))
+	q.log.m.Lock()
+	assert.NoError(t, q.log.roll())
+	q.log.m.Unlock()
+
+	assert.NoError(t, q.log.compactSegment(q.log.segments[1]))
+	assert.Len(t, q.log.segments, 3)
+	assert.Equal(t, 1, q.log.segments[1].records)
+	assert.NoError(t, q.Close())
+
+	q2, err := openQueue("TEST", dir, nil)
+	assert.NoError(t, err)
+	defer q2.Close() // nolint
+	assert.Equal(t, []string{b.Id}, readyIds(q2))
+}
@@ -0,0 +1,71 @@
+package mq
+
+import (
+	"fmt"
+)
+
+/*
+A confirmed publish returns once the message is appended to the queue log, so the
+publishes of a session keep their order, and calls back once it's on disk. The queues
+storing with durability none are synced for it, the transient ones have no disk and
+confirm once the message is in memory.
+*/
+
+// ConfirmHandler gets the result of a confirmed publish.
+type ConfirmHandler func(err error)
+
+// PublishConfirm publishes msg and calls confirm from another goroutine once
+// it's on disk, or with the reason it couldn't be stored.
+func (q *queue) PublishConfirm(msg QMessage, confirm ConfirmHandler) {
+	wait := q.publishDurable(msg)
+	go func() {
+		confirm(wait())
+	}()
+}
+
+// PublishToConfirm publishes msg to the queues bound to the exchange like PublishTo
+// and calls confirm from another goroutine once every copy is on disk.
+func (qc *queuesControl) PublishToConfirm(exchangeName string, routingKey string, msg QMessage, confirm ConfirmHandler) {
+	targets, err := qc.targets(exchangeName, routingKey, msg.Header.Headers)
+	if err != nil {
+		go confirm(err)
+		return
+	}
+	waits := make([]func() error, len(targets))
+	for i, q := range targets {
+		waits[i] = q.publishDurable(routedCopy(msg, q.name))
+	}
+	go func() {
+		var first error
+		for i, wait := range waits {
+			if err := wait(); err != nil && first == nil {
+				first = fmt.Errorf("queue %s: %w", targets[i].name, err)
+			}
+		}
+		confirm(first)
+	}()
+}
+
+// publishDurable stores msg and returns how to wait until it's on disk,
+// whatever the queue durability.
+func (q *queue) publishDurable(msg QMessage) func() error {
+	c, deadLetters, err := q.publish(msg)
+	return func() error {
+		q.sendDeadLetters(deadLetters)
+		if err != nil {
+			return err
+		}
+		return q.durable(c)
+	}
+}
+
+// durable waits for c and syncs the log when the queue durability didn't.
+func (q *queue) durable(c commit) error {
+	if err := c.Wait(); err != nil {
+		return err
+	}
+	if q.options.Durability == DURABILITY_NONE {
+		return q.Persist()
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package mq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// confirmed returns a confirm handler and the channel receiving its results.
+func confirmed() (ConfirmHandler, chan error) {
+	ch := make(chan error, 16)
+	return func(err error) { ch <- err }, ch
+}
+
+func confirmation(t *testing.T, ch chan error) error {
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatal("no confirm")
+	}
+	return nil
+}
+
+func TestQueue_PublishConfirm(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueueWithOptions("work", QueueOptions{Durability: DURABILITY_NONE}))
+	q, _ := qc.GetQueue("WORK")
+	confirm, ch := confirmed()
+
+	msgs := []QMessage{NewMessage("WORK", []byte("1")), NewMessage("WORK", []byte("2")), NewMessage("WORK", []byte("3"))}
+	for _, msg := range msgs {
+		q.PublishConfirm(msg, confirm)
+	}
+	for range msgs {
+		assert.NoError(t, confirmation(t, ch))
+	}
+	// appended in order before any confirm
+	assert.Equal(t, []string{msgs[0].Id, msgs[1].Id, msgs[2].Id}, readyIds(q))
+
+	q.PublishConfirm(msgs[0], confirm)
+	assert.Equal(t, ErrDuplicateId, confirmation(t, ch))
+}
+
+func TestQueuesControl_PublishToConfirm(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueue("billing"))
+	assert.NoError(t, qc.NewQueueWithOptions("audit", QueueOptions{Transient: true}))
+	assert.NoError(t, qc.DeclareExchange("events", EXCHANGE_FANOUT))
+	confirm, ch := confirmed()
+
+	qc.PublishToConfirm("events", "", NewMessage("", []byte("event")), confirm)
+	assert.Equal(t, ErrUnroutable, confirmation(t, ch))
+	qc.PublishToConfirm("missing", "", NewMessage("", []byte("event")), confirm)
+	assert.Equal(t, ErrNoExchange, confirmation(t, ch))
+
+	assert.NoError(t, qc.Bind("events", "billing", "", nil))
+	assert.NoError(t, qc.Bind("events", "audit", "", nil))
+	qc.PublishToConfirm("events", "", NewMessage("", []byte("event")), confirm)
+	assert.NoError(t, confirmation(t, ch))
+	for _, name := range []string{"BILLING", "AUDIT"} {
+		q, _ := qc.GetQueue(name)
+		assert.Equal(t, 1, q.TotalMesssages(), name)
+	}
+}
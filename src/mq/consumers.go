@@ -1,6 +1,7 @@
 package mq
 
 import (
+	"math"
 	"tomqserver/src/server"
 )
 
@@ -8,12 +9,20 @@ const (
 	CONSUMER_STATUS_IDLE         = 0
 	CONSUMER_STATUS_WORKING      = 1
 	CONSUMER_STATUS_WAITING_NACK = 2
+	CONSUMER_STATUS_CLOSED       = 3
+
+	// DEFAULT_PREFETCH is the in-flight window of a consumer which didn't ask for one.
+	DEFAULT_PREFETCH = 1
+	// MAX_PREFETCH bounds the in-flight window, whatever the credit.
+	MAX_PREFETCH = math.MaxInt32
 )
 
 type consumer struct {
 	session     server.Session
 	status      int
 	lastMessage int64
+	prefetch    int                 // max messages in flight
+	inFlight    map[string]struct{} // distributed and not yet acked or rejected
 }
 
 func NewConsumer(s server.Session) *consumer {
@@ -21,6 +30,8 @@ func NewConsumer(s server.Session) *consumer {
 		session:     s,
 		status:      CONSUMER_STATUS_IDLE,
 		lastMessage: 0,
+		prefetch:    DEFAULT_PREFETCH,
+		inFlight:    map[string]struct{}{},
 	}
 	return &c
 }
@@ -34,3 +45,62 @@ func (c *consumer) Status() int {
 func (c *consumer) SetStatus(s int) {
 	c.status = s
 }
+
+// SetPrefetch sets how many messages the consumer can hold without acking them.
+func (c *consumer) SetPrefetch(n int) {
+	if n < 1 {
+		n = DEFAULT_PREFETCH
+	} else if n > MAX_PREFETCH {
+		n = MAX_PREFETCH
+	}
+	c.prefetch = n
+}
+
+// credit widens the window by n messages, up to MAX_PREFETCH.
+func (c *consumer) credit(n int) {
+	if c.prefetch > MAX_PREFETCH-n {
+		c.prefetch = MAX_PREFETCH
+		return
+	}
+	c.prefetch += n
+}
+
+func (c *consumer) Prefetch() int {
+	return c.prefetch
+}
+
+func (c *consumer) InFlight() int {
+	return len(c.inFlight)
+}
+
+// hasCredit tells if the consumer can take one more message.
+func (c *consumer) hasCredit() bool {
+	return c.status != CONSUMER_STATUS_CLOSED && len(c.inFlight) < c.prefetch
+}
+
+func (c *consumer) take(id string) {
+	c.inFlight[id] = struct{}{}
+	c.refreshStatus()
+}
+
+// release frees the slot of message id, returns false when the consumer didn't hold it.
+func (c *consumer) release(id string) bool {
+	if _, ok := c.inFlight[id]; !ok {
+		return false
+	}
+	delete(c.inFlight, id)
+	c.refreshStatus()
+	return true
+}
+
+// refreshStatus sets WAITING_NACK while the window is full, IDLE otherwise.
+func (c *consumer) refreshStatus() {
+	if c.status == CONSUMER_STATUS_CLOSED {
+		return
+	}
+	if len(c.inFlight) >= c.prefetch {
+		c.status = CONSUMER_STATUS_WAITING_NACK
+	} else {
+		c.status = CONSUMER_STATUS_IDLE
+	}
+}
@@ -0,0 +1,175 @@
+package mq
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+/*
+A message is dead-lettered when it reaches the MaxDeliveries of its queue,
+when a consumer rejects it without requeue or, with DeadLetterExpired,
+when it expires. Queue overflows can dead-letter too, see limits.go. It's published as a new
+message to the DeadLetter queue of the options, with headers telling where
+it comes from; without a DeadLetter queue it's dropped.
+
+The copy is published before the original is removed, a crash in between
+leaves the message in both queues but never in none. An overflowed message
+leaves the queue first but stays in its log until the copy is stored, see limits.go.
+*/
+
+const (
+	HEADER_DEATH_QUEUE  = "x-death-queue"  // queue the message was dead-lettered from
+	HEADER_DEATH_REASON = "x-death-reason" // one of DEATH_REASON_*
+	HEADER_DEATH_COUNT  = "x-death-count"  // delivery attempts before it died
+	HEADER_DEATH_ID     = "x-death-id"     // id of the message in the original queue
+
+	DEATH_REASON_REJECTED       = "rejected"
+	DEATH_REASON_MAX_DELIVERIES = "max-deliveries"
+	DEATH_REASON_EXPIRED        = "expired"
+)
+
+// DeadLetterRoute publishes a dead-lettered message to queue.
+type DeadLetterRoute func(queue string, msg QMessage) error
+
+type deadLetter struct {
+	queue   string
+	msg     QMessage
+	evicted *QMessage // original already out of the queue but not of its log, see makeRoom
+}
+
+func (q *queue) setDeadLetterRoute(r DeadLetterRoute) {
+	q.m.Lock()
+	q.deadLetterRoute = r
+	q.m.Unlock()
+}
+
+// exhausted tells if msg used all the deliveries of the queue, q.m must be held.
+func (q *queue) exhausted(msg *QMessage) bool {
+	return q.options.MaxDeliveries > 0 && msg.DeliveryCount >= q.options.MaxDeliveries
+}
+
+// retire takes msg out of distribution because of reason. Returns the copy
+// to publish to the dead letter queue, or nil when msg was dropped. q.m must be held.
+func (q *queue) retire(msg *QMessage, reason string) (*deadLetter, commit) {
+	q.release(msg.Id)
+	status := STATUS_MESSAGE_REJECTED
+	if reason == DEATH_REASON_EXPIRED {
+		q.expired++
+		status = STATUS_MESSAGE_EXPIRED
+	}
+	if q.options.DeadLetter == "" || (reason == DEATH_REASON_EXPIRED && !q.options.DeadLetterExpired) {
+		log.Println("[MQ] queue", q.name, "drops message", msg.Id+":", reason)
+		c, err := q.remove(msg, status)
+		if err != nil {
+			log.Println("[MQ] queue", q.name, "message", msg.Id, "not dropped:", err)
+		}
+		return nil, c
+	}
+	// hidden from distribution until the copy is stored, if that fails
+	// the message comes back when its ack expires and is retried
+	msg.Status = STATUS_MESSAGE_WAITING_NACK
+	msg.Header.Timestamp = time.Now().UnixNano()
+	q.index.wait(msg)
+	if deadline := msg.Header.Timestamp + q.ackTimeout(); q.ackDeadline == 0 || deadline < q.ackDeadline {
+		q.ackDeadline = deadline
+	}
+
+	dl := q.deadLetterCopy(msg, reason)
+	return &dl, nil
+}
+
+// deadLetterCopy returns the copy of msg for the dead letter queue, q.m must be held.
+func (q *queue) deadLetterCopy(msg *QMessage, reason string) deadLetter {
+	dead := NewMessage(q.options.DeadLetter, msg.Data)
+	dead.Header.ContentType = msg.Header.ContentType
+	dead.Header.ContentEncoding = msg.Header.ContentEncoding
+	dead.Header.CorrelationId = msg.Header.CorrelationId
+	dead.Header.ReplyTo = msg.Header.ReplyTo
+	// the dead letter queue applies its own TTL
+	dead.Header.Headers = make(map[string]string, len(msg.Header.Headers)+4)
+	for k, v := range msg.Header.Headers {
+		dead.Header.Headers[k] = v
+	}
+	dead.Header.Headers[HEADER_DEATH_QUEUE] = q.name
+	dead.Header.Headers[HEADER_DEATH_REASON] = reason
+	dead.Header.Headers[HEADER_DEATH_COUNT] = strconv.Itoa(msg.DeliveryCount)
+	dead.Header.Headers[HEADER_DEATH_ID] = msg.Id
+	return deadLetter{queue: q.options.DeadLetter, msg: dead}
+}
+
+// sendDeadLetters publishes the dead letters then removes the originals, q.m must not be held.
+func (q *queue) sendDeadLetters(letters []deadLetter) {
+	if len(letters) == 0 {
+		return
+	}
+	q.m.Lock()
+	route := q.deadLetterRoute
+	q.m.Unlock()
+	for _, dl := range letters {
+		id := dl.msg.Header.Headers[HEADER_DEATH_ID]
+		if route == nil {
+			log.Println("[MQ] queue", q.name, "has no dead letter route, message", id, "kept")
+			q.readmit(dl.evicted)
+			continue
+		}
+		if err := route(dl.queue, dl.msg); err != nil {
+			log.Println("[MQ] queue", q.name, "dead letter of", id, "to", dl.queue, "failed:", err)
+			q.readmit(dl.evicted)
+			continue
+		}
+		if err := q.settleDeadLetter(id, dl.evicted); err != nil {
+			log.Println("[MQ] queue", q.name, "dead-lettered message", id, "not removed:", err)
+		}
+	}
+}
+
+// settleDeadLetter removes the original of a stored dead letter, evicted when it already left the queue.
+func (q *queue) settleDeadLetter(id string, evicted *QMessage) error {
+	q.m.Lock()
+	if evicted != nil {
+		evicted.Status = STATUS_MESSAGE_REJECTED
+		c, err := q.log.SetStatus(evicted)
+		q.m.Unlock()
+		if err != nil {
+			return err
+		}
+		return c.Wait()
+	}
+	msg, ok := q.storage[id]
+	if !ok {
+		q.m.Unlock()
+		return nil
+	}
+	c, err := q.remove(msg, STATUS_MESSAGE_REJECTED)
+	q.m.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// evict takes a message out of the queue, leaving it in the log, q.m must be held.
+func (q *queue) evict(msg *QMessage) {
+	delete(q.storage, msg.Id)
+	q.bytes -= int64(len(msg.Data))
+	q.index.remove(msg.Id)
+}
+
+// readmit puts back at the head of the queue an evicted message whose dead letter failed.
+func (q *queue) readmit(msg *QMessage) {
+	if msg == nil {
+		return
+	}
+	q.m.Lock()
+	defer q.m.Unlock()
+	if _, ok := q.storage[msg.Id]; ok {
+		return
+	}
+	msg.Status = STATUS_MESSAGE_READY
+	q.storage[msg.Id] = msg
+	q.bytes += int64(len(msg.Data))
+	q.expireAt(msg)
+	q.index.requeue(msg)
+	q.notify()
+}
@@ -0,0 +1,106 @@
+package mq
+
+import (
+	"testing"
+	"time"
+	"tomqserver/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testControl returns a queues control storing in a temp dir, with a short ack timeout.
+func testControl(t *testing.T) *queuesControl {
+	prev := config.Get()
+	cfg := *prev
+	cfg.DataDir = t.TempDir()
+	cfg.AckTimeout = 50 * time.Millisecond
+	config.Set(&cfg)
+	qc := InitQueuesControl()
+	t.Cleanup(func() {
+		for _, q := range qc.queues {
+			q.Close() // nolint
+		}
+		config.Set(prev)
+	})
+	return qc
+}
+
+// waitMessages waits until q holds n messages.
+func waitMessages(t *testing.T, q *queue, n int) {
+	assert.Eventually(t, func() bool {
+		q.m.Lock()
+		defer q.m.Unlock()
+		return q.TotalMesssages() == n
+	}, 2*time.Second, 5*time.Millisecond)
+}
+
+func TestQueue_DeadLetterMaxDeliveries(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueueWithOptions("work", QueueOptions{DeadLetter: "dead", MaxDeliveries: 2}))
+	q, err := qc.GetQueue("WORK")
+	assert.NoError(t, err)
+	ch := deliveries(q)
+
+	msg := NewMessage("WORK", []byte("poison"))
+	msg.Header.Headers = map[string]string{"tenant": "42"}
+	assert.NoError(t, q.Publish(msg))
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 1})))
+	assert.Equal(t, 1, receive(t, ch).DeliveryCount)
+	assert.Equal(t, 2, receive(t, ch).DeliveryCount)
+
+	var dead *queue
+	if !assert.Eventually(t, func() bool { dead, err = qc.GetQueue("DEAD"); return err == nil }, 2*time.Second, 5*time.Millisecond) {
+		return
+	}
+	waitMessages(t, dead, 1)
+	waitMessages(t, q, 0)
+	dl := dead.storage[readyIds(dead)[0]]
+	assert.Equal(t, []byte("poison"), dl.Data)
+	assert.Equal(t, map[string]string{
+		"tenant":            "42",
+		HEADER_DEATH_QUEUE:  "WORK",
+		HEADER_DEATH_REASON: DEATH_REASON_MAX_DELIVERIES,
+		HEADER_DEATH_COUNT:  "2",
+		HEADER_DEATH_ID:     msg.Id,
+	}, dl.Header.Headers)
+}
+
+func TestQueue_RejectRequeueAndDeadLetter(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueueWithOptions("work", QueueOptions{DeadLetter: "dead"}))
+	q, err := qc.GetQueue("WORK")
+	assert.NoError(t, err)
+	ch := deliveries(q)
+
+	msg := NewMessage("WORK", []byte("data"))
+	assert.NoError(t, q.Publish(msg))
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 1})))
+	receive(t, ch)
+	assert.NoError(t, q.Reject("", msg.Id, true))
+	redelivered := receive(t, ch)
+	assert.True(t, redelivered.Redelivered())
+
+	assert.NoError(t, q.Reject("", msg.Id, false))
+	waitMessages(t, q, 0)
+	dead, err := qc.GetQueue("DEAD")
+	assert.NoError(t, err)
+	waitMessages(t, dead, 1)
+	assert.Equal(t, DEATH_REASON_REJECTED, dead.storage[readyIds(dead)[0]].Header.Headers[HEADER_DEATH_REASON])
+}
+
+func TestQueue_RejectWithoutDeadLetter(t *testing.T) {
+	qc := testControl(t)
+	q, err := qc.GetOrCreate("work")
+	assert.NoError(t, err)
+	msg := NewMessage("WORK", []byte("data"))
+	assert.NoError(t, q.Publish(msg))
+	assert.NoError(t, q.Reject("", msg.Id, false))
+	assert.Empty(t, q.storage)
+	assert.Empty(t, readyIds(q))
+	assert.Equal(t, []string{"WORK"}, qc.List())
+}
+
+func TestQueueOptions_OwnDeadLetter(t *testing.T) {
+	qc := testControl(t)
+	assert.Error(t, qc.NewQueueWithOptions("work", QueueOptions{DeadLetter: "Work"}))
+}
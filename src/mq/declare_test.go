@@ -0,0 +1,117 @@
+package mq
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"tomqserver/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseQueueArgs(t *testing.T) {
+	opts, err := ParseQueueArgs([]string{"durable=false", "auto-delete=true", "ttl=500", "max-length=10", "dead-letter=DEAD"})
+	assert.NoError(t, err)
+	assert.True(t, opts.Transient)
+	assert.True(t, opts.AutoDelete)
+	assert.Equal(t, int64(500), opts.TTL)
+	assert.Equal(t, 10, opts.MaxLength)
+	assert.Equal(t, "DEAD", opts.DeadLetter)
+
+	opts, err = ParseQueueArgs([]string{"exclusive=true"})
+	assert.NoError(t, err)
+	assert.True(t, opts.Transient, "exclusive queues are transient")
+
+	_, err = ParseQueueArgs([]string{"color=blue"})
+	assert.Error(t, err)
+	_, err = ParseQueueArgs([]string{"max-length=many"})
+	assert.Error(t, err)
+	_, err = ParseQueueArgs([]string{"durable"})
+	assert.Error(t, err)
+}
+
+func TestQueuesControl_Declare(t *testing.T) {
+	qc := testControl(t)
+	opts, err := ParseQueueArgs([]string{"max-length=10"})
+	assert.NoError(t, err)
+	assert.NoError(t, qc.Declare("orders", opts, "1"))
+	assert.NoError(t, qc.Declare("orders", opts, "2"), "same options")
+
+	other, err := ParseQueueArgs([]string{"max-length=20"})
+	assert.NoError(t, err)
+	assert.Error(t, qc.Declare("orders", other, "1"))
+
+	_, err = os.Stat(filepath.Join(config.Get().DataDir, "ORDERS", queueOptionsFile))
+	assert.NoError(t, err)
+}
+
+func TestQueuesControl_DeclareTransient(t *testing.T) {
+	qc := testControl(t)
+	opts, err := ParseQueueArgs([]string{"durable=false"})
+	assert.NoError(t, err)
+	assert.NoError(t, qc.Declare("scratch", opts, "1"))
+	q, err := qc.GetQueue("SCRATCH")
+	assert.NoError(t, err)
+	assert.NoError(t, q.Publish(NewMessage("SCRATCH", []byte("data"))))
+	assert.Equal(t, 1, q.TotalMesssages())
+
+	_, err = os.Stat(filepath.Join(config.Get().DataDir, "SCRATCH"))
+	assert.True(t, os.IsNotExist(err), "nothing on disk")
+}
+
+func TestQueuesControl_AutoDelete(t *testing.T) {
+	qc := testControl(t)
+	opts, err := ParseQueueArgs([]string{"auto-delete=true"})
+	assert.NoError(t, err)
+	assert.NoError(t, qc.Declare("tasks", opts, "1"))
+
+	// no consumer ever came, the queue stays
+	qc.UnregisterConsumer("1")
+	q, err := qc.GetQueue("TASKS")
+	assert.NoError(t, err)
+
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 1})))
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 2})))
+	qc.UnregisterConsumer("1")
+	_, err = qc.GetQueue("TASKS")
+	assert.NoError(t, err, "one consumer left")
+
+	qc.UnregisterConsumer("2")
+	_, err = qc.GetQueue("TASKS")
+	assert.Equal(t, ErrNoQueue, err)
+	_, err = os.Stat(filepath.Join(config.Get().DataDir, "TASKS"))
+	assert.True(t, os.IsNotExist(err), "files removed")
+}
+
+func TestQueuesControl_Exclusive(t *testing.T) {
+	qc := testControl(t)
+	opts, err := ParseQueueArgs([]string{"exclusive=true"})
+	assert.NoError(t, err)
+	assert.NoError(t, qc.Declare("replies", opts, "1"))
+	assert.Equal(t, ErrExclusive, qc.Declare("replies", opts, "2"))
+
+	q, err := qc.GetQueue("REPLIES")
+	assert.NoError(t, err)
+	assert.Equal(t, ErrExclusive, q.RegisterConsumer(*NewConsumer(&testSession{id: 2})))
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 1})))
+
+	qc.UnregisterConsumer("2")
+	_, err = qc.GetQueue("REPLIES")
+	assert.NoError(t, err)
+	qc.UnregisterConsumer("1")
+	_, err = qc.GetQueue("REPLIES")
+	assert.Equal(t, ErrNoQueue, err)
+}
+
+func TestQueuesControl_ExplicitQueuesOnly(t *testing.T) {
+	qc := testControl(t)
+	cfg := *config.Get()
+	cfg.ImplicitQueues = false
+	config.Set(&cfg)
+
+	_, err := qc.GetOrCreate("missing")
+	assert.Equal(t, ErrNoQueue, err)
+	assert.NoError(t, qc.Declare("declared", DefaultQueueOptions(), "1"))
+	_, err = qc.GetOrCreate("declared")
+	assert.NoError(t, err)
+}
@@ -0,0 +1,77 @@
+package mq
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"tomqserver/config"
+	"tomqserver/src/server"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueuesControl_Delete(t *testing.T) {
+	qc := testControl(t)
+	var m sync.Mutex
+	cancelled := []string{}
+	qc.SetCancelHandler(func(sess server.Session, queueName string) {
+		m.Lock()
+		defer m.Unlock()
+		cancelled = append(cancelled, queueName)
+	})
+	assert.NoError(t, qc.NewQueue("work"))
+	q, err := qc.GetQueue("WORK")
+	assert.NoError(t, err)
+	assert.NoError(t, q.Publish(NewMessage("WORK", []byte("data"))))
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 1})))
+
+	assert.Equal(t, ErrQueueNotEmpty, qc.Delete("work", true, false))
+	assert.Equal(t, ErrQueueInUse, qc.Delete("work", false, true))
+	assert.Equal(t, ErrNoQueue, qc.Delete("missing", false, false))
+
+	legacy := filepath.Join(config.Get().DataDir, "work"+legacyExt+legacyMigratedExt)
+	assert.NoError(t, os.WriteFile(legacy, nil, 0644))
+	assert.NoError(t, qc.Delete("work", false, false))
+	_, err = qc.GetQueue("WORK")
+	assert.Equal(t, ErrNoQueue, err)
+	_, err = os.Stat(filepath.Join(config.Get().DataDir, "WORK"))
+	assert.True(t, os.IsNotExist(err), "queue dir removed")
+	_, err = os.Stat(legacy)
+	assert.True(t, os.IsNotExist(err), "legacy file removed")
+	assert.Equal(t, []string{"WORK"}, cancelled)
+
+	// a new queue with the same name starts empty
+	assert.NoError(t, qc.NewQueue("work"))
+	q, err = qc.GetQueue("WORK")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, q.TotalMesssages())
+}
+
+func TestQueue_Purge(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueue("work"))
+	q, err := qc.GetQueue("WORK")
+	assert.NoError(t, err)
+	ch := deliveries(q)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, q.Publish(NewMessage("WORK", []byte("data"))))
+	}
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 1})))
+	held := receive(t, ch)
+
+	count, err := qc.Purge("work")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, 1, q.TotalMesssages())
+	assert.NoError(t, q.Ack("", held.Id))
+	waitMessages(t, q, 0)
+
+	// purged messages don't come back
+	assert.NoError(t, q.Close())
+	delete(qc.queues, "WORK")
+	qc.recover(config.Get().DataDir)
+	q, err = qc.GetQueue("WORK")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, q.TotalMesssages())
+}
@@ -0,0 +1,218 @@
+package mq
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"tomqserver/config"
+	"tomqserver/src/server"
+)
+
+/*
+Every queue runs a dispatcher goroutine which sleeps until something
+can change the distribution:
+  - a message is published
+  - a consumer registers, gets more credit or has a message acked
+  - the ack of a distributed message expires
+  - a scheduled message is due
+
+so an idle queue costs a blocked goroutine and nothing else.
+*/
+
+// DeliveryHandler sends msg to a consumer session, returns false when it couldn't.
+type DeliveryHandler func(sess server.Session, msg QMessage) bool
+
+// CancelHandler tells a consumer session its queue was deleted.
+type CancelHandler func(sess server.Session, queueName string)
+
+type delivery struct {
+	sess server.Session
+	msg  QMessage
+}
+
+// notify wakes the queue dispatcher up, it never blocks.
+func (q *queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// setDeliveryHandler sets the function used to send messages to consumers.
+func (q *queue) setDeliveryHandler(h DeliveryHandler) {
+	q.m.Lock()
+	q.deliver = h
+	q.m.Unlock()
+	q.notify()
+}
+
+func (q *queue) dispatcher() {
+	timer := time.NewTimer(time.Hour)
+	stopTimer(timer)
+	for {
+		select {
+		case <-q.stop:
+			stopTimer(timer)
+			return
+		case <-q.wake:
+		case <-timer.C:
+		}
+		deliveries, deadLetters, handler, wait := q.dispatch(time.Now())
+		for _, d := range deliveries {
+			if !handler(d.sess, d.msg) {
+				log.Println("[MQ] delivery to consumer", d.sess.ID(), "failed, message", d.msg.Id, "waits for its ack timeout")
+			}
+		}
+		q.sendDeadLetters(deadLetters)
+		stopTimer(timer)
+		if wait > 0 {
+			timer.Reset(wait)
+		}
+	}
+}
+
+func stopTimer(t *time.Timer) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+}
+
+// dispatch hands ready messages to the consumers with credit left, one each in turn,
+// requeues the expired ones, releases the due ones and retires those out of deliveries.
+// Returns the deliveries and dead letters to send and how long until the next ack expires
+// or scheduled message is due, 0 when there's nothing to wait for.
+func (q *queue) dispatch(now time.Time) ([]delivery, []deadLetter, DeliveryHandler, time.Duration) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.ackDeadline > 0 && now.UnixNano() >= q.ackDeadline {
+		q.expireDistributed(now.UnixNano())
+	}
+	q.releaseDue(now.UnixNano())
+	q.expireTransactions(now.UnixNano())
+	deliveries := []delivery{}
+	deadLetters := []deadLetter{}
+	if q.deliver != nil {
+	rounds:
+		for progress := true; progress; {
+			progress = false
+			for _, c := range q.consumers {
+				if !c.hasCredit() {
+					continue
+				}
+				msg, err := q.nextDeliverable(now, &deadLetters)
+				if err != nil {
+					break rounds
+				}
+				q.handOut(msg, fmt.Sprint(c.session.ID()))
+				q.holders[msg.Id] = c
+				c.take(msg.Id)
+				deliveries = append(deliveries, delivery{sess: c.session, msg: *msg})
+				progress = true
+			}
+		}
+	}
+	q.wakePullers()
+	var wait time.Duration
+	next := q.ackDeadline
+	if release := q.nextRelease(); release > 0 && (next == 0 || release < next) {
+		next = release
+	}
+	if q.tm.deadline > 0 && (next == 0 || q.tm.deadline < next) {
+		next = q.tm.deadline
+	}
+	if next > 0 {
+		wait = time.Duration(next - now.UnixNano())
+		if wait <= 0 {
+			wait = time.Nanosecond
+		}
+	}
+	return deliveries, deadLetters, q.deliver, wait
+}
+
+// nextDeliverable returns the next ready message, retiring on the way the expired ones
+// and those out of deliveries. q.m must be held.
+func (q *queue) nextDeliverable(now time.Time, deadLetters *[]deadLetter) (*QMessage, error) {
+	msg, err := q.nextReady()
+	for err == nil && (msg.Expired(now) || q.exhausted(msg)) {
+		reason := DEATH_REASON_MAX_DELIVERIES
+		if msg.Expired(now) {
+			reason = DEATH_REASON_EXPIRED
+		}
+		if dl, _ := q.retire(msg, reason); dl != nil {
+			*deadLetters = append(*deadLetters, *dl)
+		}
+		msg, err = q.nextReady()
+	}
+	return msg, err
+}
+
+// handOut marks msg as in flight to session sid until it's acked or its ack expires.
+// q.m must be held.
+func (q *queue) handOut(msg *QMessage, sid string) {
+	msg.SetDistributed(sid)
+	q.tm.Start(msg.Id, sid, msg.Header.Timestamp)
+	if _, err := q.log.SetStatus(msg); err != nil {
+		log.Println("[MQ] queue", q.name, "delivery count of", msg.Id, "not stored:", err)
+	}
+	q.index.wait(msg)
+	if deadline := msg.Header.Timestamp + q.ackTimeout(); q.ackDeadline == 0 || deadline < q.ackDeadline {
+		q.ackDeadline = deadline
+	}
+}
+
+func (q *queue) ackTimeout() int64 {
+	return config.Get().AckTimeout.Nanoseconds()
+}
+
+func transactionTimeout() int64 {
+	return config.Get().TransactionTimeout.Nanoseconds()
+}
+
+// expireDistributed puts back to READY the messages whose ack expired,
+// and keeps the next deadline in q.ackDeadline. q.m must be held.
+func (q *queue) expireDistributed(now int64) {
+	maxTime := q.ackTimeout()
+	q.ackDeadline = 0
+	for msg := q.index.firstWaiting(); msg != nil; msg = q.index.firstWaiting() {
+		deadline := msg.Header.Timestamp + maxTime
+		if now < deadline {
+			q.ackDeadline = deadline
+			return
+		}
+		// acknowledgment expired
+		log.Println("Message ack expired")
+		q.tm.timeout(msg.Id)
+		msg.Status = STATUS_MESSAGE_READY
+		q.release(msg.Id)
+		q.index.requeue(msg)
+	}
+}
+
+// expireTransactions puts back to READY the messages of the stale transactions, q.m must be held.
+func (q *queue) expireTransactions(now int64) {
+	for _, id := range q.tm.stale(now) {
+		q.tm.timeout(id)
+		msg, ok := q.storage[id]
+		if !ok || (msg.Status != STATUS_MESSAGE_WAITING_NACK && msg.Status != STATUS_MESSAGE_UNACK) {
+			continue
+		}
+		log.Println("[MQ] queue", q.name, "transaction of", id, "timed out")
+		msg.Status = STATUS_MESSAGE_READY
+		q.release(id)
+		q.index.requeue(msg)
+	}
+}
+
+// release frees the consumer slot held by message id and ends its transaction, q.m must be held.
+func (q *queue) release(id string) {
+	q.tm.end(id)
+	delete(q.pulled, id)
+	if c, ok := q.holders[id]; ok {
+		delete(q.holders, id)
+		c.release(id)
+		q.notify()
+	}
+}
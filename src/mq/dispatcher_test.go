@@ -0,0 +1,153 @@
+package mq
+
+import (
+	"testing"
+	"time"
+	"tomqserver/config"
+	"tomqserver/src/server"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testSession struct {
+	server.Session
+	id int64
+}
+
+func (s *testSession) ID() interface{} {
+	return s.id
+}
+
+func deliveries(q *queue) chan QMessage {
+	ch := make(chan QMessage, 16)
+	q.setDeliveryHandler(func(sess server.Session, msg QMessage) bool {
+		ch <- msg
+		return true
+	})
+	return ch
+}
+
+func receive(t *testing.T, ch chan QMessage) QMessage {
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("no delivery")
+	}
+	return QMessage{}
+}
+
+func TestQueue_DispatchOnEvents(t *testing.T) {
+	q, err := openQueue("TEST", t.TempDir(), nil)
+	assert.NoError(t, err)
+	defer q.Close() // nolint
+	ch := deliveries(q)
+
+	first := NewMessage("TEST", []byte("first"))
+	second := NewMessage("TEST", []byte("second"))
+	assert.NoError(t, q.Publish(first))
+	assert.NoError(t, q.Publish(second))
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 1})))
+
+	assert.Equal(t, first.Id, receive(t, ch).Id)
+	select {
+	case msg := <-ch:
+		t.Fatal("busy consumer got", msg.Id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.NoError(t, q.Ack("1", first.Id))
+	assert.Equal(t, second.Id, receive(t, ch).Id)
+}
+
+func TestQueue_DispatchAckExpired(t *testing.T) {
+	prev := config.Get()
+	cfg := *prev
+	cfg.AckTimeout = 50 * time.Millisecond
+	config.Set(&cfg)
+	defer config.Set(prev)
+
+	q, err := openQueue("TEST", t.TempDir(), nil)
+	assert.NoError(t, err)
+	defer q.Close() // nolint
+	ch := deliveries(q)
+
+	msg := NewMessage("TEST", []byte("data"))
+	assert.NoError(t, q.Publish(msg))
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 1})))
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 2})))
+	first := receive(t, ch)
+	assert.Equal(t, msg.Id, first.Id)
+	assert.Equal(t, 1, first.DeliveryCount)
+	assert.False(t, first.Redelivered())
+
+	// the ack expires, the message is distributed again
+	second := receive(t, ch)
+	assert.Equal(t, msg.Id, second.Id)
+	assert.Equal(t, 2, second.DeliveryCount)
+	assert.True(t, second.Redelivered())
+	assert.Contains(t, string(second.TcpData()), " attempt=2 redelivered=true")
+}
+
+func TestQueue_RecoverDeliveryCount(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openQueue("TEST", dir, nil)
+	assert.NoError(t, err)
+	ch := deliveries(q)
+	msg := NewMessage("TEST", []byte("data"))
+	assert.NoError(t, q.Publish(msg))
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 7})))
+	receive(t, ch)
+	assert.NoError(t, q.Close())
+
+	q2, err := openQueue("TEST", dir, nil)
+	assert.NoError(t, err)
+	defer q2.Close() // nolint
+	restored := q2.storage[msg.Id]
+	assert.Equal(t, STATUS_MESSAGE_READY, restored.Status)
+	assert.Equal(t, 1, restored.DeliveryCount)
+	assert.Equal(t, "7", restored.LastConsumer)
+}
+
+func TestQueue_DispatchPrefetch(t *testing.T) {
+	q, err := openQueue("TEST", t.TempDir(), nil)
+	assert.NoError(t, err)
+	defer q.Close() // nolint
+	ch := deliveries(q)
+
+	msgs := []QMessage{}
+	for i := 0; i < 5; i++ {
+		msg := NewMessage("TEST", []byte("data"))
+		assert.NoError(t, q.Publish(msg))
+		msgs = append(msgs, msg)
+	}
+	c := NewConsumer(&testSession{id: 1})
+	c.SetPrefetch(3)
+	assert.NoError(t, q.RegisterConsumer(*c))
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, msgs[i].Id, receive(t, ch).Id)
+	}
+	select {
+	case msg := <-ch:
+		t.Fatal("window exceeded by", msg.Id)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Error(t, q.Credit("2", 1))
+	assert.NoError(t, q.Credit("1", 1))
+	assert.Equal(t, msgs[3].Id, receive(t, ch).Id)
+	assert.NoError(t, q.Reject("", msgs[0].Id, false))
+	assert.Equal(t, msgs[4].Id, receive(t, ch).Id)
+
+	// the messages of a closed consumer go to the next one
+	q.UnregisterConsumer("1")
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 2})))
+	assert.Equal(t, msgs[1].Id, receive(t, ch).Id)
+
+	// the window stops growing at MAX_PREFETCH
+	assert.NoError(t, q.Credit("2", MAX_PREFETCH))
+	assert.NoError(t, q.Credit("2", MAX_PREFETCH))
+	q.m.Lock()
+	assert.Equal(t, MAX_PREFETCH, q.consumers[0].Prefetch())
+	q.m.Unlock()
+}
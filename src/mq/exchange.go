@@ -0,0 +1,370 @@
+package mq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"tomqserver/config"
+)
+
+/*
+An exchange sits between a publisher and the queues: a message is published
+to an exchange with a routing key and every queue bound with a matching
+binding gets a copy.
+
+	direct  the binding key equals the routing key
+	fanout  every bound queue, the key is ignored
+	topic   the binding key is a pattern of dot separated words,
+	        * matches one word and # zero or more: "order.*.eu", "audit.#"
+	headers the key is ignored, the binding arguments are compared to the message
+	        headers: all of them must be equal, or any of them with x-match=any.
+	        Arguments starting with x- are not compared.
+
+The default exchange has no name, it sends a message to the queue named by
+the routing key, which is how PUBLISH works without exchange.
+The exchanges and their bindings are stored in <DATA_DIR>/exchanges.json.
+*/
+
+const (
+	EXCHANGE_DIRECT  = "direct"
+	EXCHANGE_FANOUT  = "fanout"
+	EXCHANGE_TOPIC   = "topic"
+	EXCHANGE_HEADERS = "headers"
+
+	// BINDING_MATCH is the binding argument choosing how a headers exchange compares
+	BINDING_MATCH     = "x-match"
+	BINDING_MATCH_ALL = "all"
+	BINDING_MATCH_ANY = "any"
+
+	topologyFile = "exchanges.json"
+)
+
+var (
+	// ErrNoExchange is returned for an exchange which doesn't exist.
+	ErrNoExchange = errors.New("exchange doesn't exists")
+	// ErrUnroutable is returned when no queue is bound for the routing key of a message.
+	ErrUnroutable = errors.New("no queue bound for the routing key")
+	// ErrExchangeType refuses to declare an existing exchange with another type.
+	ErrExchangeType = errors.New("exchange exists with another type")
+	// ErrNoBinding is returned when unbinding a binding which doesn't exist.
+	ErrNoBinding = errors.New("binding doesn't exists")
+)
+
+// binding sends the messages of an exchange matching Key to Queue.
+type binding struct {
+	Queue string            `json:"queue"`
+	Key   string            `json:"key"`
+	Args  map[string]string `json:"args,omitempty"` // headers to match
+}
+
+// same tells if b and o bind the same queue with the same key and arguments.
+func (b binding) same(o binding) bool {
+	if b.Queue != o.Queue || b.Key != o.Key || len(b.Args) != len(o.Args) {
+		return false
+	}
+	for k, v := range b.Args {
+		if w, ok := o.Args[k]; !ok || w != v {
+			return false
+		}
+	}
+	return true
+}
+
+type exchange struct {
+	Name     string    `json:"name"`
+	Type     string    `json:"type"`
+	Bindings []binding `json:"bindings"`
+}
+
+// validExchangeType tells if kind is one of EXCHANGE_*.
+func validExchangeType(kind string) bool {
+	switch kind {
+	case EXCHANGE_DIRECT, EXCHANGE_FANOUT, EXCHANGE_TOPIC, EXCHANGE_HEADERS:
+		return true
+	}
+	return false
+}
+
+// route returns the queues a message with key and headers goes to, each once.
+func (e *exchange) route(key string, headers map[string]string) []string {
+	queues := []string{}
+	seen := map[string]bool{}
+	for _, b := range e.Bindings {
+		if seen[b.Queue] || !e.matches(b, key, headers) {
+			continue
+		}
+		seen[b.Queue] = true
+		queues = append(queues, b.Queue)
+	}
+	return queues
+}
+
+func (e *exchange) matches(b binding, key string, headers map[string]string) bool {
+	switch e.Type {
+	case EXCHANGE_FANOUT:
+		return true
+	case EXCHANGE_TOPIC:
+		return topicMatch(strings.Split(b.Key, "."), strings.Split(key, "."))
+	case EXCHANGE_HEADERS:
+		return headersMatch(b.Args, headers)
+	}
+	return b.Key == key
+}
+
+// headersMatch compares the arguments of a binding to the headers of a message.
+func headersMatch(args map[string]string, headers map[string]string) bool {
+	matchAny := args[BINDING_MATCH] == BINDING_MATCH_ANY
+	compared := 0
+	for k, v := range args {
+		if strings.HasPrefix(k, "x-") {
+			continue
+		}
+		compared++
+		h, ok := headers[k]
+		equal := ok && h == v
+		if matchAny && equal {
+			return true
+		}
+		if !matchAny && !equal {
+			return false
+		}
+	}
+	// a binding without arguments matches everything with all, nothing with any
+	return !matchAny || compared == 0
+}
+
+// topicMatch matches the words of a routing key against the words of a topic pattern.
+func topicMatch(pattern []string, key []string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case "#":
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if topicMatch(pattern[1:], key[i:]) {
+					return true
+				}
+			}
+			return false
+		case "*":
+			if len(key) == 0 {
+				return false
+			}
+		default:
+			if len(key) == 0 || key[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, key = pattern[1:], key[1:]
+	}
+	return len(key) == 0
+}
+
+// bind adds a binding, returns false when it already exists.
+func (e *exchange) bind(b binding) bool {
+	for _, existing := range e.Bindings {
+		if existing.same(b) {
+			return false
+		}
+	}
+	e.Bindings = append(e.Bindings, b)
+	return true
+}
+
+// unbind removes the binding equal to b, or every binding of its queue when all is set.
+func (e *exchange) unbind(b binding, all bool) bool {
+	kept := e.Bindings[:0]
+	for _, existing := range e.Bindings {
+		if existing.Queue != b.Queue || (!all && !existing.same(b)) {
+			kept = append(kept, existing)
+		}
+	}
+	removed := len(kept) != len(e.Bindings)
+	e.Bindings = kept
+	return removed
+}
+
+// DeclareExchange creates exchange name of type kind, declaring it again with the same type does nothing.
+func (qc *queuesControl) DeclareExchange(name string, kind string) error {
+	if !validExchangeType(kind) {
+		return fmt.Errorf("unknown exchange type %q", kind)
+	}
+	qc.m.Lock()
+	defer qc.m.Unlock()
+	name = strings.ToUpper(name)
+	if name == "" {
+		return errors.New("exchange name is required")
+	}
+	if e, ok := qc.exchanges[name]; ok {
+		if e.Type != kind {
+			return fmt.Errorf("%w: %s", ErrExchangeType, e.Type)
+		}
+		return nil
+	}
+	qc.exchanges[name] = &exchange{Name: name, Type: kind, Bindings: []binding{}}
+	return qc.saveTopology()
+}
+
+// DeleteExchange removes exchange name and its bindings, the queues stay.
+func (qc *queuesControl) DeleteExchange(name string) error {
+	qc.m.Lock()
+	defer qc.m.Unlock()
+	name = strings.ToUpper(name)
+	if _, ok := qc.exchanges[name]; !ok {
+		return ErrNoExchange
+	}
+	delete(qc.exchanges, name)
+	return qc.saveTopology()
+}
+
+// Bind sends the messages of exchangeName matching key, or args for a headers exchange, to queueName.
+func (qc *queuesControl) Bind(exchangeName string, queueName string, key string, args map[string]string) error {
+	switch args[BINDING_MATCH] {
+	case "", BINDING_MATCH_ALL, BINDING_MATCH_ANY:
+	default:
+		return fmt.Errorf("bad %s %q", BINDING_MATCH, args[BINDING_MATCH])
+	}
+	if len(args) == 0 {
+		args = nil
+	}
+	qc.m.Lock()
+	defer qc.m.Unlock()
+	e, ok := qc.exchanges[strings.ToUpper(exchangeName)]
+	if !ok {
+		return ErrNoExchange
+	}
+	queueName = strings.ToUpper(queueName)
+	if _, ok := qc.queues[queueName]; !ok {
+		return ErrNoQueue
+	}
+	if !e.bind(binding{Queue: queueName, Key: key, Args: args}) {
+		return nil
+	}
+	return qc.saveTopology()
+}
+
+// Unbind removes the binding of queueName to exchangeName with key and args.
+func (qc *queuesControl) Unbind(exchangeName string, queueName string, key string, args map[string]string) error {
+	qc.m.Lock()
+	defer qc.m.Unlock()
+	e, ok := qc.exchanges[strings.ToUpper(exchangeName)]
+	if !ok {
+		return ErrNoExchange
+	}
+	if !e.unbind(binding{Queue: strings.ToUpper(queueName), Key: key, Args: args}, false) {
+		return ErrNoBinding
+	}
+	return qc.saveTopology()
+}
+
+// unbindQueue removes every binding to a deleted queue, qc.m must be held.
+func (qc *queuesControl) unbindQueue(queueName string) {
+	changed := false
+	for _, e := range qc.exchanges {
+		if e.unbind(binding{Queue: queueName}, true) {
+			changed = true
+		}
+	}
+	if changed {
+		if err := qc.saveTopology(); err != nil {
+			log.Println("[MQ] exchanges save failed:", err)
+		}
+	}
+}
+
+// PublishTo publishes a copy of msg to every queue of exchangeName bound for routingKey
+// or the headers of msg, returns how many queues got it.
+func (qc *queuesControl) PublishTo(exchangeName string, routingKey string, msg QMessage) (int, error) {
+	targets, err := qc.targets(exchangeName, routingKey, msg.Header.Headers)
+	if err != nil {
+		return 0, err
+	}
+	for i, q := range targets {
+		if err := q.Publish(routedCopy(msg, q.name)); err != nil {
+			return i, fmt.Errorf("queue %s: %w", q.name, err)
+		}
+	}
+	return len(targets), nil
+}
+
+// targets returns the queues exchangeName routes the key and headers to.
+func (qc *queuesControl) targets(exchangeName string, routingKey string, headers map[string]string) ([]*queue, error) {
+	qc.m.Lock()
+	defer qc.m.Unlock()
+	e, ok := qc.exchanges[strings.ToUpper(exchangeName)]
+	if !ok {
+		return nil, ErrNoExchange
+	}
+	targets := []*queue{}
+	for _, name := range e.route(routingKey, headers) {
+		if q, ok := qc.queues[name]; ok {
+			targets = append(targets, q)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, ErrUnroutable
+	}
+	return targets, nil
+}
+
+// routedCopy returns the copy of msg stored in queue name, with its own headers.
+func routedCopy(msg QMessage, name string) QMessage {
+	routed := msg
+	routed.Header.Channel = name
+	if msg.Header.Headers != nil {
+		routed.Header.Headers = make(map[string]string, len(msg.Header.Headers))
+		for k, v := range msg.Header.Headers {
+			routed.Header.Headers[k] = v
+		}
+	}
+	return routed
+}
+
+// saveTopology writes the exchanges and their bindings, qc.m must be held.
+func (qc *queuesControl) saveTopology() error {
+	exchanges := make([]*exchange, 0, len(qc.exchanges))
+	for _, e := range qc.exchanges {
+		exchanges = append(exchanges, e)
+	}
+	data, err := json.MarshalIndent(exchanges, "", "  ")
+	if err != nil {
+		return err
+	}
+	dataDir := config.Get().DataDir
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return err
+	}
+	return replaceFile(filepath.Join(dataDir, topologyFile), data)
+}
+
+// loadTopology reads the exchanges stored in dataDir, bindings to queues which
+// didn't survive the restart are dropped.
+func (qc *queuesControl) loadTopology(dataDir string) error {
+	data, err := os.ReadFile(filepath.Join(dataDir, topologyFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	exchanges := []*exchange{}
+	if err := json.Unmarshal(data, &exchanges); err != nil {
+		return fmt.Errorf("%s: %s", topologyFile, err)
+	}
+	for _, e := range exchanges {
+		kept := []binding{}
+		for _, b := range e.Bindings {
+			if _, ok := qc.queues[b.Queue]; ok {
+				kept = append(kept, b)
+			}
+		}
+		e.Bindings = kept
+		qc.exchanges[e.Name] = e
+	}
+	return nil
+}
@@ -0,0 +1,146 @@
+package mq
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"tomqserver/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"order.created", "order.created", true},
+		{"order.created", "order.deleted", false},
+		{"order.*", "order.created", true},
+		{"order.*", "order.created.eu", false},
+		{"order.*.eu", "order.created.eu", true},
+		{"#", "anything.at.all", true},
+		{"audit.#", "audit", true},
+		{"audit.#", "audit.login.failed", true},
+		{"#.eu", "order.created.eu", true},
+		{"#.eu", "order.created.us", false},
+		{"order.#.eu", "order.eu", true},
+		{"*", "", true},
+		{"*.*", "order", false},
+	}
+	for _, c := range cases {
+		got := topicMatch(strings.Split(c.pattern, "."), strings.Split(c.key, "."))
+		assert.Equal(t, c.match, got, "%s ~ %s", c.pattern, c.key)
+	}
+}
+
+func TestQueuesControl_ExchangeRouting(t *testing.T) {
+	qc := testControl(t)
+	for _, name := range []string{"billing", "audit", "analytics", "eu"} {
+		assert.NoError(t, qc.NewQueue(name))
+	}
+	assert.NoError(t, qc.DeclareExchange("events", EXCHANGE_FANOUT))
+	assert.NoError(t, qc.DeclareExchange("events", EXCHANGE_FANOUT), "same type")
+	assert.Error(t, qc.DeclareExchange("events", EXCHANGE_TOPIC))
+	assert.Error(t, qc.DeclareExchange("other", "broadcast"))
+	for _, name := range []string{"billing", "audit", "analytics"} {
+		assert.NoError(t, qc.Bind("events", name, "", nil))
+	}
+	assert.Equal(t, ErrNoQueue, qc.Bind("events", "missing", "", nil))
+
+	n, err := qc.PublishTo("events", "order.created", NewMessage("", []byte("event")))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	for _, name := range []string{"BILLING", "AUDIT", "ANALYTICS"} {
+		q, _ := qc.GetQueue(name)
+		assert.Equal(t, 1, q.TotalMesssages(), name)
+		msg := q.storage[readyIds(q)[0]]
+		assert.Equal(t, name, msg.Header.Channel)
+	}
+
+	assert.NoError(t, qc.DeclareExchange("orders", EXCHANGE_TOPIC))
+	assert.NoError(t, qc.Bind("orders", "eu", "order.*.eu", nil))
+	assert.NoError(t, qc.Bind("orders", "eu", "#.refund", nil))
+	n, err = qc.PublishTo("orders", "order.created.eu", NewMessage("", []byte("event")))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = qc.PublishTo("orders", "order.created.us", NewMessage("", []byte("event")))
+	assert.Equal(t, ErrUnroutable, err)
+
+	assert.NoError(t, qc.DeclareExchange("direct", EXCHANGE_DIRECT))
+	assert.NoError(t, qc.Bind("direct", "audit", "login", nil))
+	n, err = qc.PublishTo("direct", "login", NewMessage("", []byte("event")))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = qc.PublishTo("direct", "logout", NewMessage("", []byte("event")))
+	assert.Equal(t, ErrUnroutable, err)
+	_, err = qc.PublishTo("missing", "logout", NewMessage("", []byte("event")))
+	assert.Equal(t, ErrNoExchange, err)
+}
+
+func TestQueuesControl_TopologyPersisted(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueue("billing"))
+	assert.NoError(t, qc.NewQueue("audit"))
+	assert.NoError(t, qc.DeclareExchange("events", EXCHANGE_TOPIC))
+	assert.NoError(t, qc.Bind("events", "billing", "order.#", nil))
+	assert.NoError(t, qc.Bind("events", "audit", "#", nil))
+	assert.NoError(t, qc.Unbind("events", "audit", "#", nil))
+	assert.NoError(t, qc.Bind("events", "audit", "order.created", nil))
+	assert.NoError(t, qc.Delete("billing", false, false), "its bindings go with it")
+
+	for name, q := range qc.queues {
+		assert.NoError(t, q.Close())
+		delete(qc.queues, name)
+	}
+	restarted := InitQueuesControl()
+	t.Cleanup(func() {
+		for _, q := range restarted.queues {
+			q.Close() // nolint
+		}
+	})
+	e, ok := restarted.exchanges["EVENTS"]
+	if assert.True(t, ok) {
+		assert.Equal(t, EXCHANGE_TOPIC, e.Type)
+		assert.Equal(t, []binding{{Queue: "AUDIT", Key: "order.created"}}, e.Bindings)
+	}
+	assert.FileExists(t, filepath.Join(config.Get().DataDir, topologyFile))
+}
+
+func TestQueuesControl_HeadersExchange(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueue("eu"))
+	assert.NoError(t, qc.NewQueue("tenants"))
+	assert.NoError(t, qc.DeclareExchange("tagged", EXCHANGE_HEADERS))
+	assert.NoError(t, qc.Bind("tagged", "eu", "", map[string]string{"region": "eu", "tenant": "42"}))
+	assert.NoError(t, qc.Bind("tagged", "tenants", "", map[string]string{BINDING_MATCH: BINDING_MATCH_ANY, "tenant": "42", "tenant-group": "7"}))
+	assert.Error(t, qc.Bind("tagged", "eu", "", map[string]string{BINDING_MATCH: "most"}))
+
+	route := func(headers map[string]string) []string {
+		return qc.exchanges["TAGGED"].route("", headers)
+	}
+	assert.Equal(t, []string{"EU", "TENANTS"}, route(map[string]string{"region": "eu", "tenant": "42", "user": "1"}))
+	assert.Equal(t, []string{"TENANTS"}, route(map[string]string{"region": "us", "tenant": "42"}))
+	assert.Equal(t, []string{"TENANTS"}, route(map[string]string{"tenant-group": "7"}))
+	assert.Equal(t, []string{}, route(map[string]string{"region": "eu"}))
+	assert.Equal(t, []string{}, route(nil))
+
+	msg := NewMessage("", []byte("event"))
+	msg.Header.Headers = map[string]string{"region": "eu", "tenant": "42"}
+	n, err := qc.PublishTo("tagged", "", msg)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// headers survive a restart
+	q, _ := qc.GetQueue("EU")
+	assert.NoError(t, q.Close())
+	delete(qc.queues, "EU")
+	q, err = newQueue("EU", nil)
+	assert.NoError(t, err)
+	qc.add(q)
+	assert.Equal(t, map[string]string{"region": "eu", "tenant": "42"}, q.storage[readyIds(q)[0]].Header.Headers)
+
+	assert.NoError(t, qc.Unbind("tagged", "eu", "", map[string]string{"tenant": "42", "region": "eu"}))
+	assert.Len(t, qc.exchanges["TAGGED"].Bindings, 1)
+}
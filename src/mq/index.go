@@ -0,0 +1,137 @@
+package mq
+
+import "container/list"
+
+/*
+messageIndex keeps the messages of a queue which are not scheduled
+in the lists the dispatcher works on, so every operation is O(1):
+
+  - ready: a FIFO list per priority level, the dispatcher takes the front
+    of the highest non-empty one. Levels are bounded by MAX_PRIORITY.
+  - waiting: the distributed messages waiting for an ack, in distribution
+    order, which is also the order of their ack deadlines.
+
+Messages held by a consumer after an UnAck are in none of the lists, they
+don't expire. Every message is removed through its list element.
+*/
+
+type indexEntry struct {
+	list *list.List
+	elem *list.Element
+}
+
+type messageIndex struct {
+	levels  []*list.List
+	waiting *list.List
+	entries map[string]indexEntry
+	ready   int
+}
+
+func newMessageIndex(maxPriority int) *messageIndex {
+	idx := &messageIndex{
+		levels:  make([]*list.List, maxPriority+1),
+		waiting: list.New(),
+		entries: map[string]indexEntry{},
+	}
+	for i := range idx.levels {
+		idx.levels[i] = list.New()
+	}
+	return idx
+}
+
+// level returns the ready list of msg, a priority over the queue max goes to the top level.
+func (idx *messageIndex) level(msg *QMessage) *list.List {
+	p := msg.Header.Priority
+	if p >= len(idx.levels) {
+		p = len(idx.levels) - 1
+	} else if p < 0 {
+		p = 0
+	}
+	return idx.levels[p]
+}
+
+// pushReady appends msg to the ready messages of its priority.
+func (idx *messageIndex) pushReady(msg *QMessage) {
+	idx.remove(msg.Id)
+	l := idx.level(msg)
+	idx.entries[msg.Id] = indexEntry{list: l, elem: l.PushBack(msg)}
+	idx.ready++
+}
+
+// requeue puts msg back at the front of the ready messages of its priority.
+func (idx *messageIndex) requeue(msg *QMessage) {
+	idx.remove(msg.Id)
+	l := idx.level(msg)
+	idx.entries[msg.Id] = indexEntry{list: l, elem: l.PushFront(msg)}
+	idx.ready++
+}
+
+// peekReady returns the oldest ready message of the highest priority, nil when none.
+func (idx *messageIndex) peekReady() *QMessage {
+	if idx.ready == 0 {
+		return nil
+	}
+	for p := len(idx.levels) - 1; p >= 0; p-- {
+		if e := idx.levels[p].Front(); e != nil {
+			return e.Value.(*QMessage)
+		}
+	}
+	return nil
+}
+
+// peekOldest returns the oldest ready message of the lowest priority, nil when none.
+func (idx *messageIndex) peekOldest() *QMessage {
+	if idx.ready == 0 {
+		return nil
+	}
+	for _, l := range idx.levels {
+		if e := l.Front(); e != nil {
+			return e.Value.(*QMessage)
+		}
+	}
+	return nil
+}
+
+// wait appends msg to the messages waiting for an ack.
+func (idx *messageIndex) wait(msg *QMessage) {
+	idx.remove(msg.Id)
+	idx.entries[msg.Id] = indexEntry{list: idx.waiting, elem: idx.waiting.PushBack(msg)}
+}
+
+// firstWaiting returns the message whose ack expires first, nil when none.
+func (idx *messageIndex) firstWaiting() *QMessage {
+	if e := idx.waiting.Front(); e != nil {
+		return e.Value.(*QMessage)
+	}
+	return nil
+}
+
+// remove takes message id out of its list, if any.
+func (idx *messageIndex) remove(id string) {
+	entry, ok := idx.entries[id]
+	if !ok {
+		return
+	}
+	entry.list.Remove(entry.elem)
+	delete(idx.entries, id)
+	if entry.list != idx.waiting {
+		idx.ready--
+	}
+}
+
+// isReady tells if message id is in a ready list.
+func (idx *messageIndex) isReady(id string) bool {
+	entry, ok := idx.entries[id]
+	return ok && entry.list != idx.waiting
+}
+
+// eachReady calls f on the ready messages, highest priority first, until f returns false.
+func (idx *messageIndex) eachReady(f func(msg *QMessage) bool) {
+	for p := len(idx.levels) - 1; p >= 0; p-- {
+		for e := idx.levels[p].Front(); e != nil; e = e.Next() {
+			if !f(e.Value.(*QMessage)) {
+				return
+			}
+		}
+	}
+}
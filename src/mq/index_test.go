@@ -0,0 +1,152 @@
+package mq
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// readyIds returns the ids of the ready messages of q in distribution order.
+func readyIds(q *queue) []string {
+	q.m.Lock()
+	defer q.m.Unlock()
+	ids := []string{}
+	q.index.eachReady(func(msg *QMessage) bool {
+		ids = append(ids, msg.Id)
+		return true
+	})
+	return ids
+}
+
+func TestMessageIndex(t *testing.T) {
+	idx := newMessageIndex(2)
+	msgs := []*QMessage{}
+	for i, p := range []int{0, 2, 0, 1, 5} {
+		msg := &QMessage{Id: string(rune('a' + i))}
+		msg.Header.Priority = p
+		idx.pushReady(msg)
+		msgs = append(msgs, msg)
+	}
+	assert.Equal(t, 5, idx.ready)
+	// priority 5 is capped to the top level, behind the older priority 2
+	assert.Equal(t, msgs[1], idx.peekReady())
+
+	idx.wait(msgs[1])
+	idx.wait(msgs[4])
+	assert.Equal(t, 3, idx.ready)
+	assert.Equal(t, msgs[1], idx.firstWaiting())
+	assert.Equal(t, msgs[3], idx.peekReady())
+
+	idx.requeue(msgs[1])
+	assert.Equal(t, msgs[1], idx.peekReady())
+	assert.Equal(t, msgs[4], idx.firstWaiting())
+
+	idx.remove(msgs[4].Id)
+	idx.remove(msgs[4].Id)
+	assert.Nil(t, idx.firstWaiting())
+	order := []string{}
+	idx.eachReady(func(msg *QMessage) bool {
+		order = append(order, msg.Id)
+		return true
+	})
+	assert.Equal(t, []string{"b", "d", "a", "c"}, order)
+	assert.Equal(t, 4, idx.ready)
+}
+
+// queue depths of the queue benchmarks, ns/op must not grow with them
+var benchDepths = []int{1000, 100000, 1000000}
+
+// benchQueue returns a queue holding depth messages, stored in a temp dir without fsync
+// so the benchmarks measure the queue structures and not the disk.
+func benchQueue(b *testing.B, depth int) *queue {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() {
+		log.SetOutput(os.Stderr)
+	})
+	q, err := openQueue("BENCH", b.TempDir(), &QueueOptions{Durability: DURABILITY_NONE})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		q.Close() // nolint
+	})
+	for i := 0; i < depth; i++ {
+		if err := q.Publish(NewMessage("BENCH", []byte("pending"))); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return q
+}
+
+// go test -bench="^Benchmark_Queue" -run=none -benchmem ./src/mq
+func Benchmark_Queue_Publish(b *testing.B) {
+	for _, depth := range benchDepths {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			q := benchQueue(b, depth)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_ = q.Publish(NewMessage("BENCH", []byte("data")))
+			}
+		})
+	}
+}
+
+// Benchmark_Queue_DispatchAck takes the next ready message and acks it,
+// the queue depth stays the same.
+func Benchmark_Queue_DispatchAck(b *testing.B) {
+	for _, depth := range benchDepths {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			q := benchQueue(b, depth+b.N)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				msg, err := q.GetQMessage()
+				if err != nil {
+					b.Fatal(err)
+				}
+				_ = q.Ack("", msg.Id)
+			}
+		})
+	}
+}
+
+// Benchmark_Queue_AckNewest acks the newest message, which used to be the slowest to remove.
+func Benchmark_Queue_AckNewest(b *testing.B) {
+	for _, depth := range benchDepths {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			q := benchQueue(b, depth)
+			ids := make([]string, b.N)
+			for i := range ids {
+				msg := NewMessage("BENCH", []byte("data"))
+				_ = q.Publish(msg)
+				ids[i] = msg.Id
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := b.N - 1; i >= 0; i-- {
+				_ = q.Ack("", ids[i])
+			}
+		})
+	}
+}
+
+// Benchmark_Queue_Sweep sweeps a queue whose messages don't expire yet.
+func Benchmark_Queue_Sweep(b *testing.B) {
+	for _, depth := range benchDepths {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			q := benchQueue(b, depth)
+			now := time.Now()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				q.sweep(now)
+			}
+		})
+	}
+}
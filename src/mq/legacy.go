@@ -0,0 +1,189 @@
+package mq
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+Before the segment log a queue was persisted in <DATA_DIR>/<QUEUE>.mq,
+rewritten on every change with the pending messages one after the other:
+
+	[9]byte data size | timestamp | [1]byte status | [28]byte id | data
+
+Size, timestamp and status are ASCII decimals and the timestamp has no fixed width.
+The id is the base64 sha1 digest of a uuid, it always ends with the only '=' of
+the record header, which is what tells where the timestamp digits stop.
+*/
+
+const (
+	legacyExt         = ".mq"
+	legacyMigratedExt = ".migrated"
+	legacySizeDigits  = 9
+	legacyIdSize      = 28
+)
+
+// readLegacyRecord parses the record at the start of data, returns it with the bytes consumed.
+func readLegacyRecord(data []byte) (QMessage, int, error) {
+	if len(data) < legacySizeDigits {
+		return QMessage{}, 0, errRecordTooShort
+	}
+	size, err := strconv.Atoi(string(data[:legacySizeDigits]))
+	if err != nil || size < 0 {
+		return QMessage{}, 0, fmt.Errorf("bad data size %q", data[:legacySizeDigits])
+	}
+	idEnd := bytes.IndexByte(data[legacySizeDigits:], '=')
+	if idEnd < 0 {
+		return QMessage{}, 0, errRecordTooShort
+	}
+	idEnd += legacySizeDigits + 1
+	idStart := idEnd - legacyIdSize
+	if idStart < legacySizeDigits+2 {
+		return QMessage{}, 0, errors.New("bad record header")
+	}
+	digits := data[legacySizeDigits:idStart]
+	for _, d := range digits {
+		if d < '0' || d > '9' {
+			return QMessage{}, 0, fmt.Errorf("bad timestamp %q", digits)
+		}
+	}
+	ts, err := strconv.ParseInt(string(digits[:len(digits)-1]), 10, 64)
+	if err != nil {
+		return QMessage{}, 0, fmt.Errorf("bad timestamp %q", digits)
+	}
+	end := idEnd + size
+	if end > len(data) {
+		return QMessage{}, 0, errRecordTooShort
+	}
+	body := make([]byte, size)
+	copy(body, data[idEnd:end])
+	msg := QMessage{
+		Header: Header{
+			Size:      size,
+			Timestamp: ts,
+		},
+		Id:     string(data[idStart:idEnd]),
+		Data:   body,
+		Status: int(digits[len(digits)-1] - '0'),
+	}
+	return msg, end, nil
+}
+
+// readLegacyFile returns the messages of a legacy file still waiting for an ack,
+// in their original order. The same message can be written more than once,
+// the last copy wins.
+func readLegacyFile(path string) ([]QMessage, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	order := []string{}
+	msgs := map[string]QMessage{}
+	var errRead error
+	for pos := 0; pos < len(data); {
+		msg, n, err := readLegacyRecord(data[pos:])
+		if err != nil {
+			errRead = fmt.Errorf("record at offset %d: %s, %d bytes skipped", pos, err, len(data)-pos)
+			break
+		}
+		if _, ok := msgs[msg.Id]; !ok {
+			order = append(order, msg.Id)
+		}
+		msgs[msg.Id] = msg
+		pos += n
+	}
+	pending := []QMessage{}
+	for _, id := range order {
+		if msg := msgs[id]; !isTerminalStatus(msg.Status) {
+			pending = append(pending, msg)
+		}
+	}
+	return pending, errRead
+}
+
+// removeLegacyFiles deletes the legacy files of queue name, migrated or not.
+func removeLegacyFiles(dataDir string, name string) error {
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		base := strings.TrimSuffix(e.Name(), legacyMigratedExt)
+		if !strings.HasSuffix(base, legacyExt) || e.IsDir() {
+			continue
+		}
+		if strings.ToUpper(strings.TrimSuffix(base, legacyExt)) == name {
+			if err := os.Remove(filepath.Join(dataDir, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateLegacy imports every <QUEUE>.mq file of dataDir into the log of its queue,
+// then renames the file to <QUEUE>.mq.migrated so it's imported only once.
+func (qc *queuesControl) migrateLegacy(dataDir string) {
+	paths, err := filepath.Glob(filepath.Join(dataDir, "*"+legacyExt))
+	if err != nil {
+		log.Println("[MQ] legacy migration skipped:", err)
+		return
+	}
+	for _, path := range paths {
+		name := strings.ToUpper(strings.TrimSuffix(filepath.Base(path), legacyExt))
+		imported, err := qc.migrateLegacyFile(name, path)
+		if err != nil {
+			log.Println("[MQ] legacy queue", name, "migration failed:", err)
+			continue
+		}
+		log.Printf("[MQ] legacy queue %s migrated: %d messages", name, imported)
+	}
+}
+
+func (qc *queuesControl) migrateLegacyFile(name string, path string) (int, error) {
+	msgs, errRead := readLegacyFile(path)
+	if errRead != nil {
+		if len(msgs) == 0 {
+			return 0, errRead
+		}
+		log.Printf("[MQ] legacy queue %s: %s", name, errRead)
+	}
+	q, ok := qc.queues[name]
+	if !ok {
+		var err error
+		if q, err = newQueue(name, nil); err != nil {
+			return 0, err
+		}
+		qc.add(q)
+	}
+	imported := 0
+	// the messages dropped to make room are dead-lettered once the import is synced
+	deadLetters := []deadLetter{}
+	defer func() { q.sendDeadLetters(deadLetters) }()
+	for _, msg := range msgs {
+		if _, ok := q.storage[msg.Id]; ok {
+			continue
+		}
+		msg.Header.Channel = name
+		_, letters, err := q.publish(msg)
+		deadLetters = append(deadLetters, letters...)
+		if err != nil {
+			return imported, err
+		}
+		imported++
+	}
+	// one sync for the whole file, whatever the queue durability
+	if err := q.Persist(); err != nil {
+		return imported, err
+	}
+	return imported, os.Rename(path, path+legacyMigratedExt)
+}
@@ -0,0 +1,152 @@
+package mq
+
+import (
+	"container/list"
+	"errors"
+	"log"
+)
+
+/*
+MaxLength and MaxBytes bound the messages a queue stores, whatever their
+status, MaxBytes counting the message data. A publish going over a limit
+makes room according to the queue Overflow:
+
+  - drop-head: the oldest ready messages of the lowest priority are dropped
+  - dead-letter: the same messages go to the dead letter queue, if the queue has one
+  - reject-publish: the publish fails with ErrQueueFull
+
+When there is no ready message left to make room the publish fails too.
+A dead-lettered overflow leaves the queue at once but stays in its log until its
+copy is stored: when the copy fails the message comes back to the queue, over the
+limit, and after a crash it's back too. Like any dead letter it's never lost.
+*/
+
+const (
+	OVERFLOW_DROP_HEAD      = "drop-head"
+	OVERFLOW_DEAD_LETTER    = "dead-letter"
+	OVERFLOW_REJECT_PUBLISH = "reject-publish"
+
+	DEATH_REASON_MAX_LENGTH = "max-length"
+)
+
+var ErrQueueFull = errors.New("queue full")
+
+// overflows tells if adding size bytes goes over the queue limits, q.m must be held.
+func (q *queue) overflows(size int64) bool {
+	return (q.options.MaxLength > 0 && len(q.storage)+1 > q.options.MaxLength) ||
+		(q.options.MaxBytes > 0 && q.bytes+size > q.options.MaxBytes)
+}
+
+// accepts tells if makeRoom succeeds for each of the prepared msgs published in turn,
+// once the messages of gone left the queue. q.m must be held.
+func (q *queue) accepts(msgs []*QMessage, gone []*QMessage) bool {
+	length := len(q.storage) - len(gone)
+	bytes := q.bytes
+	for _, msg := range gone {
+		bytes -= int64(len(msg.Data))
+	}
+	overflows := func(size int64) bool {
+		return (q.options.MaxLength > 0 && length+1 > q.options.MaxLength) ||
+			(q.options.MaxBytes > 0 && bytes+size > q.options.MaxBytes)
+	}
+	// the ready messages makeRoom would drop, in order: per level the stored ones then msgs
+	stored := map[*list.List]*list.Element{}
+	for _, l := range q.index.levels {
+		stored[l] = l.Front()
+	}
+	added := map[*list.List][]*QMessage{}
+	oldest := func() *QMessage {
+		for _, l := range q.index.levels {
+			if e := stored[l]; e != nil {
+				stored[l] = e.Next()
+				return e.Value.(*QMessage)
+			}
+			if len(added[l]) > 0 {
+				msg := added[l][0]
+				added[l] = added[l][1:]
+				return msg
+			}
+		}
+		return nil
+	}
+	for _, msg := range msgs {
+		size := int64(len(msg.Data))
+		if overflows(size) && (q.options.Overflow == OVERFLOW_REJECT_PUBLISH || (q.options.MaxBytes > 0 && size > q.options.MaxBytes)) {
+			return false
+		}
+		for overflows(size) {
+			head := oldest()
+			if head == nil {
+				return false
+			}
+			length--
+			bytes -= int64(len(head.Data))
+		}
+		length++
+		bytes += size
+		if msg.Status != STATUS_MESSAGE_SCHEDULED {
+			l := q.index.level(msg)
+			added[l] = append(added[l], msg)
+		}
+	}
+	return true
+}
+
+// makeRoom applies the overflow policy until a message of size bytes fits.
+// Returns the dead letters of the removed messages, q.m must be held.
+func (q *queue) makeRoom(size int64) ([]deadLetter, error) {
+	if !q.overflows(size) {
+		return nil, nil
+	}
+	if q.options.Overflow == OVERFLOW_REJECT_PUBLISH || (q.options.MaxBytes > 0 && size > q.options.MaxBytes) {
+		return nil, ErrQueueFull
+	}
+	deadLetters := []deadLetter{}
+	for q.overflows(size) {
+		head := q.index.peekOldest()
+		if head == nil {
+			return deadLetters, ErrQueueFull
+		}
+		if q.options.Overflow == OVERFLOW_DEAD_LETTER && q.options.DeadLetter != "" {
+			dl := q.deadLetterCopy(head, DEATH_REASON_MAX_LENGTH)
+			dl.evicted = head
+			deadLetters = append(deadLetters, dl)
+			q.evict(head)
+		} else if _, err := q.remove(head, STATUS_MESSAGE_REJECTED); err != nil {
+			return deadLetters, err
+		}
+		q.dropped++
+	}
+	log.Println("[MQ] queue", q.name, "overflow,", q.dropped, "messages dropped since startup")
+	return deadLetters, nil
+}
+
+// evictFor is makeRoom in memory only, for a publish accepts let through: the dropped
+// messages are returned for their status to be logged. q.m must be held.
+func (q *queue) evictFor(size int64) ([]*QMessage, []deadLetter) {
+	if !q.overflows(size) {
+		return nil, nil
+	}
+	dropped := []*QMessage{}
+	deadLetters := []deadLetter{}
+	for q.overflows(size) {
+		head := q.index.peekOldest()
+		if head == nil {
+			break
+		}
+		if q.options.Overflow == OVERFLOW_DEAD_LETTER && q.options.DeadLetter != "" {
+			dl := q.deadLetterCopy(head, DEATH_REASON_MAX_LENGTH)
+			dl.evicted = head
+			deadLetters = append(deadLetters, dl)
+			q.evict(head)
+		} else {
+			head.Status = STATUS_MESSAGE_REJECTED
+			dropped = append(dropped, head)
+			q.evict(head)
+			q.release(head.Id)
+		}
+		q.dropped++
+	}
+	log.Println("[MQ] queue", q.name, "overflow,", q.dropped, "messages dropped since startup")
+	return dropped, deadLetters
+}
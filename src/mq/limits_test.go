@@ -0,0 +1,90 @@
+package mq
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func publishAll(t *testing.T, q *queue, n int) []QMessage {
+	msgs := []QMessage{}
+	for i := 0; i < n; i++ {
+		msg := NewMessage(q.name, []byte("0123456789"))
+		assert.NoError(t, q.Publish(msg))
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestQueue_OverflowDropHead(t *testing.T) {
+	q, err := openQueue("TEST", t.TempDir(), &QueueOptions{MaxLength: 3})
+	assert.NoError(t, err)
+	defer q.Close() // nolint
+	msgs := publishAll(t, q, 5)
+	assert.Equal(t, []string{msgs[2].Id, msgs[3].Id, msgs[4].Id}, readyIds(q))
+	assert.Equal(t, 2, q.dropped)
+	assert.Equal(t, int64(30), q.bytes)
+}
+
+func TestQueue_OverflowRejectPublish(t *testing.T) {
+	q, err := openQueue("TEST", t.TempDir(), &QueueOptions{MaxBytes: 25, Overflow: OVERFLOW_REJECT_PUBLISH})
+	assert.NoError(t, err)
+	defer q.Close() // nolint
+	msgs := publishAll(t, q, 2)
+	assert.Equal(t, ErrQueueFull, q.Publish(NewMessage("TEST", []byte("0123456789"))))
+	assert.NoError(t, q.Publish(NewMessage("TEST", []byte("01234"))))
+	assert.NoError(t, q.Ack("", msgs[0].Id))
+	assert.NoError(t, q.Publish(NewMessage("TEST", []byte("0123456789"))))
+	assert.Equal(t, int64(25), q.bytes)
+}
+
+func TestQueue_OverflowDeadLetter(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueueWithOptions("work", QueueOptions{MaxLength: 2, Overflow: OVERFLOW_DEAD_LETTER, DeadLetter: "dead"}))
+	q, err := qc.GetQueue("WORK")
+	assert.NoError(t, err)
+	msgs := publishAll(t, q, 3)
+	assert.Equal(t, []string{msgs[1].Id, msgs[2].Id}, readyIds(q))
+
+	dead, err := qc.GetQueue("DEAD")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dead.TotalMesssages())
+	dl := dead.storage[readyIds(dead)[0]]
+	assert.Equal(t, DEATH_REASON_MAX_LENGTH, dl.Header.Headers[HEADER_DEATH_REASON])
+	assert.Equal(t, msgs[0].Id, dl.Header.Headers[HEADER_DEATH_ID])
+}
+
+func TestQueue_OverflowDeadLetterFails(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueueWithOptions("dead", QueueOptions{MaxLength: 1, Overflow: OVERFLOW_REJECT_PUBLISH}))
+	assert.NoError(t, qc.NewQueueWithOptions("work", QueueOptions{MaxLength: 2, Overflow: OVERFLOW_DEAD_LETTER, DeadLetter: "dead"}))
+	q, err := qc.GetQueue("WORK")
+	assert.NoError(t, err)
+	msgs := publishAll(t, q, 4)
+
+	// the dead letter queue took the first one and refused the second, which stays
+	assert.Equal(t, []string{msgs[1].Id, msgs[2].Id, msgs[3].Id}, readyIds(q))
+	assert.Equal(t, int64(30), q.bytes)
+	assert.NoError(t, q.Close())
+	delete(qc.queues, "WORK")
+	q, err = newQueue("WORK", nil)
+	assert.NoError(t, err)
+	defer q.Close() // nolint
+	assert.Equal(t, []string{msgs[1].Id, msgs[2].Id, msgs[3].Id}, readyIds(q))
+}
+
+func TestQueue_OverflowWithoutReadyMessages(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openQueue("TEST", dir, &QueueOptions{MaxLength: 1})
+	assert.NoError(t, err)
+	msg := publishAll(t, q, 1)[0]
+	assert.NoError(t, q.UnAck("", msg.Id))
+	assert.Equal(t, ErrQueueFull, q.Publish(NewMessage("TEST", []byte("data"))))
+	assert.NoError(t, q.Close())
+
+	q2, err := openQueue("TEST", dir, nil)
+	assert.NoError(t, err)
+	defer q2.Close() // nolint
+	assert.Equal(t, int64(10), q2.bytes)
+	assert.Equal(t, OVERFLOW_DROP_HEAD, q2.options.Overflow)
+}
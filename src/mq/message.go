@@ -2,12 +2,14 @@ package mq
 
 import (
 	"encoding/base64"
-	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"math"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 	"tomqserver/src/utils"
 
@@ -21,32 +23,48 @@ const (
 	STATUS_MESSAGE_ACK          = 3
 	STATUS_MESSAGE_REJECTED     = 4
 	STATUS_MESSAGE_WAITING_NACK = 5
+	STATUS_MESSAGE_EXPIRED      = 6
+	STATUS_MESSAGE_SCHEDULED    = 7
+	STATUS_MESSAGE_PURGED       = 8
 )
 
 var StatusName = map[int]string{
-	STATUS_MESSAGE_RECEIVED: "RECEIVED",
-	STATUS_MESSAGE_ACK:      "ACKNOWLEDGED",
-	STATUS_MESSAGE_READY:    "READY",
-	STATUS_MESSAGE_REJECTED: "REJECTED",
-	STATUS_MESSAGE_UNACK:    "UNACKNOWLEDGED",
+	STATUS_MESSAGE_RECEIVED:  "RECEIVED",
+	STATUS_MESSAGE_ACK:       "ACKNOWLEDGED",
+	STATUS_MESSAGE_READY:     "READY",
+	STATUS_MESSAGE_REJECTED:  "REJECTED",
+	STATUS_MESSAGE_UNACK:     "UNACKNOWLEDGED",
+	STATUS_MESSAGE_EXPIRED:   "EXPIRED",
+	STATUS_MESSAGE_SCHEDULED: "SCHEDULED",
+	STATUS_MESSAGE_PURGED:    "PURGED",
 }
 
 type Header struct {
-	Channel   string `json:"channel,omitempty"`
-	Size      int    `json:"size,omitempty"`
-	Timestamp int64  `json:"timestamp,omitempty"`
+	Channel    string            `json:"channel,omitempty"`
+	Size       int               `json:"size,omitempty"`
+	Timestamp  int64             `json:"timestamp,omitempty"`
+	Expiration int64             `json:"expiration,omitempty"` // unix nano after which the message is dropped, 0 never
+	DeliverAt  int64             `json:"deliver_at,omitempty"` // unix nano before which the message is not distributed
+	Priority   int               `json:"priority,omitempty"`   // from 0 to the max priority of the queue
+	Headers    map[string]string `json:"headers,omitempty"`
+	// application properties, the server carries them without looking at them
+	ContentType     string `json:"content_type,omitempty"`
+	ContentEncoding string `json:"content_encoding,omitempty"`
+	CorrelationId   string `json:"correlation_id,omitempty"`
+	ReplyTo         string `json:"reply_to,omitempty"`
 }
 
 type QMessage struct {
-	Header Header `json:"header,omitempty"`
-	Id     string `json:"id"`
-	Data   []byte `json:"data,omitempty"`
-	Status int    `json:"status,omitempty"`
+	Header        Header `json:"header,omitempty"`
+	Id            string `json:"id"`
+	Data          []byte `json:"data,omitempty"`
+	Status        int    `json:"status,omitempty"`
+	DeliveryCount int    `json:"delivery_count,omitempty"` // times the message was distributed
+	LastConsumer  string `json:"last_consumer,omitempty"`  // session id of the last consumer it went to
 }
 
 type IMessage interface {
 	Marshal() ([]byte, error)
-	Line() []byte
 }
 
 func (m *QMessage) Marshal() ([]byte, error) {
@@ -66,9 +84,17 @@ func (m *QMessage) ShowStatus() string {
 	return StatusName[m.Status]
 }
 
-func (m *QMessage) SetDistributed() {
+// SetDistributed marks the message as sent to consumer sid.
+func (m *QMessage) SetDistributed(sid string) {
 	m.Status = STATUS_MESSAGE_WAITING_NACK
 	m.Header.Timestamp = time.Now().UnixNano()
+	m.DeliveryCount++
+	m.LastConsumer = sid
+}
+
+// Redelivered tells if the message was distributed before.
+func (m *QMessage) Redelivered() bool {
+	return m.DeliveryCount > 1
 }
 
 func NewMessage(channel string, data []byte) QMessage {
@@ -87,107 +113,151 @@ func NewMessage(channel string, data []byte) QMessage {
 	return msg
 }
 
+// TcpData is the distribute payload:
+// ID BASE64_DATA attempt=N redelivered=BOOL [PROPERTY=VALUE]... [header.KEY=VALUE]...
 func (m *QMessage) TcpData() []byte {
 	data := []byte(m.Id)
 	data = append(data, []byte(" ")...)
 	data = append(data, []byte(base64.StdEncoding.EncodeToString(m.Data))...)
+	data = append(data, []byte(" attempt="+strconv.Itoa(m.DeliveryCount))...)
+	data = append(data, []byte(" redelivered="+strconv.FormatBool(m.Redelivered()))...)
+	for _, arg := range append(m.PropertyArgs(), m.HeaderArgs()...) {
+		data = append(data, ' ')
+		data = append(data, arg...)
+	}
 	return data
 }
 
-func (m *QMessage) Line() []byte {
-	var line []byte
-	dataSize := fmt.Sprintf("%09d", len(m.Data))
-
-	id := []byte(m.Id)
-	timestamp := make([]byte, 18)
-	binary.LittleEndian.PutUint64(timestamp, uint64(m.Header.Timestamp))
-	line = append(line, []byte(dataSize)...)
-	line = append(line, []byte(strconv.Itoa(int(m.Header.Timestamp)))...)
-	line = append(line, []byte(strconv.Itoa(m.Status))...)
-	line = append(line, id...)
-	line = append(line, m.Data...)
-	//println("LINE   ", string(line))
-	//println("LINESTR", lineStr(line))
-	return line
-}
-
-func LineSS(m QMessage) {
-	var line []byte
-
-	id := []byte(m.Id)
-	timestamp := make([]byte, 18)
-	binary.LittleEndian.PutUint64(timestamp, uint64(m.Header.Timestamp))
-	line = append(line, []byte(strconv.Itoa(int(m.Header.Timestamp)))...)
-	line = append(line, byte(m.Status))
-	line = append(line, id...)
-	line = append(line, m.Data...)
-	println("LINESS ", string(line))
-
-}
-
-func lineStr(data []byte) string {
-	var line string
-	dataSize := data[:9]
-	log.Println("DATASIZE", string(dataSize))
-	timestamp := data[9:28]
-	log.Println("TIME", string(timestamp))
-	status := data[29:30]
-	msgId := data[29:57]
-	log.Println("ID", string(msgId))
-	body := data[57:]
-	line += string(dataSize)
-	line += string(timestamp)
-	line += string(status)
-	line += string(msgId)
-	line += string(body)
-	// statusInt, _ := strconv.Atoi(string(status))
-	// println("STATUS STR", StatusName[statusInt])
-	msg2, err := ReadMessage(data, "general", 0)
-	if err != nil {
-		return err.Error()
+// ErrDuplicateId refuses a message whose id is already in the queue.
+var ErrDuplicateId = errors.New("message id already in the queue")
+
+// MAX_MESSAGE_ID_SIZE bounds the ids chosen by publishers
+const MAX_MESSAGE_ID_SIZE = 255
+
+// SetId replaces the generated id of m by the one chosen by the publisher.
+func (m *QMessage) SetId(id string) error {
+	if id == "" || len(id) > MAX_MESSAGE_ID_SIZE || strings.ContainsAny(id, " \t\r\n") {
+		return fmt.Errorf("bad message id %q", id)
 	}
-	LineSS(msg2)
-	return line
+	m.Id = id
+	return nil
 }
 
-func ReadMessage(data []byte, channel string, bytePos int) (QMessage, error) {
-	headerSize := 57
+// the wire arguments of the application properties
+const (
+	PROPERTY_CONTENT_TYPE     = "content-type"
+	PROPERTY_CONTENT_ENCODING = "content-encoding"
+	PROPERTY_CORRELATION_ID   = "correlation-id"
+	PROPERTY_REPLY_TO         = "reply-to"
+)
 
-	dataSizeBytes := 9
-	timestampBytes := 18
-	statusBytes := 1
-	//msgIdBytes := 28
-	dataSize, err := strconv.Atoi(string(data[:9]))
-	bytePos = bytePos + dataSizeBytes
-	if err != nil {
-		return QMessage{}, errors.New("bad data size " + err.Error())
+// property returns the field of the application property name, nil for an unknown name.
+func (m *QMessage) property(name string) *string {
+	switch name {
+	case PROPERTY_CONTENT_TYPE:
+		return &m.Header.ContentType
+	case PROPERTY_CONTENT_ENCODING:
+		return &m.Header.ContentEncoding
+	case PROPERTY_CORRELATION_ID:
+		return &m.Header.CorrelationId
+	case PROPERTY_REPLY_TO:
+		return &m.Header.ReplyTo
 	}
+	return nil
+}
 
-	ts, err := strconv.ParseInt(string(data[9:28]), 10, 64)
-	bytePos = bytePos + timestampBytes
-	if err != nil {
-		return QMessage{}, errors.New("bad timestamp " + err.Error())
+// PropertyArgs returns the application properties of m which are set as
+// PROPERTY=VALUE wire arguments, the values are query escaped.
+func (m *QMessage) PropertyArgs() []string {
+	args := []string{}
+	for _, name := range []string{PROPERTY_CONTENT_TYPE, PROPERTY_CONTENT_ENCODING, PROPERTY_CORRELATION_ID, PROPERTY_REPLY_TO} {
+		if v := *m.property(name); v != "" {
+			args = append(args, name+"="+url.QueryEscape(v))
+		}
+	}
+	return args
+}
+
+// SetPropertyArg sets the application property name from its escaped wire value,
+// returns false when name is not a property.
+func (m *QMessage) SetPropertyArg(name string, value string) (bool, error) {
+	p := m.property(name)
+	if p == nil {
+		return false, nil
 	}
+	v, err := url.QueryUnescape(value)
 	if err != nil {
-		return QMessage{}, errors.New("bad timestamp")
+		return true, fmt.Errorf("bad %s %q", name, value)
 	}
+	if len(v) > MAX_HEADER_SIZE {
+		return true, fmt.Errorf("%w: %s", ErrHeaderTooLong, name)
+	}
+	*p = v
+	return true, nil
+}
 
-	var st []byte = data[28:29]
-	bytePos += statusBytes
-	byteToInt, _ := strconv.Atoi(string(st))
-	if len(data) <= 2 {
-		return QMessage{}, errors.New("no data to parse")
+// the message headers bounds, the log records and the frames hold the counts and the
+// sizes on 16 bits
+const (
+	MAX_HEADER_SIZE = math.MaxUint16 // of a key, a value or an application property
+	MAX_HEADERS     = math.MaxUint16
+)
+
+// ErrHeaderTooLong refuses a message whose headers go over the bounds.
+var ErrHeaderTooLong = errors.New("message headers too long")
+
+// CheckHeaders returns ErrHeaderTooLong when the headers of m go over the bounds.
+func (m *QMessage) CheckHeaders() error {
+	if len(m.Header.Headers) > MAX_HEADERS {
+		return fmt.Errorf("%w: %d headers", ErrHeaderTooLong, len(m.Header.Headers))
 	}
-	body := data[57 : headerSize+dataSize]
-	m := QMessage{
-		Header: Header{
-			Channel:   channel,
-			Size:      0,
-			Timestamp: ts,
-		},
-		Id:     string(data[29:57]),
-		Data:   body,
-		Status: byteToInt,
+	for k, v := range m.Header.Headers {
+		if len(k) > MAX_HEADER_SIZE || len(v) > MAX_HEADER_SIZE {
+			return fmt.Errorf("%w: %.32q...", ErrHeaderTooLong, k)
+		}
+	}
+	for _, name := range []string{PROPERTY_CONTENT_TYPE, PROPERTY_CONTENT_ENCODING, PROPERTY_CORRELATION_ID, PROPERTY_REPLY_TO} {
+		if len(*m.property(name)) > MAX_HEADER_SIZE {
+			return fmt.Errorf("%w: %s", ErrHeaderTooLong, name)
+		}
+	}
+	return nil
+}
+
+// HEADER_ARG_PREFIX starts a message header written as a wire argument: header.KEY=VALUE,
+// key and value are query escaped.
+const HEADER_ARG_PREFIX = "header."
+
+// HeaderArgs returns the headers of m as wire arguments, sorted by key.
+func (m *QMessage) HeaderArgs() []string {
+	args := make([]string, 0, len(m.Header.Headers))
+	for k, v := range m.Header.Headers {
+		args = append(args, HEADER_ARG_PREFIX+url.QueryEscape(k)+"="+url.QueryEscape(v))
+	}
+	sort.Strings(args)
+	return args
+}
+
+// SetHeaderArg reads a header.KEY=VALUE wire argument into the headers of m.
+func (m *QMessage) SetHeaderArg(arg string) error {
+	kv := strings.SplitN(strings.TrimPrefix(arg, HEADER_ARG_PREFIX), "=", 2)
+	if !strings.HasPrefix(arg, HEADER_ARG_PREFIX) || len(kv) != 2 {
+		return fmt.Errorf("bad header %q", arg)
+	}
+	k, errKey := url.QueryUnescape(kv[0])
+	v, errValue := url.QueryUnescape(kv[1])
+	if errKey != nil || errValue != nil || k == "" {
+		return fmt.Errorf("bad header %q", arg)
+	}
+	if len(k) > MAX_HEADER_SIZE || len(v) > MAX_HEADER_SIZE {
+		return fmt.Errorf("%w: %.32q...", ErrHeaderTooLong, k)
+	}
+	if _, ok := m.Header.Headers[k]; !ok && len(m.Header.Headers) >= MAX_HEADERS {
+		return fmt.Errorf("%w: %d headers", ErrHeaderTooLong, len(m.Header.Headers)+1)
+	}
+	if m.Header.Headers == nil {
+		m.Header.Headers = map[string]string{}
 	}
-	return m, nil
+	m.Header.Headers[k] = v
+	return nil
 }
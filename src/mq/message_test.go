@@ -0,0 +1,108 @@
+package mq
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQMessage_HeaderArgs(t *testing.T) {
+	msg := NewMessage("WORK", []byte("data"))
+	msg.Header.Headers = map[string]string{"region": "eu", "note": "two words=yes", "tenant": "42"}
+	args := msg.HeaderArgs()
+	assert.Equal(t, []string{"header.note=two+words%3Dyes", "header.region=eu", "header.tenant=42"}, args)
+
+	payload := string(msg.TcpData())
+	assert.True(t, strings.HasSuffix(payload, " "+strings.Join(args, " ")), payload)
+
+	parsed := NewMessage("WORK", []byte("data"))
+	for _, arg := range strings.Fields(payload)[4:] {
+		assert.NoError(t, parsed.SetHeaderArg(arg))
+	}
+	assert.Equal(t, msg.Header.Headers, parsed.Header.Headers)
+
+	assert.Error(t, parsed.SetHeaderArg("header.=x"))
+	assert.Error(t, parsed.SetHeaderArg("header.novalue"))
+	assert.Error(t, parsed.SetHeaderArg("region=eu"))
+	assert.Error(t, parsed.SetHeaderArg("header.bad=%zz"))
+	long := strings.Repeat("x", MAX_HEADER_SIZE+1)
+	assert.ErrorIs(t, parsed.SetHeaderArg("header.long="+long), ErrHeaderTooLong)
+	assert.ErrorIs(t, parsed.SetHeaderArg("header."+long+"=x"), ErrHeaderTooLong)
+}
+
+func TestQueue_PublishHeadersTooLong(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueue("work"))
+	q, _ := qc.GetQueue("WORK")
+
+	msg := NewMessage("WORK", []byte("data"))
+	msg.Header.Headers = map[string]string{strings.Repeat("k", MAX_HEADER_SIZE+1): "v"}
+	assert.ErrorIs(t, q.Publish(msg), ErrHeaderTooLong)
+	_, err := q.log.Publish(&msg)
+	assert.ErrorIs(t, err, ErrHeaderTooLong, "never written to the log")
+	assert.Equal(t, 0, q.TotalMesssages())
+
+	msg.Header.Headers = map[string]string{}
+	for i := 0; i <= MAX_HEADERS; i++ {
+		msg.Header.Headers[fmt.Sprint(i)] = ""
+	}
+	assert.ErrorIs(t, q.Publish(msg), ErrHeaderTooLong)
+	assert.NoError(t, qc.Begin("1"))
+	assert.ErrorIs(t, qc.StagePublish("1", msg), ErrHeaderTooLong)
+}
+
+func TestQMessage_Properties(t *testing.T) {
+	msg := NewMessage("WORK", []byte("data"))
+	for _, arg := range []string{"content-type=application%2Fjson", "correlation-id=req+1", "reply-to=REPLIES"} {
+		kv := strings.SplitN(arg, "=", 2)
+		ok, err := msg.SetPropertyArg(kv[0], kv[1])
+		assert.True(t, ok)
+		assert.NoError(t, err)
+	}
+	ok, _ := msg.SetPropertyArg("ttl", "10")
+	assert.False(t, ok, "not a property")
+	assert.Equal(t, "application/json", msg.Header.ContentType)
+	assert.Equal(t, "req 1", msg.Header.CorrelationId)
+	assert.Equal(t, []string{"content-type=application%2Fjson", "correlation-id=req+1", "reply-to=REPLIES"}, msg.PropertyArgs())
+	assert.Contains(t, string(msg.TcpData()), " redelivered=false content-type=application%2Fjson correlation-id=req+1 reply-to=REPLIES")
+
+	assert.NoError(t, msg.SetId("order-42"))
+	assert.Equal(t, "order-42", msg.Id)
+	assert.Error(t, msg.SetId(""))
+	assert.Error(t, msg.SetId("two words"))
+	assert.Error(t, msg.SetId(strings.Repeat("x", MAX_MESSAGE_ID_SIZE+1)))
+}
+
+func TestQueue_PublishProperties(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueue("work"))
+	q, err := qc.GetQueue("WORK")
+	assert.NoError(t, err)
+
+	msg := NewMessage("WORK", []byte("data"))
+	assert.NoError(t, msg.SetId("order-42"))
+	msg.Header.ContentType = "text/plain"
+	msg.Header.ReplyTo = "REPLIES"
+	assert.NoError(t, q.Publish(msg))
+	assert.Equal(t, ErrDuplicateId, q.Publish(msg))
+
+	peeked := q.Peek(10)
+	if assert.Len(t, peeked, 1) {
+		assert.Equal(t, "order-42", peeked[0].Id)
+		assert.Equal(t, "text/plain", peeked[0].Header.ContentType)
+	}
+
+	// the properties survive a restart
+	assert.NoError(t, q.Close())
+	delete(qc.queues, "WORK")
+	q, err = newQueue("WORK", nil)
+	assert.NoError(t, err)
+	qc.add(q)
+	restored := q.storage["order-42"]
+	if assert.NotNil(t, restored) {
+		assert.Equal(t, "text/plain", restored.Header.ContentType)
+		assert.Equal(t, "REPLIES", restored.Header.ReplyTo)
+	}
+}
@@ -6,26 +6,49 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 	"tomqserver/config"
-	"tomqserver/src/utils"
 )
 
 type queue struct {
-	name          string
-	consumers     []*consumer
-	publishers    *list.List
-	messagesOrder []string
-	storage       map[string]*QMessage
-	m             sync.Mutex
+	name            string
+	consumers       []*consumer
+	publishers      *list.List
+	storage         map[string]*QMessage
+	index           *messageIndex
+	holders         map[string]*consumer // consumer holding each message in flight
+	pulled          map[string]string    // session holding each pulled message in flight
+	pullers         chan struct{}        // closed when messages are ready for the waiting pulls
+	tm              transactionManager   // transaction of each distribution
+	restoring       []string             // publish order while the log is replayed
+	log             *segmentLog
+	options         QueueOptions
+	recovery        recoveryReport
+	wake            chan struct{}
+	deliver         DeliveryHandler
+	deadLetterRoute DeadLetterRoute
+	expired         int // messages expired since startup
+	scheduled       scheduleHeap
+	expiring        expiryHeap
+	expiredHeld     []*QMessage // expired while out of the ready lists
+	bytes           int64       // data size of the stored messages
+	owner           string      // session id of the declarer of an exclusive queue
+	hadConsumer     bool        // an auto-delete queue goes when its last consumer leaves
+	dropped         int         // messages dropped by overflows since startup
+	ackDeadline     int64       // unix nano of the first ack to expire, 0 when none
+	stop            chan struct{}
+	workers         sync.WaitGroup
+	m               sync.Mutex
 }
 
 type Queue interface {
 	Add(QMessage QMessage) error
-	Ack(QMessageId string) error
-	UnAck(QMessageId string) error
-	Reject(QMessageId string) error
+	Ack(sid string, QMessageId string) error
+	UnAck(sid string, QMessageId string) error
+	Reject(sid string, QMessageId string, requeue bool) error
 	GetQMessage() QMessage
 	NewQueue(name string) (queue, error)
 	RegisterConsumer(c consumer) error
@@ -36,6 +59,7 @@ type Queue interface {
 	UpdateConsumer(sid string, status int)
 	UnregisterConsumer(sid string)
 	CheckDistributeTime()
+	Credit(sid string, n int) error
 	GetStorageByteSize() int64
 }
 
@@ -54,19 +78,7 @@ func (q *queue) GetStorageByteSize() int64 {
 func (q *queue) CheckDistributeTime() {
 	q.m.Lock()
 	defer q.m.Unlock()
-	maxTime := config.MAX_TIME_DISTRIBUTED_ACK * 1000000000
-	now := time.Now().UnixNano()
-	for id, msg := range q.storage {
-		if msg.Status == STATUS_MESSAGE_WAITING_NACK {
-			diff := now - msg.Header.Timestamp
-			if diff >= maxTime {
-				// acknowledgment expired
-				log.Println("Message ack expired")
-				msg.Status = STATUS_MESSAGE_READY
-				q.storage[id] = msg
-			}
-		}
-	}
+	q.expireDistributed(time.Now().UnixNano())
 }
 
 func (q *queue) UpdateConsumer(sid string, status int) {
@@ -79,18 +91,60 @@ func (q *queue) UpdateConsumer(sid string, status int) {
 			break
 		}
 	}
+	if status == CONSUMER_STATUS_IDLE {
+		q.notify()
+	}
 }
 
+// UnregisterConsumer removes the consumer, the messages it was holding
+// or had pulled are distributed again.
 func (q *queue) UnregisterConsumer(sid string) {
 	q.m.Lock()
 	defer q.m.Unlock()
-	for _, consumer := range q.consumers {
+	held := q.pulledBy(sid)
+	for i, consumer := range q.consumers {
 		if sid == fmt.Sprint(consumer.session.ID()) {
-			consumer.status = 3
-			fmt.Println("consumer unregistered?")
+			consumer.status = CONSUMER_STATUS_CLOSED
+			for id := range consumer.inFlight {
+				delete(q.holders, id)
+				q.tm.end(id)
+				if msg, ok := q.storage[id]; ok {
+					held = append(held, msg)
+				}
+			}
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			fmt.Println("consumer unregistered", sid)
 			break
 		}
 	}
+	if len(held) == 0 {
+		return
+	}
+	// back to the front in the order they were distributed
+	sort.Slice(held, func(i, j int) bool { return held[i].Header.Timestamp > held[j].Header.Timestamp })
+	for _, msg := range held {
+		msg.Status = STATUS_MESSAGE_READY
+		q.index.requeue(msg)
+	}
+	q.notify()
+}
+
+// Credit widens the in-flight window of consumer sid by n messages, up to MAX_PREFETCH.
+func (q *queue) Credit(sid string, n int) error {
+	if n < 1 {
+		return errors.New("credit must be positive")
+	}
+	q.m.Lock()
+	defer q.m.Unlock()
+	for _, consumer := range q.consumers {
+		if sid == fmt.Sprint(consumer.session.ID()) {
+			consumer.credit(n)
+			consumer.refreshStatus()
+			q.notify()
+			return nil
+		}
+	}
+	return ErrNoConsumer
 }
 
 func (q *queue) ListConsumers() []*consumer {
@@ -98,155 +152,409 @@ func (q *queue) ListConsumers() []*consumer {
 }
 
 func (q *queue) RegisterConsumer(c consumer) error {
+	q.m.Lock()
+	if q.owner != "" && q.owner != fmt.Sprint(c.session.ID()) {
+		q.m.Unlock()
+		return ErrExclusive
+	}
 	q.consumers = append(q.consumers, &c)
+	q.hadConsumer = true
+	q.m.Unlock()
+	q.notify()
 	return nil
 }
 
-func (q *queue) Persist() error {
-
-	dataPath := "/home/ozy/GO/toMQServer/data/"
-	fileName := dataPath + q.name + ".mq"
-	if err := Save(fileName, q); err != nil {
-		log.Fatalln(err)
-	}
-	f, err := os.Open(fileName)
-	f.Close()
-	if err != nil {
-		log.Println("OPEN ERR", err)
-		f2, err2 := os.Create(fileName)
-		f2.Close()
-		if err2 != nil {
-			return err2
-		}
-		log.Println("File", fileName, "created!")
-	}
-	for _, msg := range q.storage {
-		if msg.Status != STATUS_MESSAGE_ACK && msg.Status != STATUS_MESSAGE_REJECTED {
-			data := msg.Line()
-			WriteFile(fileName, data)
-		}
+// unused tells if the queue lost its reason to exist: the owner of an exclusive
+// queue is gone or the last consumer of an auto-delete queue left.
+func (q *queue) unused(closedSid string) bool {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.owner != "" && q.owner == closedSid {
+		return true
 	}
+	return q.options.AutoDelete && q.hadConsumer && len(q.consumers) == 0
+}
 
-	return nil
+// Persist flushes the queue log to disk.
+// Every change is already appended to the log when it happens.
+func (q *queue) Persist() error {
+	return q.log.Sync()
 }
 
+// TotalMesssages returns how many messages are ready or in flight.
 func (q *queue) TotalMesssages() int {
-	return len(q.messagesOrder)
+	return len(q.storage) - len(q.scheduled)
+}
+
+// TotalScheduled returns how many messages wait for their delivery time.
+func (q *queue) TotalScheduled() int {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return len(q.scheduled)
 }
 
 func (q *queue) GetQMessage() (*QMessage, error) {
 	q.m.Lock()
 	defer q.m.Unlock()
-	for _, msgId := range q.messagesOrder {
-		if msg, ok := q.storage[msgId]; ok {
-			if msg.Status == STATUS_MESSAGE_READY {
-				//msg.Status = STATUS_MESSAGE_UNACK
-				q.storage[msgId] = msg
-				q.Persist()
-				return msg, nil
-			}
-		}
+	return q.nextReady()
+}
+
+// nextReady returns the oldest READY message of the highest priority, q.m must be held.
+func (q *queue) nextReady() (*QMessage, error) {
+	next := q.index.peekReady()
+	if next == nil {
+		return &QMessage{}, errors.New("no new QMessages")
 	}
+	return next, nil
+}
 
-	return &QMessage{}, errors.New("no new QMessages")
+func newQueue(name string, opts *QueueOptions) (*queue, error) {
+	return openQueue(name, filepath.Join(config.Get().DataDir, name), opts)
 }
 
-func newQueue(name string) *queue {
+// openQueue creates the queue name persisted in dir, replaying what is already there.
+// When opts is nil the options stored in dir are used.
+func openQueue(name string, dir string, opts *QueueOptions) (*queue, error) {
 	nq := make(map[string]*QMessage)
 	q := queue{
-		name:          name,
-		consumers:     []*consumer{},
-		publishers:    list.New(),
-		messagesOrder: []string{},
-		storage:       nq,
+		name:       name,
+		consumers:  []*consumer{},
+		publishers: list.New(),
+		storage:    nq,
+		holders:    map[string]*consumer{},
+		pulled:     map[string]string{},
+		tm:         NewTM(),
+		wake:       make(chan struct{}, 1),
+		stop:       make(chan struct{}),
 	}
 
-	f, err := os.OpenFile(config.DATA_DIR+"/"+name+".mq", os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		f, err = os.Create(config.DATA_DIR + "/" + name + ".mq")
+	if opts == nil {
+		stored, err := loadQueueOptions(dir)
+		if err != nil {
+			return nil, err
+		}
+		opts = &stored
+	} else {
+		if err := opts.Validate(); err != nil {
+			return nil, err
+		}
+		if opts.DeadLetter == name {
+			return nil, errors.New("a queue can't be its own dead letter queue")
+		}
+		if !opts.Transient {
+			if err := saveQueueOptions(dir, *opts); err != nil {
+				return nil, err
+			}
+		}
+	}
+	q.options = *opts
+	q.index = newMessageIndex(opts.MaxPriority)
+
+	// a transient queue has no log, the log methods do nothing on nil
+	if !opts.Transient {
+		l, report, err := openSegmentLog(dir, config.Get().Storage.SegmentSize, opts.syncPolicy(), q.restore)
 		if err != nil {
-			log.Fatal(err)
+			return nil, err
 		}
+		q.finishRestore(&report)
+		q.log = l
+		q.recovery = report
+		q.workers.Add(1)
+		go func() {
+			defer q.workers.Done()
+			storage := config.Get().Storage
+			q.compactor(storage.CompactInterval, storage.CompactRatio)
+		}()
 	}
-	f.Close()
-	//q.ReadFile()
 
-	return &q
+	q.workers.Add(2)
+	go func() {
+		defer q.workers.Done()
+		q.sweeper(config.Get().SweepInterval)
+	}()
+	go func() {
+		defer q.workers.Done()
+		q.dispatcher()
+	}()
+
+	return &q, nil
 }
 
-func (q *queue) Publish(msg QMessage) error {
+// Close stops the queue background work and closes its log.
+func (q *queue) Close() error {
+	close(q.stop)
+	q.workers.Wait()
+	return q.log.Close()
+}
+
+// Peek returns copies of the first limit messages in distribution order,
+// followed by the scheduled ones when there is room left.
+func (q *queue) Peek(limit int) []QMessage {
 	q.m.Lock()
 	defer q.m.Unlock()
-	q.messagesOrder = append(q.messagesOrder, msg.Id)
-	msg.Status = STATUS_MESSAGE_READY
-	q.storage[msg.Id] = &msg
-	q.Persist()
-	return nil
+	msgs := []QMessage{}
+	q.index.eachReady(func(msg *QMessage) bool {
+		if len(msgs) >= limit {
+			return false
+		}
+		msgs = append(msgs, *msg)
+		return true
+	})
+	for _, msg := range q.scheduled {
+		if len(msgs) >= limit {
+			break
+		}
+		msgs = append(msgs, *msg)
+	}
+	return msgs
 }
 
-func stringInSlice(a string, list []string) bool {
-	for _, b := range list {
-		if b == a {
-			return true
+// Purge drops the ready messages, those held by consumers and the scheduled ones stay.
+// Returns how many messages were dropped.
+func (q *queue) Purge() (int, error) {
+	q.m.Lock()
+	ready := make([]*QMessage, 0, q.index.ready)
+	q.index.eachReady(func(msg *QMessage) bool {
+		ready = append(ready, msg)
+		return true
+	})
+	var last commit
+	for i, msg := range ready {
+		c, err := q.remove(msg, STATUS_MESSAGE_PURGED)
+		if err != nil {
+			q.m.Unlock()
+			return i, err
 		}
+		last = c
+	}
+	q.m.Unlock()
+	if len(ready) > 0 {
+		log.Println("[MQ] queue", q.name, "purged", len(ready), "messages")
+	}
+	return len(ready), last.Wait()
+}
+
+// destroy closes the queue and removes its files, the queue must not be
+// reachable from the queues control anymore.
+func (q *queue) destroy() error {
+	if err := q.Close(); err != nil {
+		return err
+	}
+	if q.log == nil {
+		return nil
+	}
+	return os.RemoveAll(q.log.dir)
+}
+
+// Publish adds msg to the queue, returns once it's stored
+// as required by the queue durability.
+func (q *queue) Publish(msg QMessage) error {
+	c, deadLetters, err := q.publish(msg)
+	q.sendDeadLetters(deadLetters)
+	if err != nil {
+		return err
 	}
-	return false
+	return c.Wait()
 }
 
-func (q *queue) Ack(QMessageId string) error {
+// publish stores msg, returns the dead letters of the messages dropped to make room.
+func (q *queue) publish(msg QMessage) (commit, []deadLetter, error) {
 	q.m.Lock()
 	defer q.m.Unlock()
+	return q.store(msg)
+}
+
+// store is publish with q.m held.
+func (q *queue) store(msg QMessage) (commit, []deadLetter, error) {
+	if _, ok := q.storage[msg.Id]; ok {
+		return nil, nil, ErrDuplicateId
+	}
+	if err := msg.CheckHeaders(); err != nil {
+		return nil, nil, err
+	}
+	deadLetters, err := q.makeRoom(int64(len(msg.Data)))
+	if err != nil {
+		return nil, deadLetters, err
+	}
+	q.prepare(&msg)
+	c, err := q.log.Publish(&msg)
+	if err != nil {
+		return nil, deadLetters, err
+	}
+	q.insert(&msg)
+	return c, deadLetters, nil
+}
+
+// prepare sets the status, priority and expiration msg gets in the queue.
+func (q *queue) prepare(msg *QMessage) {
+	msg.Status = STATUS_MESSAGE_READY
+	if msg.Header.DeliverAt > time.Now().UnixNano() {
+		msg.Status = STATUS_MESSAGE_SCHEDULED
+	}
+	if msg.Header.Priority < 0 {
+		msg.Header.Priority = 0
+	} else if msg.Header.Priority > q.options.MaxPriority {
+		msg.Header.Priority = q.options.MaxPriority
+	}
+	if msg.Header.Expiration == 0 && q.options.TTL > 0 {
+		msg.SetTTL(time.Duration(q.options.TTL) * time.Millisecond)
+	}
+}
+
+// insert adds the prepared msg to the queue in memory, q.m must be held.
+func (q *queue) insert(msg *QMessage) {
+	q.storage[msg.Id] = msg
+	q.bytes += int64(len(msg.Data))
+	q.expireAt(msg)
+	if msg.Status == STATUS_MESSAGE_SCHEDULED {
+		q.schedule(msg)
+	} else {
+		q.index.pushReady(msg)
+	}
+	q.notify()
+}
+
+// Ack removes an acknowledged message. sid is the session which acks it, refused
+// unless the message was distributed to it, empty when it's not a consumer ack.
+func (q *queue) Ack(sid string, QMessageId string) error {
+	q.m.Lock()
+	c, err := q.ack(sid, QMessageId)
+	q.m.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// ack is Ack without the wait for the disk, q.m must be held.
+func (q *queue) ack(sid string, QMessageId string) (commit, error) {
 	log.Println("[MQ] ACKING", QMessageId)
+	if err := q.step(sid, QMessageId, TX_ACK, TX_ACK_SENT); err != nil {
+		return nil, err
+	}
 	if msg, ok := q.storage[QMessageId]; ok {
-		msg.Status = STATUS_MESSAGE_ACK
-		delete(q.storage, QMessageId) // = msg
-		q.messagesOrder = utils.RemoveStringFromSlice(q.messagesOrder, QMessageId)
-		log.Println("[MQ] QMessage acknowledged")
-	} else {
-		log.Println("[MQ] QMessage not found", QMessageId)
-		if stringInSlice(QMessageId, q.messagesOrder) {
-			log.Println("[MQ] Interesting fact!")
+		c, err := q.remove(msg, STATUS_MESSAGE_ACK)
+		if err != nil {
+			return nil, err
 		}
-		return errors.New("QMessage not found")
+		log.Println("[MQ] QMessage acknowledged")
+		return c, nil
 	}
-	q.Persist()
-	return nil
+	log.Println("[MQ] QMessage not found", QMessageId)
+	return nil, ErrNoMessage
 }
 
-func (q *queue) UnAck(QMessageId string) error {
+// UnAck tells the consumer sid works on the message, which is held
+// without ack deadline until its transaction times out.
+func (q *queue) UnAck(sid string, QMessageId string) error {
 	q.m.Lock()
-	defer q.m.Unlock()
+	c, err := q.unAck(sid, QMessageId)
+	q.m.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.Wait()
+}
+
+// unAck is UnAck without the wait for the disk, q.m must be held.
+func (q *queue) unAck(sid string, QMessageId string) (commit, error) {
 	log.Println("[MQ] UNACKING", QMessageId)
+	if err := q.step(sid, QMessageId, TX_NACK, TX_NACK_SENT); err != nil {
+		return nil, err
+	}
 	if msg, ok := q.storage[QMessageId]; ok {
 		msg.Status = STATUS_MESSAGE_UNACK
-		q.storage[QMessageId] = msg
-		log.Println("[MQ] QMessage working")
-	} else {
-		log.Println("[MQ] QMessage not found", QMessageId)
-		if stringInSlice(QMessageId, q.messagesOrder) {
-			log.Println("[MQ] Interesting fact!")
+		c, err := q.log.SetStatus(msg)
+		if err != nil {
+			return nil, err
 		}
-		return errors.New("QMessage not found")
+		// held by the consumer until it acks, without ack deadline
+		q.index.remove(QMessageId)
+		log.Println("[MQ] QMessage working")
+		return c, nil
 	}
-	q.Persist()
-	return nil
+	log.Println("[MQ] QMessage not found", QMessageId)
+	return nil, ErrNoMessage
 }
 
-func (q *queue) Reject(QMessageId string) error {
+// Reject gives a message back, when requeue is false it's dead-lettered.
+// sid is checked like for Ack.
+func (q *queue) Reject(sid string, QMessageId string, requeue bool) error {
 	q.m.Lock()
-	defer q.m.Unlock()
+	c, dl, err := q.reject(sid, QMessageId, requeue)
+	q.m.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := c.Wait(); err != nil {
+		return err
+	}
+	if dl != nil {
+		q.sendDeadLetters([]deadLetter{*dl})
+	}
+	return nil
+}
+
+// reject is Reject without the wait for the disk and the dead letter, q.m must be held.
+func (q *queue) reject(sid string, QMessageId string, requeue bool) (commit, *deadLetter, error) {
 	log.Println("[MQ] REJECTING", QMessageId)
+	if err := q.step(sid, QMessageId, TX_REJECT, TX_REJECT_SENT); err != nil {
+		return nil, nil, err
+	}
 	if msg, ok := q.storage[QMessageId]; ok {
-		msg.Status = STATUS_MESSAGE_REJECTED
-		q.storage[QMessageId] = msg
-		q.messagesOrder = utils.RemoveStringFromSlice(q.messagesOrder, QMessageId)
+		if requeue {
+			msg.Status = STATUS_MESSAGE_READY
+			c, err := q.log.SetStatus(msg)
+			if err != nil {
+				return nil, nil, err
+			}
+			q.release(QMessageId)
+			q.index.requeue(msg)
+			q.notify()
+			log.Println("[MQ] QMessage requeued")
+			return c, nil, nil
+		}
+		dl, c := q.retire(msg, DEATH_REASON_REJECTED)
 		log.Println("[MQ] QMessage rejected")
-	} else {
-		log.Println("[MQ] QMessage not found", QMessageId)
-		if stringInSlice(QMessageId, q.messagesOrder) {
-			log.Println("[MQ] Interesting fact!")
+		return c, dl, nil
+	}
+	log.Println("[MQ] QMessage not found", QMessageId)
+	return nil, nil, ErrNoMessage
+}
+
+// step moves the transaction of message id with the tcp messages of session sid.
+// A message which is not in the queue is not found, unless its transaction just
+// completed. q.m must be held.
+func (q *queue) step(sid string, id string, tcpMsgIds ...int) error {
+	err := q.tm.Update(id, sid, tcpMsgIds...)
+	if errors.Is(err, ErrTxNotInFlight) {
+		if _, ok := q.storage[id]; !ok {
+			return ErrNoMessage
 		}
 	}
-	q.Persist()
-	return nil
+	if err != nil {
+		log.Println("[MQ] queue", q.name, "refused", tcpMsgIds[0], "of", sid+":", err)
+	}
+	return err
+}
+
+// Received records that consumer sid got message id.
+func (q *queue) Received(sid string, id string) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.step(sid, id, TX_RECEIVED)
+}
+
+// remove ends msg with a terminal status, q.m must be held.
+func (q *queue) remove(msg *QMessage, status int) (commit, error) {
+	msg.Status = status
+	c, err := q.log.SetStatus(msg)
+	if err != nil {
+		return nil, err
+	}
+	delete(q.storage, msg.Id)
+	q.bytes -= int64(len(msg.Data))
+	q.index.remove(msg.Id)
+	q.release(msg.Id)
+	return c, nil
 }
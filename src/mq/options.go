@@ -0,0 +1,199 @@
+package mq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"tomqserver/config"
+)
+
+const (
+	// fsync after every write
+	DURABILITY_ALWAYS = "always"
+	// group commit every SyncInterval or SyncBatch records, callers are released after the fsync
+	DURABILITY_BATCH = "batch"
+	// leave the flushing to the OS
+	DURABILITY_NONE = "none"
+
+	queueOptionsFile = "queue.json"
+
+	// MAX_PRIORITY bounds the priority levels of a queue
+	MAX_PRIORITY = 255
+)
+
+// QueueOptions are the settings of a queue, stored next to its log.
+type QueueOptions struct {
+	Durability   string `json:"durability"`
+	SyncInterval int64  `json:"sync_interval_ms"`
+	SyncBatch    int    `json:"sync_batch"`
+	// messages delivered MaxDeliveries times, or rejected without requeue,
+	// go to the DeadLetter queue, or are dropped when it's empty. 0 means no limit.
+	DeadLetter    string `json:"dead_letter,omitempty"`
+	MaxDeliveries int    `json:"max_deliveries,omitempty"`
+	// messages published without their own TTL expire TTL milliseconds after,
+	// they go to the DeadLetter queue only with DeadLetterExpired. 0 means no TTL.
+	TTL               int64 `json:"ttl_ms,omitempty"`
+	DeadLetterExpired bool  `json:"dead_letter_expired,omitempty"`
+	// messages get a priority from 0 to MaxPriority, higher ones are distributed first.
+	// 0 means a plain FIFO queue.
+	MaxPriority int `json:"max_priority,omitempty"`
+	// bounds of the stored messages, 0 means none, see limits.go.
+	// Overflow is one of OVERFLOW_*, drop-head by default.
+	MaxLength int    `json:"max_length,omitempty"`
+	MaxBytes  int64  `json:"max_bytes,omitempty"`
+	Overflow  string `json:"overflow,omitempty"`
+	// a transient queue lives in memory only, it's gone after a restart
+	Transient bool `json:"transient,omitempty"`
+	// the queue is deleted when its last consumer leaves
+	AutoDelete bool `json:"auto_delete,omitempty"`
+	// only the declaring session can consume, the queue is deleted when it closes.
+	// Exclusive queues are transient.
+	Exclusive bool `json:"exclusive,omitempty"`
+}
+
+// DefaultQueueOptions returns the options used by queues created implicitly.
+func DefaultQueueOptions() QueueOptions {
+	storage := config.Get().Storage
+	return QueueOptions{
+		Durability:   storage.Durability,
+		SyncInterval: storage.SyncInterval.Milliseconds(),
+		SyncBatch:    storage.SyncBatch,
+	}
+}
+
+// Validate checks the options, zero values are replaced by the defaults.
+func (o *QueueOptions) Validate() error {
+	defaults := DefaultQueueOptions()
+	if o.Durability == "" {
+		o.Durability = defaults.Durability
+	}
+	if o.SyncInterval == 0 {
+		o.SyncInterval = defaults.SyncInterval
+	}
+	if o.SyncBatch == 0 {
+		o.SyncBatch = defaults.SyncBatch
+	}
+	switch o.Durability {
+	case DURABILITY_ALWAYS, DURABILITY_BATCH, DURABILITY_NONE:
+	default:
+		return errors.New("unknown durability " + o.Durability)
+	}
+	if o.SyncInterval < 0 || o.SyncBatch < 0 {
+		return errors.New("sync interval and batch must be positive")
+	}
+	if o.MaxDeliveries < 0 {
+		return errors.New("max deliveries can't be negative")
+	}
+	if o.TTL < 0 {
+		return errors.New("ttl can't be negative")
+	}
+	if o.MaxPriority < 0 || o.MaxPriority > MAX_PRIORITY {
+		return fmt.Errorf("max priority must be between 0 and %d", MAX_PRIORITY)
+	}
+	if o.MaxLength < 0 || o.MaxBytes < 0 {
+		return errors.New("max length and max bytes can't be negative")
+	}
+	if o.Exclusive {
+		o.Transient = true
+	}
+	switch o.Overflow {
+	case "":
+		o.Overflow = OVERFLOW_DROP_HEAD
+	case OVERFLOW_DROP_HEAD, OVERFLOW_DEAD_LETTER, OVERFLOW_REJECT_PUBLISH:
+	default:
+		return errors.New("unknown overflow " + o.Overflow)
+	}
+	o.DeadLetter = strings.ToUpper(strings.TrimSpace(o.DeadLetter))
+	return nil
+}
+
+// ParseQueueArgs reads the key=value arguments of a queue declaration over the defaults.
+func ParseQueueArgs(args []string) (QueueOptions, error) {
+	o := DefaultQueueOptions()
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 {
+			return o, fmt.Errorf("bad argument %q", arg)
+		}
+		key, value := kv[0], kv[1]
+		var err error
+		switch key {
+		case "durable":
+			var durable bool
+			durable, err = strconv.ParseBool(value)
+			o.Transient = !durable
+		case "auto-delete":
+			o.AutoDelete, err = strconv.ParseBool(value)
+		case "exclusive":
+			o.Exclusive, err = strconv.ParseBool(value)
+		case "durability":
+			o.Durability = value
+		case "ttl":
+			o.TTL, err = strconv.ParseInt(value, 10, 64)
+		case "max-length":
+			o.MaxLength, err = strconv.Atoi(value)
+		case "max-bytes":
+			o.MaxBytes, err = strconv.ParseInt(value, 10, 64)
+		case "overflow":
+			o.Overflow = value
+		case "dead-letter":
+			o.DeadLetter = value
+		case "dead-letter-expired":
+			o.DeadLetterExpired, err = strconv.ParseBool(value)
+		case "max-deliveries":
+			o.MaxDeliveries, err = strconv.Atoi(value)
+		case "max-priority":
+			o.MaxPriority, err = strconv.Atoi(value)
+		default:
+			return o, fmt.Errorf("unknown argument %q", key)
+		}
+		if err != nil {
+			return o, fmt.Errorf("bad %s %q", key, value)
+		}
+	}
+	return o, o.Validate()
+}
+
+func (o QueueOptions) syncPolicy() syncPolicy {
+	return syncPolicy{
+		mode:     o.Durability,
+		interval: time.Duration(o.SyncInterval) * time.Millisecond,
+		batch:    o.SyncBatch,
+	}
+}
+
+// loadQueueOptions reads the options stored in dir, a queue without options gets the defaults.
+func loadQueueOptions(dir string) (QueueOptions, error) {
+	o := QueueOptions{}
+	data, err := os.ReadFile(filepath.Join(dir, queueOptionsFile))
+	if err != nil && !os.IsNotExist(err) {
+		return o, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &o); err != nil {
+			return o, err
+		}
+	}
+	return o, o.Validate()
+}
+
+// saveQueueOptions replaces the options stored in dir.
+func saveQueueOptions(dir string, o QueueOptions) error {
+	data, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, queueOptionsFile+".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, queueOptionsFile))
+}
@@ -0,0 +1,54 @@
+package mq
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue_PriorityOrder(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openQueue("TEST", dir, &QueueOptions{MaxPriority: 9})
+	assert.NoError(t, err)
+
+	ids := map[string]string{}
+	for _, p := range []struct {
+		name     string
+		priority int
+	}{{"low1", 0}, {"high1", 5}, {"low2", 0}, {"urgent", 42}, {"high2", 5}} {
+		msg := NewMessage("TEST", []byte(p.name))
+		msg.Header.Priority = p.priority
+		assert.NoError(t, q.Publish(msg))
+		ids[msg.Id] = p.name
+	}
+	assert.NoError(t, q.Close())
+
+	q2, err := openQueue("TEST", dir, nil)
+	assert.NoError(t, err)
+	defer q2.Close() // nolint
+	order := []string{}
+	for {
+		msg, err := q2.GetQMessage()
+		if err != nil {
+			break
+		}
+		order = append(order, ids[msg.Id])
+		assert.NoError(t, q2.Ack("", msg.Id))
+	}
+	assert.Equal(t, []string{"urgent", "high1", "high2", "low1", "low2"}, order)
+}
+
+func TestQueue_PriorityIgnoredWithoutLevels(t *testing.T) {
+	q, err := openQueue("TEST", t.TempDir(), nil)
+	assert.NoError(t, err)
+	defer q.Close() // nolint
+	first := NewMessage("TEST", []byte("first"))
+	second := NewMessage("TEST", []byte("second"))
+	second.Header.Priority = 3
+	assert.NoError(t, q.Publish(first))
+	assert.NoError(t, q.Publish(second))
+	assert.Equal(t, 0, q.storage[second.Id].Header.Priority)
+	msg, err := q.GetQMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, first.Id, msg.Id)
+}
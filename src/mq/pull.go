@@ -0,0 +1,106 @@
+package mq
+
+import (
+	"fmt"
+	"time"
+)
+
+/*
+Besides the registered consumers, any session can pull messages from a queue.
+A pull takes up to a batch of ready messages right away, or waits for the first
+one to come, and the pulled messages are in flight like distributed ones: they
+come back to the queue when their ack expires or the session closes.
+The registered consumers are served first, a waiting pull gets what they left.
+*/
+
+const (
+	// MAX_PULL_BATCH bounds the messages taken by a pull.
+	MAX_PULL_BATCH = 1000
+	// MAX_PULL_WAIT bounds how long a pull waits for a message.
+	MAX_PULL_WAIT = time.Minute
+)
+
+// Pull hands up to limit ready messages to session sid, waiting up to wait for one
+// when there's none. Returns no messages when the wait ends empty.
+func (q *queue) Pull(sid string, limit int, wait time.Duration) ([]QMessage, error) {
+	if limit < 1 || limit > MAX_PULL_BATCH {
+		return nil, fmt.Errorf("batch size must be between 1 and %d", MAX_PULL_BATCH)
+	}
+	if wait < 0 || wait > MAX_PULL_WAIT {
+		return nil, fmt.Errorf("wait must be between 0 and %s", MAX_PULL_WAIT)
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		msgs, ready, deadLetters, err := q.pull(sid, limit, time.Now())
+		q.sendDeadLetters(deadLetters)
+		if err != nil || len(msgs) > 0 {
+			return msgs, err
+		}
+		left := time.Until(deadline)
+		if left <= 0 {
+			return msgs, nil
+		}
+		timer := time.NewTimer(left)
+		select {
+		case <-ready:
+		case <-timer.C:
+		case <-q.stop:
+			stopTimer(timer)
+			return nil, ErrNoQueue
+		}
+		stopTimer(timer)
+	}
+}
+
+// pull takes up to limit ready messages for session sid. When there's none it returns
+// a channel closed once messages are ready again.
+func (q *queue) pull(sid string, limit int, now time.Time) ([]QMessage, <-chan struct{}, []deadLetter, error) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	if q.owner != "" && q.owner != sid {
+		return nil, nil, nil, ErrExclusive
+	}
+	msgs := []QMessage{}
+	deadLetters := []deadLetter{}
+	for len(msgs) < limit {
+		msg, err := q.nextDeliverable(now, &deadLetters)
+		if err != nil {
+			break
+		}
+		q.handOut(msg, sid)
+		q.pulled[msg.Id] = sid
+		msgs = append(msgs, *msg)
+	}
+	if len(msgs) > 0 {
+		// the dispatcher timer follows the new ack deadline
+		q.notify()
+		return msgs, nil, deadLetters, nil
+	}
+	if q.pullers == nil {
+		q.pullers = make(chan struct{})
+	}
+	return msgs, q.pullers, deadLetters, nil
+}
+
+// wakePullers lets the waiting pulls retry when messages are ready, q.m must be held.
+func (q *queue) wakePullers() {
+	if q.pullers != nil && q.index.peekReady() != nil {
+		close(q.pullers)
+		q.pullers = nil
+	}
+}
+
+// pulledBy forgets the messages pulled by session sid and returns them, q.m must be held.
+func (q *queue) pulledBy(sid string) []*QMessage {
+	held := []*QMessage{}
+	for id, holder := range q.pulled {
+		if holder != sid {
+			continue
+		}
+		delete(q.pulled, id)
+		if msg, ok := q.storage[id]; ok {
+			held = append(held, msg)
+		}
+	}
+	return held
+}
@@ -0,0 +1,93 @@
+package mq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue_Pull(t *testing.T) {
+	q, err := openQueue("TEST", t.TempDir(), nil)
+	assert.NoError(t, err)
+	defer q.Close() // nolint
+	sent := publishAll(t, q, 3)
+
+	msgs, err := q.Pull("1", 2, 0)
+	assert.NoError(t, err)
+	if assert.Len(t, msgs, 2) {
+		assert.Equal(t, sent[0].Id, msgs[0].Id)
+		assert.Equal(t, sent[1].Id, msgs[1].Id)
+		assert.Equal(t, 1, msgs[0].DeliveryCount)
+	}
+	assert.Equal(t, []string{sent[2].Id}, readyIds(q))
+
+	// in flight like a distributed message
+	assert.NoError(t, q.Ack("1", msgs[0].Id))
+	assert.NotContains(t, q.pulled, msgs[0].Id)
+
+	// the session leaves, what it didn't ack comes back first
+	q.UnregisterConsumer("1")
+	assert.Equal(t, []string{sent[1].Id, sent[2].Id}, readyIds(q))
+
+	msgs, err = q.Pull("2", MAX_PULL_BATCH, 0)
+	assert.NoError(t, err)
+	assert.Len(t, msgs, 2)
+	msgs, err = q.Pull("2", 1, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+
+	_, err = q.Pull("2", 0, 0)
+	assert.Error(t, err)
+	_, err = q.Pull("2", 1, MAX_PULL_WAIT+time.Second)
+	assert.Error(t, err)
+}
+
+func TestQueue_PullWaits(t *testing.T) {
+	q, err := openQueue("TEST", t.TempDir(), nil)
+	assert.NoError(t, err)
+	defer q.Close() // nolint
+
+	start := time.Now()
+	msgs, err := q.Pull("1", 1, 50*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Empty(t, msgs)
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+
+	msg := NewMessage("TEST", []byte("late"))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		q.Publish(msg) // nolint
+	}()
+	msgs, err = q.Pull("1", 10, 2*time.Second)
+	assert.NoError(t, err)
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, msg.Id, msgs[0].Id)
+	}
+}
+
+func TestQueue_PullAfterConsumers(t *testing.T) {
+	q, err := openQueue("TEST", t.TempDir(), nil)
+	assert.NoError(t, err)
+	defer q.Close() // nolint
+	ch := deliveries(q)
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 1})))
+
+	pulled := make(chan []QMessage)
+	go func() {
+		msgs, _ := q.Pull("2", 1, 2*time.Second)
+		pulled <- msgs
+	}()
+	assert.Eventually(t, func() bool {
+		q.m.Lock()
+		defer q.m.Unlock()
+		return q.pullers != nil
+	}, time.Second, time.Millisecond)
+	sent := publishAll(t, q, 2)
+
+	assert.Equal(t, sent[0].Id, receive(t, ch).Id)
+	msgs := <-pulled
+	if assert.Len(t, msgs, 1) {
+		assert.Equal(t, sent[1].Id, msgs[0].Id)
+	}
+}
@@ -2,35 +2,134 @@ package mq
 
 import (
 	"errors"
+	"log"
 	"strings"
 	"sync"
+	"tomqserver/config"
 	"tomqserver/src/server"
 )
 
 type queuesControl struct {
 	queues    map[string]*queue
+	exchanges map[string]*exchange
 	m         sync.Mutex
 	tcpServer *server.Server
+	deliver   DeliveryHandler
+	cancel    CancelHandler
+	stages    map[string]*stage // open transactions by session id
+	txm       sync.Mutex
 }
 
 type QueuesControl interface {
 	NewQueue(queueName string) error
-	Delete(queueName string) error
+	NewQueueWithOptions(queueName string, opts QueueOptions) error
+	Delete(queueName string, ifEmpty bool, ifUnused bool) error
+	Purge(queueName string) (int, error)
 	GetOrCreate(queueName string) (*queue, error)
 	GetQueue(queueName string) (*queue, error)
 	List() []string
 	UnregisterConsumer(sid string)
 	ServerInfo() webInfo
 	SetServerInstance(s *server.Server)
+	SetDeliveryHandler(h DeliveryHandler)
+	SetCancelHandler(h CancelHandler)
+	Declare(queueName string, opts QueueOptions, sid string) error
+	DeclareExchange(name string, kind string) error
+	DeleteExchange(name string) error
+	Bind(exchangeName string, queueName string, key string, args map[string]string) error
+	Unbind(exchangeName string, queueName string, key string, args map[string]string) error
+	PublishTo(exchangeName string, routingKey string, msg QMessage) (int, error)
+	PublishBatch(msgs []QMessage, durable bool) []error
+	PublishToConfirm(exchangeName string, routingKey string, msg QMessage, confirm ConfirmHandler)
+	Begin(sid string) error
+	InTx(sid string) bool
+	StagePublish(sid string, msg QMessage) error
+	StagePublishTo(sid string, exchangeName string, routingKey string, msg QMessage) (int, error)
+	StageAck(sid string, queueName string, id string) error
+	Commit(sid string) error
+	Rollback(sid string) error
 }
 
+// ErrExclusive is returned to the sessions using an exclusive queue they didn't declare.
+var ErrExclusive = errors.New("queue is exclusive to another session")
+
+var (
+	// ErrNoQueue is returned for a queue which doesn't exist.
+	ErrNoQueue = errors.New("queue doesn't exists")
+	// ErrQueueNotEmpty refuses to delete a queue holding messages.
+	ErrQueueNotEmpty = errors.New("queue is not empty")
+	// ErrQueueInUse refuses to delete a queue with consumers.
+	ErrQueueInUse = errors.New("queue has consumers")
+	// ErrQueueOptions refuses to declare an existing queue with other options.
+	ErrQueueOptions = errors.New("queue exists with different options")
+	// ErrNoMessage is returned for a message which is not in the queue.
+	ErrNoMessage = errors.New("QMessage not found")
+	// ErrNoConsumer is returned for a session which is not a consumer of the queue.
+	ErrNoConsumer = errors.New("consumer not registered")
+)
+
 func (qc *queuesControl) SetServerInstance(s *server.Server) {
 	qc.tcpServer = s
 }
-func (qc *queuesControl) UnregisterConsumer(sid string) {
 
+// SetDeliveryHandler sets how every queue, current and future, sends messages to its consumers.
+func (qc *queuesControl) SetDeliveryHandler(h DeliveryHandler) {
+	qc.m.Lock()
+	defer qc.m.Unlock()
+	qc.deliver = h
 	for _, q := range qc.queues {
+		q.setDeliveryHandler(h)
+	}
+}
+
+// SetCancelHandler sets how consumers are told their queue was deleted.
+func (qc *queuesControl) SetCancelHandler(h CancelHandler) {
+	qc.m.Lock()
+	defer qc.m.Unlock()
+	qc.cancel = h
+}
+
+// add registers a new queue, qc.m must be held.
+func (qc *queuesControl) add(q *queue) {
+	if qc.deliver != nil {
+		q.setDeliveryHandler(qc.deliver)
+	}
+	q.setDeadLetterRoute(qc.routeDeadLetter)
+	qc.queues[q.name] = q
+}
+
+// routeDeadLetter publishes a dead letter to its queue, created when missing.
+func (qc *queuesControl) routeDeadLetter(queueName string, msg QMessage) error {
+	q, err := qc.GetOrCreate(queueName)
+	if err != nil {
+		return err
+	}
+	return q.Publish(msg)
+}
+
+// UnregisterConsumer removes session sid from every queue, deleting the
+// exclusive queues it declared and the auto-delete queues it was the last consumer of.
+// Its open transaction is rolled back.
+func (qc *queuesControl) UnregisterConsumer(sid string) {
+	qc.takeStage(sid)
+	qc.m.Lock()
+	unused := []*queue{}
+	for name, q := range qc.queues {
 		q.UnregisterConsumer(sid)
+		if q.unused(sid) {
+			delete(qc.queues, name)
+			qc.unbindQueue(name)
+			unused = append(unused, q)
+		}
+	}
+	qc.m.Unlock()
+	// the workers of a queue may route dead letters, they're stopped without qc.m
+	for _, q := range unused {
+		if err := q.destroy(); err != nil {
+			log.Println("[MQ] queue", q.name, "delete failed:", err)
+			continue
+		}
+		log.Println("[MQ] queue", q.name, "deleted, not used anymore")
 	}
 }
 
@@ -53,9 +152,11 @@ func (qc *queuesControl) GetQueue(queueName string) (*queue, error) {
 		return q, nil
 	}
 
-	return nil, errors.New("queue doesn't exists")
+	return nil, ErrNoQueue
 }
 
+// GetOrCreate returns queue queueName, creating it with the default options
+// unless the server forbids implicit creation.
 func (qc *queuesControl) GetOrCreate(queueName string) (*queue, error) {
 	qc.m.Lock()
 	defer qc.m.Unlock()
@@ -63,37 +164,136 @@ func (qc *queuesControl) GetOrCreate(queueName string) (*queue, error) {
 	if q, ok := qc.queues[queueName]; ok {
 		return q, nil
 	}
-	qc.queues[queueName] = newQueue(queueName)
-	q := qc.queues[queueName]
+	if !config.Get().ImplicitQueues {
+		return nil, ErrNoQueue
+	}
+	q, err := newQueue(queueName, nil)
+	if err != nil {
+		return nil, err
+	}
+	qc.add(q)
 	return q, nil
 }
 
 func InitQueuesControl() *queuesControl {
 	q := &queuesControl{
-		queues: map[string]*queue{},
-		m:      sync.Mutex{},
+		queues:    map[string]*queue{},
+		exchanges: map[string]*exchange{},
+		m:         sync.Mutex{},
+		stages:    map[string]*stage{},
+	}
+	q.recover(config.Get().DataDir)
+	q.recoverTransactions(config.Get().DataDir)
+	if err := q.loadTopology(config.Get().DataDir); err != nil {
+		log.Println("[MQ] exchanges recovery failed:", err)
 	}
 	return q
 }
 
 func (qc *queuesControl) NewQueue(queueName string) error {
+	return qc.NewQueueWithOptions(queueName, DefaultQueueOptions())
+}
+
+// NewQueueWithOptions creates a queue with its own settings,
+// which are stored with the queue and restored at startup.
+func (qc *queuesControl) NewQueueWithOptions(queueName string, opts QueueOptions) error {
 	qc.m.Lock()
 	defer qc.m.Unlock()
 	queueName = strings.ToUpper(queueName)
 	if _, ok := qc.queues[queueName]; ok {
 		return errors.New("Queue already exists")
 	}
-	qc.queues[queueName] = newQueue(queueName)
+	q, err := newQueue(queueName, &opts)
+	if err != nil {
+		return err
+	}
+	qc.add(q)
 	return nil
 }
 
-func (qc *queuesControl) Delete(queueName string) error {
+// Declare creates queue queueName with opts, or checks that the existing one has
+// the same options. An exclusive queue belongs to session sid.
+func (qc *queuesControl) Declare(queueName string, opts QueueOptions, sid string) error {
+	if err := opts.Validate(); err != nil {
+		return err
+	}
 	qc.m.Lock()
 	defer qc.m.Unlock()
 	queueName = strings.ToUpper(queueName)
-	if _, ok := qc.queues[queueName]; ok {
-		return errors.New("Queue already exists")
+	if q, ok := qc.queues[queueName]; ok {
+		q.m.Lock()
+		defer q.m.Unlock()
+		if q.owner != "" && q.owner != sid {
+			return ErrExclusive
+		}
+		if q.options != opts {
+			return ErrQueueOptions
+		}
+		return nil
 	}
-	qc.queues[queueName] = newQueue(queueName)
+	q, err := newQueue(queueName, &opts)
+	if err != nil {
+		return err
+	}
+	if opts.Exclusive {
+		q.owner = sid
+	}
+	qc.add(q)
 	return nil
 }
+
+// Delete removes queue queueName with its messages and files, its consumers are told.
+// With ifEmpty a queue holding messages is kept, with ifUnused a queue with consumers is kept.
+func (qc *queuesControl) Delete(queueName string, ifEmpty bool, ifUnused bool) error {
+	qc.m.Lock()
+	queueName = strings.ToUpper(queueName)
+	q, ok := qc.queues[queueName]
+	if !ok {
+		qc.m.Unlock()
+		return ErrNoQueue
+	}
+	q.m.Lock()
+	if ifEmpty && len(q.storage) > 0 {
+		q.m.Unlock()
+		qc.m.Unlock()
+		return ErrQueueNotEmpty
+	}
+	if ifUnused && len(q.consumers) > 0 {
+		q.m.Unlock()
+		qc.m.Unlock()
+		return ErrQueueInUse
+	}
+	consumers := q.consumers
+	q.consumers = []*consumer{}
+	for _, c := range consumers {
+		c.status = CONSUMER_STATUS_CLOSED
+	}
+	q.m.Unlock()
+	delete(qc.queues, queueName)
+	qc.unbindQueue(queueName)
+	cancel := qc.cancel
+	qc.m.Unlock()
+
+	if err := q.destroy(); err != nil {
+		return err
+	}
+	if err := removeLegacyFiles(config.Get().DataDir, queueName); err != nil {
+		return err
+	}
+	if cancel != nil {
+		for _, c := range consumers {
+			cancel(c.session, queueName)
+		}
+	}
+	log.Println("[MQ] queue", queueName, "deleted")
+	return nil
+}
+
+// Purge drops the ready messages of queue queueName, returns how many.
+func (qc *queuesControl) Purge(queueName string) (int, error) {
+	q, err := qc.GetQueue(queueName)
+	if err != nil {
+		return 0, err
+	}
+	return q.Purge()
+}
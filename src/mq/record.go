@@ -0,0 +1,375 @@
+package mq
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+/*
+Every record written to a segment starts with a 12 bytes header,
+integers are big endian:
+
+	[2]byte magic | [1]byte version | [1]byte kind | [4]byte body length | [4]byte crc32
+
+The checksum (IEEE) covers version, kind, body length and the body,
+so a torn write or a flipped bit is detected before the record is applied.
+
+publish body:
+
+	[2]byte id length | id
+	[8]byte timestamp
+	[1]byte status
+	[4]byte data length | data
+	[2]byte headers count | ([2]byte key length | key | [4]byte value length | value)...
+	attributes
+
+status body:
+
+	[2]byte id length | id
+	[8]byte home segment
+	[1]byte status
+	attributes
+
+attributes: ([1]byte tag | [4]byte length | value)... until the end of the body.
+Readers skip the tags they don't know, so optional fields can be added
+without a new record version.
+
+	1 delivery count  [4]byte
+	2 last consumer   session id
+	3 expiration      [8]byte unix nano
+	4 deliver at      [8]byte unix nano
+	5 priority        [1]byte
+	6 content type      publish records only
+	7 content encoding  publish records only
+	8 correlation id    publish records only
+	9 reply to          publish records only
+*/
+
+const (
+	recordMagic      uint16 = 0x744d // "tM"
+	recordVersion    byte   = 1
+	recordHeaderSize        = 12
+
+	recordPublish byte = 1
+	recordStatus  byte = 2
+
+	attrDeliveryCount byte = 1
+	attrLastConsumer  byte = 2
+	attrExpiration    byte = 3
+	attrDeliverAt     byte = 4
+	attrPriority      byte = 5
+	attrContentType   byte = 6
+	attrContentEnc    byte = 7
+	attrCorrelationId byte = 8
+	attrReplyTo       byte = 9
+)
+
+var errRecordTooShort = errors.New("record too short")
+
+// logRecord is one decoded entry of the log.
+type logRecord struct {
+	kind   byte
+	msg    QMessage // status records only carry id, status and attributes
+	id     string
+	home   uint64 // status records only
+	status int
+	attrs  map[byte][]byte
+}
+
+// recordWriter appends big endian fields to a record body.
+type recordWriter struct {
+	buf []byte
+}
+
+func (w *recordWriter) uint8(v byte) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *recordWriter) uint16(v uint16) {
+	w.buf = append(w.buf, 0, 0)
+	binary.BigEndian.PutUint16(w.buf[len(w.buf)-2:], v)
+}
+
+func (w *recordWriter) uint32(v uint32) {
+	w.buf = append(w.buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(w.buf[len(w.buf)-4:], v)
+}
+
+func (w *recordWriter) uint64(v uint64) {
+	w.buf = append(w.buf, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(w.buf[len(w.buf)-8:], v)
+}
+
+func (w *recordWriter) string16(s string) {
+	w.uint16(uint16(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *recordWriter) bytes32(b []byte) {
+	w.uint32(uint32(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *recordWriter) attribute(tag byte, value []byte) {
+	w.uint8(tag)
+	w.bytes32(value)
+}
+
+// recordReader reads the fields written by recordWriter.
+// The first short read is kept in err and every following read returns zero values.
+type recordReader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *recordReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || len(r.buf)-r.pos < n {
+		r.err = errRecordTooShort
+		return nil
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *recordReader) uint8() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *recordReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *recordReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *recordReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *recordReader) string16() string {
+	return string(r.next(int(r.uint16())))
+}
+
+func (r *recordReader) bytes32() []byte {
+	b := r.next(int(r.uint32()))
+	if b == nil {
+		return nil
+	}
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
+
+// attributes reads the tagged fields up to the end of the body.
+func (r *recordReader) attributes() map[byte][]byte {
+	var attrs map[byte][]byte
+	for r.err == nil && r.pos < len(r.buf) {
+		tag := r.uint8()
+		value := r.bytes32()
+		if r.err != nil {
+			break
+		}
+		if attrs == nil {
+			attrs = map[byte][]byte{}
+		}
+		attrs[tag] = value
+	}
+	return attrs
+}
+
+// encodeRecord prefixes body with the record header.
+func encodeRecord(kind byte, body []byte) []byte {
+	record := make([]byte, recordHeaderSize, recordHeaderSize+len(body))
+	binary.BigEndian.PutUint16(record[0:], recordMagic)
+	record[2] = recordVersion
+	record[3] = kind
+	binary.BigEndian.PutUint32(record[4:], uint32(len(body)))
+	record = append(record, body...)
+	binary.BigEndian.PutUint32(record[8:], recordChecksum(record[:recordHeaderSize], body))
+	return record
+}
+
+func recordChecksum(hdr []byte, body []byte) uint32 {
+	crc := crc32.ChecksumIEEE(hdr[2:8])
+	return crc32.Update(crc, crc32.IEEETable, body)
+}
+
+// parseRecordHeader validates magic and version, returns the kind and body length.
+func parseRecordHeader(hdr []byte) (byte, int64, error) {
+	if len(hdr) < recordHeaderSize {
+		return 0, 0, errRecordTooShort
+	}
+	if binary.BigEndian.Uint16(hdr) != recordMagic {
+		return 0, 0, errors.New("bad record magic")
+	}
+	if hdr[2] == 0 || hdr[2] > recordVersion {
+		return 0, 0, fmt.Errorf("unsupported record version %d", hdr[2])
+	}
+	return hdr[3], int64(binary.BigEndian.Uint32(hdr[4:])), nil
+}
+
+// verifyRecord checks the record checksum.
+func verifyRecord(hdr []byte, body []byte) error {
+	if binary.BigEndian.Uint32(hdr[8:]) != recordChecksum(hdr, body) {
+		return errors.New("checksum mismatch")
+	}
+	return nil
+}
+
+func encodePublishBody(msg *QMessage) []byte {
+	w := recordWriter{buf: make([]byte, 0, 64+len(msg.Id)+len(msg.Data))}
+	w.string16(msg.Id)
+	w.uint64(uint64(msg.Header.Timestamp))
+	w.uint8(byte(msg.Status))
+	w.bytes32(msg.Data)
+	w.uint16(uint16(len(msg.Header.Headers)))
+	for k, v := range msg.Header.Headers {
+		w.string16(k)
+		w.bytes32([]byte(v))
+	}
+	writeAttributes(&w, msg)
+	writeProperties(&w, msg)
+	return w.buf
+}
+
+func encodeStatusBody(msg *QMessage, home uint64) []byte {
+	w := recordWriter{buf: make([]byte, 0, 32+len(msg.Id))}
+	w.string16(msg.Id)
+	w.uint64(home)
+	w.uint8(byte(msg.Status))
+	writeAttributes(&w, msg)
+	return w.buf
+}
+
+// writeAttributes appends the optional fields of msg which are set.
+func writeAttributes(w *recordWriter, msg *QMessage) {
+	if msg.DeliveryCount > 0 {
+		v := make([]byte, 4)
+		binary.BigEndian.PutUint32(v, uint32(msg.DeliveryCount))
+		w.attribute(attrDeliveryCount, v)
+	}
+	if msg.LastConsumer != "" {
+		w.attribute(attrLastConsumer, []byte(msg.LastConsumer))
+	}
+	if msg.Header.Expiration > 0 {
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(msg.Header.Expiration))
+		w.attribute(attrExpiration, v)
+	}
+	if msg.Header.DeliverAt > 0 {
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(msg.Header.DeliverAt))
+		w.attribute(attrDeliverAt, v)
+	}
+	if msg.Header.Priority > 0 {
+		w.attribute(attrPriority, []byte{byte(msg.Header.Priority)})
+	}
+}
+
+// writeProperties appends the application properties of msg which are set,
+// they never change so status records don't repeat them.
+func writeProperties(w *recordWriter, msg *QMessage) {
+	properties := []struct {
+		tag   byte
+		value string
+	}{
+		{attrContentType, msg.Header.ContentType},
+		{attrContentEnc, msg.Header.ContentEncoding},
+		{attrCorrelationId, msg.Header.CorrelationId},
+		{attrReplyTo, msg.Header.ReplyTo},
+	}
+	for _, p := range properties {
+		if p.value != "" {
+			w.attribute(p.tag, []byte(p.value))
+		}
+	}
+}
+
+// applyAttributes sets the optional fields of msg found in attrs.
+func applyAttributes(msg *QMessage, attrs map[byte][]byte) {
+	if v, ok := attrs[attrDeliveryCount]; ok && len(v) == 4 {
+		msg.DeliveryCount = int(binary.BigEndian.Uint32(v))
+	}
+	if v, ok := attrs[attrLastConsumer]; ok {
+		msg.LastConsumer = string(v)
+	}
+	if v, ok := attrs[attrExpiration]; ok && len(v) == 8 {
+		msg.Header.Expiration = int64(binary.BigEndian.Uint64(v))
+	}
+	if v, ok := attrs[attrDeliverAt]; ok && len(v) == 8 {
+		msg.Header.DeliverAt = int64(binary.BigEndian.Uint64(v))
+	}
+	if v, ok := attrs[attrPriority]; ok && len(v) == 1 {
+		msg.Header.Priority = int(v[0])
+	}
+	if v, ok := attrs[attrContentType]; ok {
+		msg.Header.ContentType = string(v)
+	}
+	if v, ok := attrs[attrContentEnc]; ok {
+		msg.Header.ContentEncoding = string(v)
+	}
+	if v, ok := attrs[attrCorrelationId]; ok {
+		msg.Header.CorrelationId = string(v)
+	}
+	if v, ok := attrs[attrReplyTo]; ok {
+		msg.Header.ReplyTo = string(v)
+	}
+}
+
+func decodeRecord(kind byte, body []byte) (logRecord, error) {
+	r := recordReader{buf: body}
+	rec := logRecord{kind: kind}
+	switch kind {
+	case recordPublish:
+		msg := QMessage{}
+		msg.Id = r.string16()
+		msg.Header.Timestamp = int64(r.uint64())
+		msg.Status = int(r.uint8())
+		msg.Data = r.bytes32()
+		msg.Header.Size = len(msg.Data)
+		if count := int(r.uint16()); count > 0 {
+			msg.Header.Headers = make(map[string]string, count)
+			for i := 0; i < count && r.err == nil; i++ {
+				k := r.string16()
+				msg.Header.Headers[k] = string(r.bytes32())
+			}
+		}
+		rec.msg = msg
+		rec.id = msg.Id
+		rec.status = msg.Status
+	case recordStatus:
+		rec.id = r.string16()
+		rec.home = r.uint64()
+		rec.status = int(r.uint8())
+		rec.msg.Id = rec.id
+		rec.msg.Status = rec.status
+	default:
+		return logRecord{}, fmt.Errorf("unknown record kind %d", kind)
+	}
+	rec.attrs = r.attributes()
+	if r.err != nil {
+		return logRecord{}, r.err
+	}
+	applyAttributes(&rec.msg, rec.attrs)
+	return rec, nil
+}
@@ -0,0 +1,118 @@
+package mq
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"tomqserver/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecord_PublishRoundTrip(t *testing.T) {
+	msg := NewMessage("TEST", []byte("some data"))
+	msg.Header.Headers = map[string]string{"region": "eu", "tenant": "42"}
+	msg.Header.ContentType = "application/json"
+	msg.Header.ContentEncoding = "gzip"
+	msg.Header.CorrelationId = "req-1"
+	msg.Header.ReplyTo = "REPLIES"
+	record := encodeRecord(recordPublish, encodePublishBody(&msg))
+
+	kind, size, err := parseRecordHeader(record)
+	assert.NoError(t, err)
+	assert.Equal(t, recordPublish, kind)
+	assert.Equal(t, int64(len(record)-recordHeaderSize), size)
+	body := record[recordHeaderSize:]
+	assert.NoError(t, verifyRecord(record, body))
+
+	rec, err := decodeRecord(kind, body)
+	assert.NoError(t, err)
+	assert.Equal(t, msg.Id, rec.id)
+	assert.Equal(t, msg.Data, rec.msg.Data)
+	assert.Equal(t, msg.Header.Timestamp, rec.msg.Header.Timestamp)
+	assert.Equal(t, msg.Header.Headers, rec.msg.Header.Headers)
+	assert.Equal(t, "application/json", rec.msg.Header.ContentType)
+	assert.Equal(t, "gzip", rec.msg.Header.ContentEncoding)
+	assert.Equal(t, "req-1", rec.msg.Header.CorrelationId)
+	assert.Equal(t, "REPLIES", rec.msg.Header.ReplyTo)
+	assert.Equal(t, STATUS_MESSAGE_READY, rec.status)
+
+	body[len(body)-1] ^= 0xff
+	assert.Error(t, verifyRecord(record, body))
+}
+
+func TestRecord_BadHeader(t *testing.T) {
+	record := encodeRecord(recordStatus, encodeStatusBody(&QMessage{Id: "id", Status: STATUS_MESSAGE_ACK}, 1))
+	record[2] = recordVersion + 1
+	_, _, err := parseRecordHeader(record)
+	assert.Error(t, err)
+	record[0] = 0
+	_, _, err = parseRecordHeader(record)
+	assert.Error(t, err)
+}
+
+func TestQueue_RecoverSkipsCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openQueue("TEST", dir, nil)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, q.Publish(NewMessage("TEST", []byte("data"))))
+	}
+	seg := q.log.activeSegment()
+	second := readyIds(q)[1]
+	assert.NoError(t, q.Close())
+
+	data, err := os.ReadFile(seg.path)
+	assert.NoError(t, err)
+	data[seg.size/3+recordHeaderSize+5] ^= 0xff
+	assert.NoError(t, os.WriteFile(seg.path, data, 0644))
+
+	q2, err := openQueue("TEST", dir, nil)
+	assert.NoError(t, err)
+	defer q2.Close() // nolint
+	assert.Len(t, q2.recovery.Problems, 1)
+	assert.Len(t, readyIds(q2), 2)
+	assert.NotContains(t, readyIds(q2), second)
+}
+
+func TestReadLegacyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "PING.mq")
+	data := "000000001165818168598649683" + "61NYo8x4rf3XqlZaqtDg7rAJCxFSs=1" +
+		"000000001165818168598649683" + "61NYo8x4rf3XqlZaqtDg7rAJCxFSs=1" +
+		"000000004165818168498819894" + "91E8-SSH-IyeJKyFi6_MlOsCBKvQU=a b " +
+		"000000001165818168498819894" + "3ackedxIyeJKyFi6_MlOsCBKvQU=x" +
+		"00000000"
+	assert.NoError(t, os.WriteFile(path, []byte(data), 0644))
+
+	msgs, err := readLegacyFile(path)
+	assert.Error(t, err)
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, "NYo8x4rf3XqlZaqtDg7rAJCxFSs=", msgs[0].Id)
+	assert.Equal(t, int64(1658181685986496836), msgs[0].Header.Timestamp)
+	assert.Equal(t, []byte("1"), msgs[0].Data)
+	assert.Equal(t, "E8-SSH-IyeJKyFi6_MlOsCBKvQU=", msgs[1].Id)
+	assert.Equal(t, []byte("a b "), msgs[1].Data)
+}
+
+func TestMigrateLegacyFile_Overflow(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueueWithOptions("ping", QueueOptions{MaxLength: 1, Overflow: OVERFLOW_DEAD_LETTER, DeadLetter: "dead"}))
+	path := filepath.Join(config.Get().DataDir, "PING.mq")
+	data := "000000001165818168598649683" + "1NYo8x4rf3XqlZaqtDg7rAJCxFSs=1" +
+		"000000001165818168498819894" + "1E8-SSH-IyeJKyFi6_MlOsCBKvQU=2"
+	assert.NoError(t, os.WriteFile(path, []byte(data), 0644))
+
+	imported, err := qc.migrateLegacyFile("PING", path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, imported)
+	q, err := qc.GetQueue("PING")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"E8-SSH-IyeJKyFi6_MlOsCBKvQU="}, readyIds(q))
+
+	// the overflow went to the dead letter queue
+	dead, err := qc.GetQueue("DEAD")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, dead.TotalMesssages())
+	dl := dead.storage[readyIds(dead)[0]]
+	assert.Equal(t, "NYo8x4rf3XqlZaqtDg7rAJCxFSs=", dl.Header.Headers[HEADER_DEATH_ID])
+}
@@ -0,0 +1,67 @@
+package mq
+
+import (
+	"container/heap"
+	"time"
+)
+
+/*
+A message published with a delivery time in the future is SCHEDULED:
+it's stored and logged like any other but stays out of the ready lists,
+in a min-heap on Header.DeliverAt. The dispatcher sleeps until the first
+one is due, then appends the due messages to the ready lists.
+*/
+
+// SetDelay makes the message visible to consumers d after now.
+func (m *QMessage) SetDelay(d time.Duration) {
+	m.Header.DeliverAt = time.Now().Add(d).UnixNano()
+}
+
+// visibleAt returns when the message can be distributed.
+func (m *QMessage) visibleAt(now time.Time) time.Time {
+	if m.Header.DeliverAt > now.UnixNano() {
+		return time.Unix(0, m.Header.DeliverAt)
+	}
+	return now
+}
+
+// scheduleHeap orders the scheduled messages by delivery time.
+type scheduleHeap []*QMessage
+
+func (h scheduleHeap) Len() int            { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool  { return h[i].Header.DeliverAt < h[j].Header.DeliverAt }
+func (h scheduleHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *scheduleHeap) Push(x interface{}) { *h = append(*h, x.(*QMessage)) }
+func (h *scheduleHeap) Pop() interface{} {
+	old := *h
+	msg := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return msg
+}
+
+// schedule keeps msg aside until its delivery time, q.m must be held.
+func (q *queue) schedule(msg *QMessage) {
+	msg.Status = STATUS_MESSAGE_SCHEDULED
+	heap.Push(&q.scheduled, msg)
+}
+
+// releaseDue moves the messages due at now to the ready lists, q.m must be held.
+func (q *queue) releaseDue(now int64) {
+	for len(q.scheduled) > 0 && q.scheduled[0].Header.DeliverAt <= now {
+		msg := heap.Pop(&q.scheduled).(*QMessage)
+		if stored, ok := q.storage[msg.Id]; !ok || stored != msg || msg.Status != STATUS_MESSAGE_SCHEDULED {
+			continue
+		}
+		msg.Status = STATUS_MESSAGE_READY
+		q.index.pushReady(msg)
+	}
+}
+
+// nextRelease returns the delivery time of the first scheduled message, 0 when none.
+func (q *queue) nextRelease() int64 {
+	if len(q.scheduled) == 0 {
+		return 0
+	}
+	return q.scheduled[0].Header.DeliverAt
+}
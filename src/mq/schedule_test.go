@@ -0,0 +1,58 @@
+package mq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue_ScheduledDelivery(t *testing.T) {
+	q, err := openQueue("TEST", t.TempDir(), nil)
+	assert.NoError(t, err)
+	defer q.Close() // nolint
+	ch := deliveries(q)
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 1})))
+	q.Credit("1", 2) // nolint
+
+	start := time.Now()
+	later := NewMessage("TEST", []byte("later"))
+	later.SetDelay(400 * time.Millisecond)
+	sooner := NewMessage("TEST", []byte("sooner"))
+	sooner.SetDelay(200 * time.Millisecond)
+	now := NewMessage("TEST", []byte("now"))
+	assert.NoError(t, q.Publish(later))
+	assert.NoError(t, q.Publish(sooner))
+	assert.NoError(t, q.Publish(now))
+	assert.Equal(t, 2, q.TotalScheduled())
+
+	assert.Equal(t, now.Id, receive(t, ch).Id)
+	assert.Equal(t, sooner.Id, receive(t, ch).Id)
+	assert.Equal(t, later.Id, receive(t, ch).Id)
+	assert.GreaterOrEqual(t, time.Since(start), 400*time.Millisecond)
+	assert.Equal(t, 0, q.TotalScheduled())
+}
+
+func TestQueue_RecoverScheduled(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openQueue("TEST", dir, nil)
+	assert.NoError(t, err)
+	msg := NewMessage("TEST", []byte("reminder"))
+	msg.SetDelay(time.Hour)
+	assert.NoError(t, q.Publish(msg))
+	assert.NoError(t, q.Close())
+
+	q2, err := openQueue("TEST", dir, nil)
+	assert.NoError(t, err)
+	defer q2.Close() // nolint
+	assert.Empty(t, readyIds(q2))
+	assert.Equal(t, 1, q2.TotalScheduled())
+	assert.Equal(t, STATUS_MESSAGE_SCHEDULED, q2.storage[msg.Id].Status)
+	assert.Equal(t, msg.Header.DeliverAt, q2.storage[msg.Id].Header.DeliverAt)
+
+	q2.m.Lock()
+	q2.releaseDue(msg.Header.DeliverAt)
+	q2.m.Unlock()
+	assert.Equal(t, []string{msg.Id}, readyIds(q2))
+	assert.Equal(t, STATUS_MESSAGE_READY, q2.storage[msg.Id].Status)
+}
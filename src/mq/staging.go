@@ -0,0 +1,542 @@
+package mq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"tomqserver/config"
+
+	"github.com/google/uuid"
+)
+
+/*
+A session can open a transaction: its publishes and acks are staged, nothing is
+published or removed, until it commits them as a unit or rolls them back. Nacks and
+rejects are not staged. A staged ack doesn't hold back the ack deadline of its message,
+the commit fails when the message went back to the queue meanwhile.
+
+A commit checks the whole transaction before changing anything, room for the publishes
+included, then writes its journal: the transaction is committed. It's applied to the
+queues in memory, which can't fail once checked, then their logs get the records and
+are synced whatever their durability, and the journal is marked applied. The queues of
+the transaction stay locked until then, nobody sees a part of it or touches its messages.
+When a log fails the journal keeps only the records which didn't make it to the logs:
+the messages logged are free to go, the others stay until the next start, their acks
+failing without a publish record. A journal not marked applied, left by a crash or a
+log failure, is applied again at startup, skipping what was already done, so after a
+restart a transaction is either complete or absent.
+*/
+
+// journals of the commits in progress, lower case so it's never taken for a queue
+const txDir = "transactions"
+
+var (
+	// ErrNoTx is returned to a session which has no transaction open.
+	ErrNoTx = errors.New("no transaction open")
+	// ErrTxOpen refuses to open a transaction in a session which has one.
+	ErrTxOpen = errors.New("transaction already open")
+)
+
+// stage is what a transaction does once committed, its journal too.
+type stage struct {
+	Id        string      `json:"id"`
+	Publishes []QMessage  `json:"publishes,omitempty"` // to the queue named by their channel
+	Acks      []stagedAck `json:"acks,omitempty"`
+	Drops     []stagedAck `json:"drops,omitempty"` // made room for the publishes, in a redo only
+	Applied   bool        `json:"applied,omitempty"`
+	creates   []string    // the queues of the publishes the commit may create
+}
+
+type stagedAck struct {
+	Queue string `json:"queue"`
+	Id    string `json:"id"`
+}
+
+// Begin opens a transaction in session sid.
+func (qc *queuesControl) Begin(sid string) error {
+	qc.txm.Lock()
+	defer qc.txm.Unlock()
+	if _, ok := qc.stages[sid]; ok {
+		return ErrTxOpen
+	}
+	qc.stages[sid] = &stage{Id: uuid.New().String()}
+	return nil
+}
+
+// InTx tells if session sid has a transaction open.
+func (qc *queuesControl) InTx(sid string) bool {
+	qc.txm.Lock()
+	defer qc.txm.Unlock()
+	_, ok := qc.stages[sid]
+	return ok
+}
+
+// StagePublish stages the publish of msg to the queue named by its channel,
+// which the commit creates when it's missing, like Publish.
+func (qc *queuesControl) StagePublish(sid string, msg QMessage) error {
+	if err := msg.CheckHeaders(); err != nil {
+		return err
+	}
+	name := strings.ToUpper(msg.Header.Channel)
+	if _, err := qc.GetQueue(name); err != nil && !config.Get().ImplicitQueues {
+		return err
+	}
+	return qc.staging(sid, func(st *stage) error {
+		if err := st.publish(routedCopy(msg, name)); err != nil {
+			return err
+		}
+		if !containsString(st.creates, name) {
+			st.creates = append(st.creates, name)
+		}
+		return nil
+	})
+}
+
+// StagePublishTo stages a copy of msg for every queue the exchange routes it to,
+// like PublishTo. Returns how many queues will get it.
+func (qc *queuesControl) StagePublishTo(sid string, exchangeName string, routingKey string, msg QMessage) (int, error) {
+	if err := msg.CheckHeaders(); err != nil {
+		return 0, err
+	}
+	targets, err := qc.targets(exchangeName, routingKey, msg.Header.Headers)
+	if err != nil {
+		return 0, err
+	}
+	err = qc.staging(sid, func(st *stage) error {
+		for _, q := range targets {
+			if st.publishes(q.name, msg.Id) {
+				return fmt.Errorf("queue %s: %w", q.name, ErrDuplicateId)
+			}
+		}
+		for _, q := range targets {
+			st.Publishes = append(st.Publishes, routedCopy(msg, q.name))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(targets), nil
+}
+
+// StageAck stages the ack of message id of queueName, which session sid must hold.
+func (qc *queuesControl) StageAck(sid string, queueName string, id string) error {
+	q, err := qc.GetQueue(queueName)
+	if err != nil {
+		return err
+	}
+	q.m.Lock()
+	err = q.ackable(sid, id)
+	q.m.Unlock()
+	if err != nil {
+		return err
+	}
+	return qc.staging(sid, func(st *stage) error {
+		ack := stagedAck{Queue: q.name, Id: id}
+		for _, staged := range st.Acks {
+			if staged == ack {
+				return fmt.Errorf("%w %d for %s", ErrTxDuplicate, TX_ACK, id)
+			}
+		}
+		st.Acks = append(st.Acks, ack)
+		return nil
+	})
+}
+
+// Rollback drops the transaction of session sid.
+func (qc *queuesControl) Rollback(sid string) error {
+	st := qc.takeStage(sid)
+	if st == nil {
+		return ErrNoTx
+	}
+	log.Println("[MQ] transaction", st.Id, "rolled back,", len(st.Publishes), "publishes and", len(st.Acks), "acks dropped")
+	return nil
+}
+
+// Commit applies the transaction of session sid as a unit, which ends either way.
+// When it fails nothing is applied.
+func (qc *queuesControl) Commit(sid string) error {
+	st := qc.takeStage(sid)
+	if st == nil {
+		return ErrNoTx
+	}
+	if len(st.Publishes) == 0 && len(st.Acks) == 0 {
+		return nil
+	}
+	queues, missing := qc.queuesOf(st)
+	for _, name := range missing {
+		if !containsString(st.creates, name) || !config.Get().ImplicitQueues {
+			return fmt.Errorf("queue %s: %w", name, ErrNoQueue)
+		}
+	}
+	if len(missing) > 0 {
+		// the missing queues are created once the rest of the transaction checks out
+		err := lockQueues(queues, func() (map[*queue][]deadLetter, error) {
+			return nil, st.check(sid, queues)
+		})
+		if err != nil {
+			return err
+		}
+		for _, name := range missing {
+			q, err := qc.GetOrCreate(name)
+			if err != nil {
+				return fmt.Errorf("queue %s: %w", name, err)
+			}
+			queues[name] = q
+		}
+	}
+	dir := filepath.Join(config.Get().DataDir, txDir)
+	path := filepath.Join(dir, st.Id+".json")
+	return lockQueues(queues, func() (map[*queue][]deadLetter, error) {
+		if err := st.check(sid, queues); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		if err := writeJournal(path, st); err != nil {
+			return nil, err
+		}
+		deadLetters, rest, err := st.apply(sid, queues, false)
+		if rest != nil {
+			log.Println("[MQ] transaction", st.Id, "committed, the next start completes its logs:", err)
+			if err := writeJournal(path, rest); err != nil {
+				log.Println("[MQ] transaction", st.Id, "journal not trimmed:", err)
+			}
+			return deadLetters, nil
+		}
+		if err := closeJournal(path, st.Id); err != nil {
+			log.Println("[MQ] transaction", st.Id, "journal not closed:", err)
+		}
+		log.Println("[MQ] transaction", st.Id, "committed,", len(st.Publishes), "publishes and", len(st.Acks), "acks")
+		return deadLetters, nil
+	})
+}
+
+// recoverTransactions completes the commits a crash stopped, from their journals.
+func (qc *queuesControl) recoverTransactions(dataDir string) {
+	dir := filepath.Join(dataDir, txDir)
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		// a journal not completely written is a transaction which wasn't committed
+		err = removeCompactionLeftovers(dir)
+	}
+	if err != nil {
+		log.Println("[MQ] transactions recovery skipped:", err)
+		return
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		if err := qc.redo(filepath.Join(dir, e.Name())); err != nil {
+			log.Println("[MQ] transaction journal", e.Name(), "recovery failed:", err)
+		}
+	}
+}
+
+// redo applies the journal at path again, skipping what's already done, and closes it.
+// Nothing else touched its messages since, their queues were locked until then.
+func (qc *queuesControl) redo(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	st := &stage{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return err
+	}
+	if st.Applied {
+		return os.Remove(path)
+	}
+	queues, missing := qc.queuesOf(st)
+	for _, name := range missing {
+		log.Println("[MQ] transaction", st.Id, "skips queue", name+", it's gone")
+	}
+	err = lockQueues(queues, func() (map[*queue][]deadLetter, error) {
+		deadLetters, rest, err := st.apply("", queues, true)
+		if rest != nil {
+			if werr := writeJournal(path, rest); werr != nil {
+				log.Println("[MQ] transaction", st.Id, "journal not trimmed:", werr)
+			}
+			return deadLetters, err
+		}
+		return deadLetters, closeJournal(path, st.Id)
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("[MQ] transaction", st.Id, "completed from its journal")
+	return nil
+}
+
+// staging runs f on the transaction of session sid.
+func (qc *queuesControl) staging(sid string, f func(st *stage) error) error {
+	qc.txm.Lock()
+	defer qc.txm.Unlock()
+	st, ok := qc.stages[sid]
+	if !ok {
+		return ErrNoTx
+	}
+	return f(st)
+}
+
+// takeStage ends the transaction of session sid and returns it, nil when there's none.
+func (qc *queuesControl) takeStage(sid string) *stage {
+	qc.txm.Lock()
+	defer qc.txm.Unlock()
+	st := qc.stages[sid]
+	delete(qc.stages, sid)
+	return st
+}
+
+// writeJournal replaces the journal at path with st, for good once it returns.
+func writeJournal(path string, st *stage) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	if err := replaceFile(path, data); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// closeJournal marks the journal at path applied, which lasts even when the removal
+// that follows doesn't.
+func closeJournal(path string, id string) error {
+	if err := writeJournal(path, &stage{Id: id, Applied: true}); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// queuesOf returns the queues of the transaction by name and the names of the missing ones.
+func (qc *queuesControl) queuesOf(st *stage) (map[string]*queue, []string) {
+	names := []string{}
+	for _, msg := range st.Publishes {
+		names = append(names, msg.Header.Channel)
+	}
+	for _, ack := range st.Acks {
+		names = append(names, ack.Queue)
+	}
+	queues := map[string]*queue{}
+	missing := []string{}
+	for _, name := range names {
+		if _, ok := queues[name]; ok || containsString(missing, name) {
+			continue
+		}
+		if q, err := qc.GetQueue(name); err == nil {
+			queues[name] = q
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	return queues, missing
+}
+
+// lockQueues runs f with the queues locked, in name order so commits don't deadlock,
+// then sends the dead letters of f.
+func lockQueues(queues map[string]*queue, f func() (map[*queue][]deadLetter, error)) error {
+	names := make([]string, 0, len(queues))
+	for name := range queues {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		queues[name].m.Lock()
+	}
+	deadLetters, err := f()
+	for _, name := range names {
+		queues[name].m.Unlock()
+	}
+	for q, letters := range deadLetters {
+		q.sendDeadLetters(letters)
+	}
+	return err
+}
+
+// publish stages msg unless its queue already gets a message with its id.
+func (st *stage) publish(msg QMessage) error {
+	if st.publishes(msg.Header.Channel, msg.Id) {
+		return fmt.Errorf("queue %s: %w", msg.Header.Channel, ErrDuplicateId)
+	}
+	st.Publishes = append(st.Publishes, msg)
+	return nil
+}
+
+// publishes tells if the transaction publishes message id to queue name.
+func (st *stage) publishes(name string, id string) bool {
+	for _, msg := range st.Publishes {
+		if msg.Header.Channel == name && msg.Id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// check refuses the transaction unless it can be applied in full, which leaves apply
+// nothing but the logs to fail on. The publishes to queues not created yet are left
+// out. q.m of its queues must be held.
+func (st *stage) check(sid string, queues map[string]*queue) error {
+	gone := map[*queue][]*QMessage{}
+	for _, ack := range st.Acks {
+		q, ok := queues[ack.Queue]
+		if !ok {
+			return fmt.Errorf("queue %s: %w", ack.Queue, ErrNoQueue)
+		}
+		if err := q.ackable(sid, ack.Id); err != nil {
+			return fmt.Errorf("queue %s: %w", q.name, err)
+		}
+		gone[q] = append(gone[q], q.storage[ack.Id])
+	}
+	added := map[*queue][]*QMessage{}
+	for _, staged := range st.Publishes {
+		q, ok := queues[staged.Header.Channel]
+		if !ok {
+			continue
+		}
+		if _, ok := q.storage[staged.Id]; ok {
+			return fmt.Errorf("queue %s: %w", q.name, ErrDuplicateId)
+		}
+		msg := staged
+		q.prepare(&msg)
+		added[q] = append(added[q], &msg)
+	}
+	for q, msgs := range added {
+		if !q.accepts(msgs, gone[q]) {
+			return fmt.Errorf("queue %s: %w", q.name, ErrQueueFull)
+		}
+	}
+	return nil
+}
+
+// apply acks and publishes what the transaction staged for session sid in memory, then
+// logs it and syncs the logs of its queues. A redo skips the messages already published
+// or removed. Only the logs fail: the queues are changed in full anyway, and what didn't
+// make it to the logs is returned, for the journal to keep. q.m of the queues must be held.
+func (st *stage) apply(sid string, queues map[string]*queue, redo bool) (map[*queue][]deadLetter, *stage, error) {
+	type record struct {
+		q       *queue
+		msg     *QMessage
+		publish bool
+	}
+	deadLetters := map[*queue][]deadLetter{}
+	records := []record{}
+	remove := func(entry stagedAck, status int) {
+		q, ok := queues[entry.Queue]
+		if !ok {
+			return
+		}
+		msg, ok := q.storage[entry.Id]
+		if !ok {
+			return
+		}
+		if !redo {
+			q.tm.Update(entry.Id, sid, TX_ACK, TX_ACK_SENT) // nolint, check accepted it
+		}
+		msg.Status = status
+		q.evict(msg)
+		q.release(msg.Id)
+		records = append(records, record{q: q, msg: msg})
+	}
+	// acks first, they make room for the publishes
+	for _, ack := range st.Acks {
+		remove(ack, STATUS_MESSAGE_ACK)
+	}
+	for _, drop := range st.Drops {
+		remove(drop, STATUS_MESSAGE_REJECTED)
+	}
+	for _, staged := range st.Publishes {
+		q, ok := queues[staged.Header.Channel]
+		if !ok {
+			continue
+		}
+		if _, ok := q.storage[staged.Id]; ok {
+			continue
+		}
+		msg := staged
+		dropped, dls := q.evictFor(int64(len(msg.Data)))
+		deadLetters[q] = append(deadLetters[q], dls...)
+		for _, d := range dropped {
+			records = append(records, record{q: q, msg: d})
+		}
+		q.prepare(&msg)
+		q.insert(&msg)
+		records = append(records, record{q: q, msg: &msg, publish: true})
+	}
+
+	// the syncs are forced instead of waited for, another batch may hold them back
+	var err error
+	lost := map[*QMessage]bool{}
+	for _, q := range queues {
+		q.log.begin()
+	}
+	for _, r := range records {
+		var werr error
+		if r.publish {
+			_, werr = r.q.log.Publish(r.msg)
+		} else {
+			_, werr = r.q.log.SetStatus(r.msg)
+		}
+		if werr != nil {
+			lost[r.msg] = true
+			if err == nil {
+				err = fmt.Errorf("queue %s: %w", r.q.name, werr)
+			}
+		}
+	}
+	unsynced := map[*queue]bool{}
+	for _, q := range queues {
+		q.log.end()
+		if serr := q.Persist(); serr != nil {
+			unsynced[q] = true
+			if err == nil {
+				err = fmt.Errorf("queue %s: %w", q.name, serr)
+			}
+		}
+	}
+	if err == nil {
+		return deadLetters, nil, nil
+	}
+	rest := &stage{Id: st.Id}
+	for _, r := range records {
+		if !lost[r.msg] && !unsynced[r.q] {
+			continue
+		}
+		entry := stagedAck{Queue: r.q.name, Id: r.msg.Id}
+		if r.publish {
+			rest.Publishes = append(rest.Publishes, *r.msg)
+		} else if r.msg.Status == STATUS_MESSAGE_ACK {
+			rest.Acks = append(rest.Acks, entry)
+		} else {
+			rest.Drops = append(rest.Drops, entry)
+		}
+	}
+	return deadLetters, rest, err
+}
+
+// ackable checks that session sid can ack message id, without acking it. q.m must be held.
+func (q *queue) ackable(sid string, id string) error {
+	if _, ok := q.storage[id]; !ok {
+		return ErrNoMessage
+	}
+	return q.tm.check(id, sid, TX_ACK)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,286 @@
+package mq
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"tomqserver/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// journals lists the transaction journals left in the data dir.
+func journals(t *testing.T) []string {
+	entries, err := os.ReadDir(filepath.Join(config.Get().DataDir, txDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	assert.NoError(t, err)
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestQueuesControl_TxCommit(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueue("orders"))
+	assert.NoError(t, qc.NewQueue("audit"))
+	assert.NoError(t, qc.DeclareExchange("events", EXCHANGE_FANOUT))
+	assert.NoError(t, qc.Bind("events", "orders", "", nil))
+	assert.NoError(t, qc.Bind("events", "audit", "", nil))
+	orders, _ := qc.GetQueue("orders")
+	audit, _ := qc.GetQueue("audit")
+	consumed := publishAll(t, orders, 1)[0]
+	pulled, err := orders.Pull("1", 1, 0)
+	assert.NoError(t, err)
+	assert.Len(t, pulled, 1)
+	// held without ack deadline for the length of the test
+	assert.NoError(t, orders.UnAck("1", consumed.Id))
+
+	assert.Equal(t, ErrNoTx, qc.StagePublish("1", NewMessage("orders", []byte("early"))))
+	assert.NoError(t, qc.Begin("1"))
+	assert.Equal(t, ErrTxOpen, qc.Begin("1"))
+	assert.True(t, qc.InTx("1"))
+	assert.False(t, qc.InTx("2"))
+
+	order := NewMessage("orders", []byte("order"))
+	event := NewMessage("", []byte("event"))
+	assert.NoError(t, qc.StagePublish("1", order))
+	assert.ErrorIs(t, qc.StagePublish("1", order), ErrDuplicateId)
+	n, err := qc.StagePublishTo("1", "events", "", event)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.NoError(t, qc.StageAck("1", "orders", consumed.Id))
+	assert.ErrorIs(t, qc.StageAck("1", "orders", consumed.Id), ErrTxDuplicate)
+	assert.Equal(t, ErrTxConsumer, qc.StageAck("2", "orders", consumed.Id), "checked before the transaction")
+	assert.Equal(t, ErrNoMessage, qc.StageAck("1", "orders", "missing"))
+
+	// nothing visible or removed before the commit
+	assert.Equal(t, 1, orders.TotalMesssages())
+	assert.Equal(t, 0, audit.TotalMesssages())
+
+	// a log batch left open on a queue doesn't hold back the commit
+	orders.log.begin()
+	committed := make(chan error, 1)
+	go func() { committed <- qc.Commit("1") }()
+	select {
+	case err := <-committed:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("commit waiting for the open log batch")
+	}
+	orders.log.end()
+	assert.False(t, qc.InTx("1"))
+	assert.ElementsMatch(t, []string{order.Id, event.Id}, readyIds(orders))
+	assert.Equal(t, []string{event.Id}, readyIds(audit))
+	assert.NotContains(t, orders.storage, consumed.Id)
+	assert.Equal(t, 1, orders.tm.stats().Completed)
+	assert.Empty(t, journals(t))
+	assert.Equal(t, ErrNoTx, qc.Commit("1"))
+}
+
+func TestQueuesControl_TxRollback(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueue("orders"))
+	orders, _ := qc.GetQueue("orders")
+
+	assert.Equal(t, ErrNoTx, qc.Rollback("1"))
+	assert.NoError(t, qc.Begin("1"))
+	assert.NoError(t, qc.StagePublish("1", NewMessage("orders", []byte("order"))))
+	assert.NoError(t, qc.StagePublish("1", NewMessage("new", []byte("order"))))
+	assert.NoError(t, qc.Rollback("1"))
+	_, err := qc.GetQueue("new")
+	assert.Equal(t, ErrNoQueue, err, "created by the commit only")
+	assert.NoError(t, qc.Begin("1"))
+	assert.NoError(t, qc.Commit("1"), "the rolled back publish is gone")
+	assert.Equal(t, 0, orders.TotalMesssages())
+
+	assert.NoError(t, qc.Begin("1"))
+	assert.NoError(t, qc.StagePublish("1", NewMessage("new", []byte("order"))))
+	assert.NoError(t, qc.Commit("1"))
+	created, err := qc.GetQueue("new")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, created.TotalMesssages())
+
+	// a closed session rolls back
+	assert.NoError(t, qc.Begin("1"))
+	assert.NoError(t, qc.StagePublish("1", NewMessage("orders", []byte("order"))))
+	qc.UnregisterConsumer("1")
+	assert.False(t, qc.InTx("1"))
+	assert.Equal(t, 0, orders.TotalMesssages())
+}
+
+func TestQueuesControl_TxCommitAllOrNothing(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueue("orders"))
+	assert.NoError(t, qc.NewQueueWithOptions("audit", QueueOptions{MaxLength: 1, Overflow: OVERFLOW_REJECT_PUBLISH}))
+	orders, _ := qc.GetQueue("orders")
+	audit, _ := qc.GetQueue("audit")
+	consumed := publishAll(t, orders, 1)[0]
+	_, err := orders.Pull("1", 1, 0)
+	assert.NoError(t, err)
+
+	// the ack deadline expires before the commit
+	assert.NoError(t, qc.Begin("1"))
+	assert.NoError(t, qc.StagePublish("1", NewMessage("audit", []byte("event"))))
+	assert.NoError(t, qc.StageAck("1", "orders", consumed.Id))
+	waitReady := func() bool { return len(readyIds(orders)) == 1 }
+	assert.Eventually(t, waitReady, time.Second, 5*time.Millisecond)
+	assert.ErrorIs(t, qc.Commit("1"), ErrTxNotInFlight)
+	assert.Equal(t, 0, audit.TotalMesssages())
+	assert.Equal(t, 1, orders.TotalMesssages())
+
+	// a queue refusing a publish refuses the whole transaction
+	publishAll(t, audit, 1)
+	assert.NoError(t, qc.Begin("1"))
+	assert.NoError(t, qc.StagePublish("1", NewMessage("orders", []byte("order"))))
+	assert.NoError(t, qc.StagePublish("1", NewMessage("audit", []byte("event"))))
+	assert.ErrorIs(t, qc.Commit("1"), ErrQueueFull)
+	assert.Equal(t, 1, orders.TotalMesssages())
+	assert.Empty(t, journals(t))
+
+	// and the queues it would create are not
+	assert.NoError(t, qc.Begin("1"))
+	assert.NoError(t, qc.StagePublish("1", NewMessage("new", []byte("order"))))
+	assert.NoError(t, qc.StagePublish("1", NewMessage("audit", []byte("event"))))
+	assert.ErrorIs(t, qc.Commit("1"), ErrQueueFull)
+	_, err = qc.GetQueue("new")
+	assert.Equal(t, ErrNoQueue, err)
+
+	// so does a queue with no ready message left to drop for a publish
+	assert.NoError(t, qc.NewQueueWithOptions("latest", QueueOptions{MaxLength: 1}))
+	latest, _ := qc.GetQueue("latest")
+	held := publishAll(t, latest, 1)[0]
+	_, err = latest.Pull("2", 1, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, latest.UnAck("2", held.Id))
+	assert.NoError(t, qc.Begin("1"))
+	assert.NoError(t, qc.StagePublish("1", NewMessage("orders", []byte("order"))))
+	assert.NoError(t, qc.StagePublish("1", NewMessage("latest", []byte("price"))))
+	assert.ErrorIs(t, qc.Commit("1"), ErrQueueFull)
+	assert.Equal(t, 1, orders.TotalMesssages())
+	assert.Equal(t, 1, latest.TotalMesssages())
+	assert.Contains(t, latest.storage, held.Id)
+
+	// the publishes of the transaction make room for each other
+	assert.NoError(t, qc.NewQueueWithOptions("recent", QueueOptions{MaxLength: 1}))
+	recent, _ := qc.GetQueue("recent")
+	prices := []QMessage{}
+	assert.NoError(t, qc.Begin("1"))
+	for i := 0; i < 3; i++ {
+		prices = append(prices, NewMessage("recent", []byte("price")))
+		assert.NoError(t, qc.StagePublish("1", prices[i]))
+	}
+	assert.NoError(t, qc.Commit("1"))
+	assert.Equal(t, []string{prices[2].Id}, readyIds(recent))
+	assert.Empty(t, journals(t))
+}
+
+func TestQueuesControl_TxLogFailure(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueue("orders"))
+	assert.NoError(t, qc.NewQueue("audit"))
+	orders, _ := qc.GetQueue("orders")
+	audit, _ := qc.GetQueue("audit")
+	// the audit log can't be written anymore
+	audit.log.m.Lock()
+	assert.NoError(t, audit.log.active.Close())
+	audit.log.m.Unlock()
+
+	order := NewMessage("orders", []byte("order"))
+	event := NewMessage("audit", []byte("event"))
+	assert.NoError(t, qc.Begin("1"))
+	assert.NoError(t, qc.StagePublish("1", order))
+	assert.NoError(t, qc.StagePublish("1", event))
+	assert.NoError(t, qc.Commit("1"), "committed once the journal is written")
+	assert.Equal(t, []string{order.Id}, readyIds(orders))
+	assert.Equal(t, []string{event.Id}, readyIds(audit))
+
+	// the journal keeps the event only, the order is consumed meanwhile
+	assert.Len(t, journals(t), 1)
+	data, err := os.ReadFile(filepath.Join(config.Get().DataDir, txDir, journals(t)[0]))
+	assert.NoError(t, err)
+	rest := stage{}
+	assert.NoError(t, json.Unmarshal(data, &rest))
+	assert.Len(t, rest.Publishes, 1)
+	assert.Equal(t, event.Id, rest.Publishes[0].Id)
+	_, err = orders.Pull("2", 1, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, orders.Ack("2", order.Id))
+
+	for name, q := range qc.queues {
+		q.Close() // nolint: the audit log is broken
+		delete(qc.queues, name)
+	}
+	restarted := InitQueuesControl()
+	t.Cleanup(func() {
+		for _, q := range restarted.queues {
+			q.Close() // nolint
+		}
+	})
+	orders, _ = restarted.GetQueue("orders")
+	audit, _ = restarted.GetQueue("audit")
+	assert.Empty(t, readyIds(orders), "not published again")
+	assert.Equal(t, []string{event.Id}, readyIds(audit))
+	assert.Empty(t, journals(t))
+}
+
+func TestQueuesControl_TxRecovery(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueue("orders"))
+	assert.NoError(t, qc.NewQueue("audit"))
+	orders, _ := qc.GetQueue("orders")
+	consumed := publishAll(t, orders, 1)[0]
+	order := routedCopy(NewMessage("", []byte("order")), "ORDERS")
+	event := routedCopy(NewMessage("", []byte("event")), "AUDIT")
+
+	// the crash stopped the commit once the order was published
+	assert.NoError(t, orders.Publish(order))
+	st := stage{
+		Id:        "crashed",
+		Publishes: []QMessage{order, event, routedCopy(event, "GONE")},
+		Acks:      []stagedAck{{Queue: "ORDERS", Id: consumed.Id}},
+	}
+	data, err := json.Marshal(st)
+	assert.NoError(t, err)
+	dir := filepath.Join(config.Get().DataDir, txDir)
+	assert.NoError(t, os.MkdirAll(dir, 0755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "crashed.json"), data, 0644))
+	// and another one before its journal was complete
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "partial.json"+compactExt), data[:10], 0644))
+	// and another one after its journal was closed, its publish acked since
+	audit, _ := qc.GetQueue("audit")
+	acked := publishAll(t, audit, 1)[0]
+	_, err = audit.Pull("1", 1, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, audit.Ack("1", acked.Id))
+	applied := stage{Id: "applied", Publishes: []QMessage{routedCopy(acked, "AUDIT")}}
+	data, err = json.Marshal(applied)
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "applied.json"), data, 0644))
+	assert.NoError(t, closeJournal(filepath.Join(dir, "applied.json"), "applied"))
+	assert.NotContains(t, journals(t), "applied.json")
+	data, err = json.Marshal(stage{Id: "applied", Applied: true})
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "applied.json"), data, 0644), "the removal didn't last")
+
+	for name, q := range qc.queues {
+		assert.NoError(t, q.Close())
+		delete(qc.queues, name)
+	}
+	restarted := InitQueuesControl()
+	t.Cleanup(func() {
+		for _, q := range restarted.queues {
+			q.Close() // nolint
+		}
+	})
+	orders, _ = restarted.GetQueue("orders")
+	audit, _ = restarted.GetQueue("audit")
+	assert.Equal(t, []string{order.Id}, readyIds(orders))
+	assert.Equal(t, []string{event.Id}, readyIds(audit))
+	assert.Empty(t, journals(t))
+}
@@ -1,150 +1,186 @@
 package mq
 
 import (
-	"bytes"
-	"encoding/binary"
+	"bufio"
+	"fmt"
 	"io"
 	"log"
 	"os"
-	"strconv"
-	"sync"
-	"tomqserver/config"
+	"strings"
 )
 
-var lock sync.Mutex
-
-//this type represnts a record with three fields
-type payload struct {
-	One   float32
-	Two   float64
-	Three uint32
+// recoveryReport describes what was rebuilt from a queue log at startup.
+type recoveryReport struct {
+	Segments int
+	Records  int
+	Messages int
+	Requeued int
+	Problems []error
 }
 
-func (q *queue) ReadFile() {
-	dataDir := config.DATA_DIR
-	file, err := os.Open(dataDir + "/" + q.name[1:] + ".mq")
-
+// recover re-creates every queue found in the data dir and replays its log.
+func (qc *queuesControl) recover(dataDir string) {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		log.Println("[MQ] recovery skipped:", err)
+		return
+	}
+	entries, err := os.ReadDir(dataDir)
 	if err != nil {
-		log.Fatal(err)
+		log.Println("[MQ] recovery skipped:", err)
+		return
 	}
-	defer file.Close()
-	//headerSize := 57
-
-	dataSizeBytes := 9
-	timestampBytes := 18
-	statusBytes := 1
-	msgIdBytes := 28
-	for {
-		ds, err := readNextBytes(file, dataSizeBytes)
-		if err == io.EOF {
-			break
-		}
-		dataSize, err := strconv.Atoi(string(ds))
-
-		timestamp, err := readNextBytes(file, timestampBytes)
-		if err == io.EOF {
-			break
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() || name != strings.ToUpper(name) {
+			continue
 		}
-		status, err := readNextBytes(file, statusBytes)
-		if err == io.EOF {
-			break
+		q, err := newQueue(name, nil)
+		if err != nil {
+			log.Println("[MQ] queue", name, "recovery failed:", err)
+			continue
 		}
-		msgId, err := readNextBytes(file, msgIdBytes)
-		if err == io.EOF {
-			break
+		qc.add(q)
+		r := q.recovery
+		log.Printf("[MQ] queue %s recovered: %d messages, %d requeued, %d records in %d segments",
+			name, r.Messages, r.Requeued, r.Records, r.Segments)
+		for _, p := range r.Problems {
+			log.Printf("[MQ] queue %s: %s", name, p)
 		}
-		body, err := readNextBytes(file, dataSize+1)
-		if err == io.EOF {
-			break
-		}
-		var data []byte
-		data = append(data, ds...)
-		data = append(data, timestamp...)
-		data = append(data, status...)
-		data = append(data, msgId...)
-		data = append(data, body...)
-		println("READ DATA", string(data))
-		msg, errMsg := ReadMessage(data, q.name, 0)
-		if errMsg != nil {
-			log.Println("Invalid persisted message")
-		}
-		println("MSG  DATA", strconv.Itoa(int(msg.Header.Timestamp)), string(msg.Id), msg.ShowStatus(), string(msg.Data))
-		q.messagesOrder = append(q.messagesOrder, msg.Id)
-		msg.Status = STATUS_MESSAGE_READY
-		q.storage[msg.Id] = &msg
 	}
-
+	qc.migrateLegacy(dataDir)
 }
 
-func readNextBytes(file *os.File, number int) ([]byte, error) {
-	bytes := make([]byte, number)
-
-	_, err := file.Read(bytes)
-	if err != nil {
-		return []byte(""), err
+// restore applies a record replayed from the log to the in-memory queue.
+func (q *queue) restore(rec logRecord) {
+	switch rec.kind {
+	case recordPublish:
+		msg := rec.msg
+		msg.Header.Channel = q.name
+		if _, ok := q.storage[msg.Id]; !ok {
+			q.restoring = append(q.restoring, msg.Id)
+		}
+		q.storage[msg.Id] = &msg
+	case recordStatus:
+		if msg, ok := q.storage[rec.id]; ok {
+			if isTerminalStatus(rec.status) {
+				delete(q.storage, rec.id)
+			} else {
+				msg.Status = rec.status
+				if rec.msg.DeliveryCount > msg.DeliveryCount {
+					msg.DeliveryCount = rec.msg.DeliveryCount
+					msg.LastConsumer = rec.msg.LastConsumer
+				}
+			}
+		}
 	}
-
-	return bytes, nil
 }
 
-func WriteFile(filename string, data []byte) {
-	//filename = config.DATA_DIR + "/" + filename + ".mq"
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0600)
-
-	if err != nil {
-		log.Fatal(err)
+// finishRestore drops finished messages from the order and hands
+// messages that were in flight when the server stopped back to consumers.
+func (q *queue) finishRestore(report *recoveryReport) {
+	for _, id := range q.restoring {
+		msg, ok := q.storage[id]
+		if !ok {
+			continue
+		}
+		if msg.Status == STATUS_MESSAGE_WAITING_NACK || msg.Status == STATUS_MESSAGE_UNACK {
+			msg.Status = STATUS_MESSAGE_READY
+			report.Requeued++
+		}
+		q.expireAt(msg)
+		if msg.Status == STATUS_MESSAGE_SCHEDULED {
+			q.schedule(msg)
+			continue
+		}
+		q.index.pushReady(msg)
 	}
-	defer file.Close()
-	var bin_buf bytes.Buffer
-	binary.Write(&bin_buf, binary.BigEndian, &data)
-	writeNextBytes(file, bin_buf.Bytes())
-
-}
-func writeNextBytes(file *os.File, bytes []byte) {
-
-	_, err := file.Write(bytes)
-
-	if err != nil {
-		log.Fatal(err)
+	for _, msg := range q.storage {
+		q.bytes += int64(len(msg.Data))
 	}
-	// if n, err = file.WriteString("\n"); err != nil {
-	// 	log.Fatal(n, err)
-	// }
-
+	q.restoring = nil
+	report.Messages = len(q.storage)
 }
 
-func Seek(file *os.File, key []byte) ([]byte, int) {
-
-	return []byte(""), -1
-}
-
-func Load(path string, q *queue) error {
-	lock.Lock()
-	defer lock.Unlock()
-	f, err := os.Open(path)
+// replaySegment reads every record of seg, rebuilding the log bookkeeping and
+// calling apply for each one. A record cut by a crash at the end of the file is
+// reported and truncated away, a record failing its checksum is reported and skipped.
+func (l *segmentLog) replaySegment(seg *segment, apply func(rec logRecord), report *recoveryReport) error {
+	f, err := os.Open(seg.path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	return nil
-}
-
-// Save saves a representation of v to the file at path.
-func Save(path string, q *queue) error {
-	lock.Lock()
-	defer lock.Unlock()
-	f, err := os.Create(path)
+	info, err := f.Stat()
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	for _, msgId := range q.messagesOrder {
-		if msg, ok := q.storage[msgId]; ok {
-			if msg.Status != STATUS_MESSAGE_ACK && msg.Status != STATUS_MESSAGE_REJECTED {
-				data := msg.Line()
-				WriteFile(path, data)
+	fileSize := info.Size()
+	r := bufio.NewReader(f)
+	hdr := make([]byte, recordHeaderSize)
+	var offset int64
+	for offset < fileSize {
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return l.truncateTail(seg, offset, fileSize, report)
+		}
+		kind, size, err := parseRecordHeader(hdr)
+		if err != nil {
+			report.Problems = append(report.Problems,
+				fmt.Errorf("segment %d: corrupt record at offset %d: %s, %d bytes skipped", seg.id, offset, err, fileSize-offset))
+			break
+		}
+		next := offset + recordHeaderSize + size
+		if next > fileSize {
+			return l.truncateTail(seg, offset, fileSize, report)
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+		if err := verifyRecord(hdr, body); err != nil {
+			if next == fileSize {
+				// torn write of the last record
+				return l.truncateTail(seg, offset, fileSize, report)
 			}
+			report.Problems = append(report.Problems,
+				fmt.Errorf("segment %d: record at offset %d skipped: %s", seg.id, offset, err))
+			offset = next
+			continue
+		}
+		rec, err := decodeRecord(kind, body)
+		if err != nil {
+			report.Problems = append(report.Problems,
+				fmt.Errorf("segment %d: record at offset %d skipped: %s", seg.id, offset, err))
+			offset = next
+			continue
+		}
+		l.replayRecord(seg, rec, recordHeaderSize+size)
+		apply(rec)
+		report.Records++
+		offset = next
+	}
+	seg.size = fileSize
+	return nil
+}
+
+// truncateTail cuts an incomplete record from the end of seg.
+func (l *segmentLog) truncateTail(seg *segment, offset, fileSize int64, report *recoveryReport) error {
+	report.Problems = append(report.Problems,
+		fmt.Errorf("segment %d: truncated record at offset %d, %d bytes dropped", seg.id, offset, fileSize-offset))
+	seg.size = offset
+	return os.Truncate(seg.path, offset)
+}
+
+// replayRecord updates homes and segment liveness for a replayed record.
+func (l *segmentLog) replayRecord(seg *segment, rec logRecord, size int64) {
+	seg.records++
+	switch rec.kind {
+	case recordPublish:
+		seg.liveBytes += size
+		l.homes[rec.id] = placement{seg: seg, size: size}
+	case recordStatus:
+		if home, ok := l.homes[rec.id]; ok && isTerminalStatus(rec.status) {
+			home.seg.liveBytes -= home.size
+			delete(l.homes, rec.id)
 		}
 	}
-	return err
 }
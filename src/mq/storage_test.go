@@ -0,0 +1,59 @@
+package mq
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue_Recover(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openQueue("TEST", dir, nil)
+	assert.NoError(t, err)
+
+	msgs := []QMessage{}
+	for i := 0; i < 4; i++ {
+		msg := NewMessage("TEST", []byte("data with spaces"))
+		assert.NoError(t, q.Publish(msg))
+		msgs = append(msgs, msg)
+	}
+	assert.NoError(t, q.Ack("", msgs[0].Id))
+	assert.NoError(t, q.UnAck("", msgs[1].Id))
+	assert.NoError(t, q.Reject("", msgs[2].Id, false))
+	assert.NoError(t, q.Close())
+
+	q2, err := openQueue("TEST", dir, nil)
+	assert.NoError(t, err)
+	defer q2.Close() // nolint
+	assert.Empty(t, q2.recovery.Problems)
+	assert.Equal(t, []string{msgs[1].Id, msgs[3].Id}, readyIds(q2))
+	assert.Equal(t, 1, q2.recovery.Requeued)
+	for _, id := range readyIds(q2) {
+		assert.Equal(t, STATUS_MESSAGE_READY, q2.storage[id].Status)
+		assert.Equal(t, []byte("data with spaces"), q2.storage[id].Data)
+		assert.Equal(t, "TEST", q2.storage[id].Header.Channel)
+	}
+}
+
+func TestQueue_RecoverTruncatedTail(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openQueue("TEST", dir, nil)
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, q.Publish(NewMessage("TEST", []byte("data"))))
+	}
+	seg := q.log.activeSegment()
+	assert.NoError(t, q.Close())
+	assert.NoError(t, os.Truncate(seg.path, seg.size-3))
+
+	q2, err := openQueue("TEST", dir, nil)
+	assert.NoError(t, err)
+	defer q2.Close() // nolint
+	assert.Len(t, q2.recovery.Problems, 1)
+	assert.Len(t, readyIds(q2), 2)
+
+	info, err := os.Stat(seg.path)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*(seg.size/3), info.Size())
+}
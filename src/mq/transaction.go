@@ -1,95 +1,266 @@
 package mq
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 /*
 Server send messsage start a transaction
-tcp ack means consumer received
-consumer nack sets step 2
-server send confirmation of step 2 (tcp ack)
-step 3 is either mq ack or reject
+the consumer can tell it received it, nack it to work on it and then
+acks or rejects it, the server confirms the nack and the ack or reject
 expected tcpMessages order
-snd >> 1019 distribute
-rec << 1020 consumer informs received distribution
-rec << 1003 consumer nack
-snd >> 1004 inform consumer the server received nack
-rec << 1005 consumer ack
-snd >> 1006 inform consumer received ack
+snd >> 1019 distribute                                 step 1
+rec << 1020 consumer informs received distribution      step 2, optional
+rec << 1003 consumer nack                               step 3, optional
+snd >> 1004 inform consumer the server received nack    step 4
+rec << 1005 consumer ack, or 1007 reject                step 5
+snd >> 1006 inform consumer received ack, or 1008       step 6, the transaction is complete
+
+Every queue keeps the transactions of its messages in flight, one per distribution.
+A tcp message from another session than the consumer, or not expected at the step
+of the transaction, is refused. A transaction open for longer than the transaction
+timeout is stale: it times out and its message goes back to the queue. A message back
+to the queue for any reason ends its transaction, its next distribution starts a new one.
 */
+
+// tcp messages of the delivery state machine, the opcodes of common.go
+const (
+	TX_NACK        = 1003
+	TX_NACK_SENT   = 1004
+	TX_ACK         = 1005
+	TX_ACK_SENT    = 1006
+	TX_REJECT      = 1007
+	TX_REJECT_SENT = 1008
+	TX_DISTRIBUTE  = 1019
+	TX_RECEIVED    = 1020
+
+	TX_STEP_COMPLETE = 6
+	// TX_DONE_HISTORY is how many completed transactions a queue remembers to refuse duplicates
+	TX_DONE_HISTORY = 1024
+)
+
+// step of the transaction after each tcp message and the steps it can follow
+var txSteps = map[int]struct {
+	to   int
+	from []int
+}{
+	TX_RECEIVED:    {to: 2, from: []int{1}},
+	TX_NACK:        {to: 3, from: []int{1, 2}},
+	TX_NACK_SENT:   {to: 4, from: []int{3}},
+	TX_ACK:         {to: 5, from: []int{1, 2, 4}},
+	TX_REJECT:      {to: 5, from: []int{1, 2, 4}},
+	TX_ACK_SENT:    {to: 6, from: []int{5}},
+	TX_REJECT_SENT: {to: 6, from: []int{5}},
+}
+
+var (
+	// ErrTxConsumer refuses a tcp message about a message distributed to another session.
+	ErrTxConsumer = errors.New("message was distributed to another consumer")
+	// ErrTxOrder refuses a tcp message not expected at the step of the transaction.
+	ErrTxOrder = errors.New("out of order")
+	// ErrTxDuplicate refuses a tcp message the transaction already got.
+	ErrTxDuplicate = errors.New("duplicate")
+	// ErrTxNotInFlight refuses a tcp message about a message which wasn't distributed.
+	ErrTxNotInFlight = errors.New("message is not in flight")
+)
+
 type transaction struct {
 	id          string
-	consumer    int
+	consumer    string // session id
 	step        int
 	tcpMessages []int
+	started     int64  // unix nano
+	seq         uint64 // distribution order in the queue
 }
 
 type transactionManager struct {
 	storage           map[string]transaction
 	totalTransactions int
+	acked             int
+	rejected          int
+	timedOut          int
+	refused           int
+	deadline          int64    // unix nano of the first open transaction to time out, 0 when none
+	done              []string // last completed transactions, TX_DONE_HISTORY at most
+	doneIds           map[string]struct{}
+	seq               uint64 // of the last transaction started
 }
 
 type TransactionManager interface {
-	Start(id string, consumer int)
-	Update(id string)
+	Start(id string, consumer string, now int64)
+	Update(id string, consumer string, tcpMsgIds ...int) error
+}
+
+// TransactionStats counts the transactions of a queue.
+type TransactionStats struct {
+	Open      int `json:"open"`
+	Completed int `json:"completed"`
+	TimedOut  int `json:"timed_out"`
+	Refused   int `json:"refused"` // out of order, duplicate or foreign tcp messages
 }
 
 func NewTM() transactionManager {
 	return transactionManager{
 		storage:           map[string]transaction{},
 		totalTransactions: 0,
+		doneIds:           map[string]struct{}{},
 	}
 }
 
-func (tm *transactionManager) Start(id string, consumer int) {
+// Start opens the transaction of a distribution of message id to session consumer.
+func (tm *transactionManager) Start(id string, consumer string, now int64) {
+	tm.seq++
 	t := transaction{
 		id:          id,
 		consumer:    consumer,
 		step:        1,
-		tcpMessages: []int{1019},
+		tcpMessages: []int{TX_DISTRIBUTE},
+		started:     now,
+		seq:         tm.seq,
 	}
 	tm.storage[id] = t
+	if deadline := now + transactionTimeout(); tm.deadline == 0 || deadline < tm.deadline {
+		tm.deadline = deadline
+	}
 }
 
-func (tm *transactionManager) Update(id string, tcpMsgId int) error {
-	if t, ok := tm.storage[id]; ok {
-		t.tcpMessages = append(t.tcpMessages, tcpMsgId)
-		if tcpMsgId == 1020 {
-			// msg Nack
-			t.step = 2
-		}
-		if tcpMsgId == 1003 {
-			// msg Nack
-			t.step = 3
-		}
-		if tcpMsgId == 1003 {
-			// msg Nack confirmation sent
-			t.step = 4
+// Update applies the tcp messages, in order, to the transaction of message id.
+// Nothing changes unless they all come from session consumer at the expected steps.
+// An empty consumer skips the checks, for the settlements which don't come from a consumer.
+func (tm *transactionManager) Update(id string, consumer string, tcpMsgIds ...int) error {
+	t, ok := tm.storage[id]
+	if !ok {
+		if _, done := tm.doneIds[id]; done && consumer != "" {
+			tm.refused++
+			return fmt.Errorf("%w %d: transaction of %s is complete", ErrTxDuplicate, tcpMsgIds[0], id)
 		}
-		if tcpMsgId == 1005 {
-			// msg Ack
-			t.step = 5
+		if consumer != "" {
+			return ErrTxNotInFlight
 		}
-		if tcpMsgId == 1006 {
-			// msg Ack
-			t.step = 6
-		}
-		if tcpMsgId == 1007 {
-			// msg Reject
-			t.step = 5
-		}
-		if tcpMsgId == 1008 {
-			// msg Reject
-			t.step = 6
-		}
-		if t.step < 6 {
-			tm.storage[id] = t
-		} else {
-			delete(tm.storage, id)
-			tm.totalTransactions++
+		return nil
+	}
+	if consumer != "" && t.consumer != consumer {
+		tm.refused++
+		return ErrTxConsumer
+	}
+	t.tcpMessages = append([]int{}, t.tcpMessages...)
+	for _, tcpMsgId := range tcpMsgIds {
+		next, ok := txSteps[tcpMsgId]
+		if consumer != "" && (!ok || !containsInt(next.from, t.step)) {
+			tm.refused++
+			if containsInt(t.tcpMessages, tcpMsgId) {
+				return fmt.Errorf("%w %d for %s", ErrTxDuplicate, tcpMsgId, id)
+			}
+			return fmt.Errorf("%w: %d for %s at step %d", ErrTxOrder, tcpMsgId, id, t.step)
 		}
+		t.tcpMessages = append(t.tcpMessages, tcpMsgId)
+		t.step = next.to
+	}
+	if t.step < TX_STEP_COMPLETE {
+		tm.storage[id] = t
+		return nil
+	}
+	delete(tm.storage, id)
+	tm.totalTransactions++
+	if containsInt(t.tcpMessages, TX_REJECT) {
+		tm.rejected++
 	} else {
-		return errors.New("not found")
+		tm.acked++
 	}
+	tm.remember(id)
+	return nil
+}
 
+// check tells if session consumer can send tcp message tcpMsgId about message id, changing nothing.
+func (tm *transactionManager) check(id string, consumer string, tcpMsgId int) error {
+	t, ok := tm.storage[id]
+	if !ok {
+		return ErrTxNotInFlight
+	}
+	if t.consumer != consumer {
+		return ErrTxConsumer
+	}
+	if !containsInt(txSteps[tcpMsgId].from, t.step) {
+		return fmt.Errorf("%w: %d for %s at step %d", ErrTxOrder, tcpMsgId, id, t.step)
+	}
 	return nil
 }
+
+// distributed returns the distribution order of message id, false when it's not in flight.
+func (tm *transactionManager) distributed(id string) (uint64, bool) {
+	t, ok := tm.storage[id]
+	return t.seq, ok
+}
+
+// end drops the transaction of message id when it's still open.
+func (tm *transactionManager) end(id string) {
+	delete(tm.storage, id)
+}
+
+// timeout drops the open transaction of message id as timed out.
+func (tm *transactionManager) timeout(id string) {
+	if _, ok := tm.storage[id]; ok {
+		delete(tm.storage, id)
+		tm.timedOut++
+	}
+}
+
+// stale returns the open transactions started before now minus the transaction timeout
+// and keeps the next deadline.
+func (tm *transactionManager) stale(now int64) []string {
+	if tm.deadline == 0 || now < tm.deadline {
+		return nil
+	}
+	timeout := transactionTimeout()
+	ids := []string{}
+	tm.deadline = 0
+	for id, t := range tm.storage {
+		deadline := t.started + timeout
+		if now >= deadline {
+			ids = append(ids, id)
+		} else if tm.deadline == 0 || deadline < tm.deadline {
+			tm.deadline = deadline
+		}
+	}
+	return ids
+}
+
+// nacked counts the messages a consumer is working on.
+func (tm *transactionManager) nacked() int {
+	n := 0
+	for _, t := range tm.storage {
+		if t.step == 4 {
+			n++
+		}
+	}
+	return n
+}
+
+func (tm *transactionManager) stats() TransactionStats {
+	return TransactionStats{
+		Open:      len(tm.storage),
+		Completed: tm.totalTransactions,
+		TimedOut:  tm.timedOut,
+		Refused:   tm.refused,
+	}
+}
+
+// remember keeps id among the last completed transactions.
+func (tm *transactionManager) remember(id string) {
+	if len(tm.done) >= TX_DONE_HISTORY {
+		delete(tm.doneIds, tm.done[0])
+		tm.done = tm.done[1:]
+	}
+	tm.done = append(tm.done, id)
+	tm.doneIds[id] = struct{}{}
+}
+
+func containsInt(steps []int, step int) bool {
+	for _, s := range steps {
+		if s == step {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package mq
+
+import (
+	"testing"
+	"time"
+	"tomqserver/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionManager_Steps(t *testing.T) {
+	tm := NewTM()
+	tm.Start("a", "1", time.Now().UnixNano())
+	assert.NoError(t, tm.Update("a", "1", TX_RECEIVED))
+	assert.ErrorIs(t, tm.Update("a", "2", TX_NACK, TX_NACK_SENT), ErrTxConsumer)
+	assert.NoError(t, tm.Update("a", "1", TX_NACK, TX_NACK_SENT))
+	assert.Equal(t, 4, tm.storage["a"].step)
+	assert.ErrorIs(t, tm.Update("a", "1", TX_NACK, TX_NACK_SENT), ErrTxDuplicate)
+	assert.ErrorIs(t, tm.Update("a", "1", TX_ACK_SENT), ErrTxOrder)
+	assert.Equal(t, 1, tm.nacked())
+	assert.NoError(t, tm.Update("a", "1", TX_ACK, TX_ACK_SENT))
+	assert.ErrorIs(t, tm.Update("a", "1", TX_ACK, TX_ACK_SENT), ErrTxDuplicate)
+
+	// nothing changes when a tcp message of the update is refused
+	tm.Start("b", "1", time.Now().UnixNano())
+	assert.ErrorIs(t, tm.Update("b", "1", TX_REJECT, TX_NACK), ErrTxOrder)
+	assert.Equal(t, []int{TX_DISTRIBUTE}, tm.storage["b"].tcpMessages)
+	assert.NoError(t, tm.Update("b", "1", TX_REJECT, TX_REJECT_SENT))
+
+	// settlements which don't come from a consumer aren't checked
+	tm.Start("c", "1", time.Now().UnixNano())
+	assert.NoError(t, tm.Update("c", "", TX_ACK, TX_ACK_SENT))
+	assert.NoError(t, tm.Update("missing", "", TX_ACK, TX_ACK_SENT))
+	assert.ErrorIs(t, tm.Update("missing", "1", TX_ACK, TX_ACK_SENT), ErrTxNotInFlight)
+
+	assert.Equal(t, TransactionStats{Completed: 3, Refused: 5}, tm.stats())
+	assert.Equal(t, 2, tm.acked)
+	assert.Equal(t, 1, tm.rejected)
+}
+
+func TestQueue_TransactionChecks(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueue("work"))
+	q, _ := qc.GetQueue("WORK")
+	ch := deliveries(q)
+	msg := NewMessage("WORK", []byte("data"))
+	assert.NoError(t, q.Publish(msg))
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 1})))
+	receive(t, ch)
+
+	assert.NoError(t, q.Received("1", msg.Id))
+	assert.ErrorIs(t, q.Ack("2", msg.Id), ErrTxConsumer)
+	assert.NoError(t, q.UnAck("1", msg.Id))
+	assert.ErrorIs(t, q.UnAck("1", msg.Id), ErrTxDuplicate)
+	assert.NoError(t, q.Ack("1", msg.Id))
+	assert.ErrorIs(t, q.Ack("1", msg.Id), ErrTxDuplicate)
+	assert.Equal(t, ErrNoMessage, q.Ack("1", "missing"))
+
+	acked, nacked, rejected, stats := q.transactionCounts()
+	assert.Equal(t, 1, acked)
+	assert.Zero(t, nacked)
+	assert.Zero(t, rejected)
+	assert.Equal(t, TransactionStats{Completed: 1, Refused: 3}, stats)
+}
+
+func TestQueue_StaleTransaction(t *testing.T) {
+	qc := testControl(t)
+	config.Get().TransactionTimeout = 100 * time.Millisecond
+	assert.NoError(t, qc.NewQueue("work"))
+	q, _ := qc.GetQueue("WORK")
+	ch := deliveries(q)
+	msg := NewMessage("WORK", []byte("data"))
+	assert.NoError(t, q.Publish(msg))
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 1})))
+	receive(t, ch)
+
+	// nacked, so out of the ack timeout but not of the transaction one
+	assert.NoError(t, q.UnAck("1", msg.Id))
+	again := receive(t, ch)
+	assert.Equal(t, msg.Id, again.Id)
+	assert.Equal(t, 2, again.DeliveryCount)
+	_, _, _, stats := q.transactionCounts()
+	assert.Equal(t, 1, stats.TimedOut)
+	assert.Equal(t, 1, stats.Open, "the new distribution")
+	assert.NoError(t, q.Ack("1", msg.Id))
+}
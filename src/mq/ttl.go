@@ -0,0 +1,100 @@
+package mq
+
+import (
+	"container/heap"
+	"log"
+	"time"
+)
+
+/*
+A message expires at Header.Expiration, set at publish time from its own TTL
+or from the TTL of the queue, counted from when it becomes visible. Expired messages are never distributed: the
+sweeper removes them every sweep interval and the dispatcher drops the ones
+it meets before that. Messages held by a consumer are left alone, they expire
+if they come back to the queue.
+
+The messages which expire are kept in a min-heap on Header.Expiration, like the
+scheduled ones, so a sweep only looks at the expired messages and costs nothing
+to a queue without TTL. Entries are left behind by the messages which leave the
+queue, the sweep skips them.
+*/
+
+// Expired tells if the message expiration is past.
+func (m *QMessage) Expired(now time.Time) bool {
+	return m.Header.Expiration > 0 && now.UnixNano() >= m.Header.Expiration
+}
+
+// SetTTL makes the message expire ttl after it becomes visible,
+// so the delivery time must be set first.
+func (m *QMessage) SetTTL(ttl time.Duration) {
+	m.Header.Expiration = m.visibleAt(time.Now()).Add(ttl).UnixNano()
+}
+
+// expiryHeap orders the messages which expire by expiration.
+type expiryHeap []*QMessage
+
+func (h expiryHeap) Len() int            { return len(h) }
+func (h expiryHeap) Less(i, j int) bool  { return h[i].Header.Expiration < h[j].Header.Expiration }
+func (h expiryHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *expiryHeap) Push(x interface{}) { *h = append(*h, x.(*QMessage)) }
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	msg := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return msg
+}
+
+// expireAt keeps msg for the sweeper when it has an expiration, q.m must be held.
+func (q *queue) expireAt(msg *QMessage) {
+	if msg.Header.Expiration > 0 {
+		heap.Push(&q.expiring, msg)
+	}
+}
+
+// sweeper removes the expired messages every interval until the queue is closed.
+func (q *queue) sweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+			q.sendDeadLetters(q.sweep(time.Now()))
+		}
+	}
+}
+
+// sweep retires the expired messages waiting in the queue, returns those to dead-letter.
+func (q *queue) sweep(now time.Time) []deadLetter {
+	q.m.Lock()
+	defer q.m.Unlock()
+	due := q.expiredHeld
+	q.expiredHeld = nil
+	for len(q.expiring) > 0 && q.expiring[0].Expired(now) {
+		due = append(due, heap.Pop(&q.expiring).(*QMessage))
+	}
+	expired := 0
+	deadLetters := []deadLetter{}
+	for _, msg := range due {
+		if stored, ok := q.storage[msg.Id]; !ok || stored != msg {
+			continue
+		}
+		if !q.index.isReady(msg.Id) {
+			// swept again until it's back to the queue or gone
+			q.expiredHeld = append(q.expiredHeld, msg)
+			continue
+		}
+		expired++
+		if dl, _ := q.retire(msg, DEATH_REASON_EXPIRED); dl != nil {
+			deadLetters = append(deadLetters, *dl)
+			// back to the queue when its dead letter fails
+			q.expiredHeld = append(q.expiredHeld, msg)
+		}
+	}
+	if expired > 0 {
+		log.Println("[MQ] queue", q.name, "expired", expired, "messages")
+	}
+	return deadLetters
+}
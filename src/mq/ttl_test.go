@@ -0,0 +1,94 @@
+package mq
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueue_SweepExpired(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueueWithOptions("prices", QueueOptions{TTL: 60000, DeadLetter: "dead"}))
+	q, err := qc.GetQueue("PRICES")
+	assert.NoError(t, err)
+
+	stale := NewMessage("PRICES", []byte("stale"))
+	stale.SetTTL(time.Millisecond)
+	fresh := NewMessage("PRICES", []byte("fresh"))
+	assert.NoError(t, q.Publish(stale))
+	assert.NoError(t, q.Publish(fresh))
+	assert.NotZero(t, q.storage[fresh.Id].Header.Expiration)
+
+	time.Sleep(5 * time.Millisecond)
+	assert.Empty(t, q.sweep(time.Now()))
+	assert.Equal(t, []string{fresh.Id}, readyIds(q))
+	assert.Equal(t, 1, q.expired)
+
+	// past the queue TTL
+	assert.Empty(t, q.sweep(time.Now().Add(time.Minute)))
+	assert.Empty(t, readyIds(q))
+	_, err = qc.GetQueue("DEAD")
+	assert.Error(t, err)
+	assert.Empty(t, q.expiring, "swept entries are gone")
+
+	// a message held when it expires is swept once it's back
+	held := NewMessage("PRICES", []byte("held"))
+	held.SetTTL(20 * time.Millisecond)
+	assert.NoError(t, q.Publish(held))
+	_, err = q.Pull("1", 1, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, q.UnAck("1", held.Id))
+	time.Sleep(30 * time.Millisecond)
+	assert.Empty(t, q.sweep(time.Now()))
+	assert.Contains(t, q.storage, held.Id)
+	assert.NoError(t, q.Reject("1", held.Id, true))
+	assert.Empty(t, q.sweep(time.Now()))
+	assert.NotContains(t, q.storage, held.Id)
+	assert.Empty(t, q.expiredHeld)
+
+	// a queue without TTL has nothing to sweep
+	assert.NoError(t, qc.NewQueue("orders"))
+	orders, _ := qc.GetQueue("ORDERS")
+	publishAll(t, orders, 3)
+	assert.Empty(t, orders.expiring)
+}
+
+func TestQueue_DeadLetterExpired(t *testing.T) {
+	qc := testControl(t)
+	assert.NoError(t, qc.NewQueueWithOptions("prices", QueueOptions{DeadLetter: "dead", DeadLetterExpired: true}))
+	q, err := qc.GetQueue("PRICES")
+	assert.NoError(t, err)
+	msg := NewMessage("PRICES", []byte("stale"))
+	msg.SetTTL(time.Millisecond)
+	assert.NoError(t, q.Publish(msg))
+
+	// the dispatcher doesn't hand expired messages out
+	ch := deliveries(q)
+	time.Sleep(5 * time.Millisecond)
+	assert.NoError(t, q.RegisterConsumer(*NewConsumer(&testSession{id: 1})))
+	var dead *queue
+	if !assert.Eventually(t, func() bool { dead, err = qc.GetQueue("DEAD"); return err == nil }, 2*time.Second, 5*time.Millisecond) {
+		return
+	}
+	waitMessages(t, dead, 1)
+	waitMessages(t, q, 0)
+	assert.Len(t, ch, 0)
+	assert.Equal(t, DEATH_REASON_EXPIRED, dead.storage[readyIds(dead)[0]].Header.Headers[HEADER_DEATH_REASON])
+}
+
+func TestQueue_RecoverExpiration(t *testing.T) {
+	dir := t.TempDir()
+	q, err := openQueue("TEST", dir, &QueueOptions{TTL: 60000})
+	assert.NoError(t, err)
+	msg := NewMessage("TEST", []byte("data"))
+	assert.NoError(t, q.Publish(msg))
+	expiration := q.storage[msg.Id].Header.Expiration
+	assert.NoError(t, q.Close())
+
+	q2, err := openQueue("TEST", dir, nil)
+	assert.NoError(t, err)
+	defer q2.Close() // nolint
+	assert.Equal(t, int64(60000), q2.options.TTL)
+	assert.Equal(t, expiration, q2.storage[msg.Id].Header.Expiration)
+}
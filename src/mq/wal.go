@@ -0,0 +1,356 @@
+package mq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Queue storage is an append-only log split in segment files.
+Every queue owns a directory inside the data dir:
+
+	<DATA_DIR>/<QUEUE>/00000000000000000001.seg
+	<DATA_DIR>/<QUEUE>/00000000000000000002.seg
+
+Only the last segment (the active one) receives writes, the others are sealed.
+A publish writes the whole message once, any later state change writes a small
+status record pointing to the segment holding the message (its home segment).
+Each segment keeps track of how many of its bytes still belong to live messages,
+which is what compaction uses to decide when a sealed segment is worth rewriting.
+*/
+
+const segmentExt = ".seg"
+
+type segment struct {
+	id        uint64
+	path      string
+	size      int64
+	liveBytes int64
+	records   int
+	// state of the last compaction, see compactionCandidates
+	compacted     bool
+	compactedLive int64
+	compactedAt   int
+}
+
+// placement tells where the publish record of a live message is stored.
+type placement struct {
+	seg  *segment
+	size int64
+}
+
+// syncPolicy tells when appended records are flushed to disk,
+// see the DURABILITY_* modes.
+type syncPolicy struct {
+	mode     string
+	interval time.Duration
+	batch    int
+}
+
+// commit is the pending result of a group commit, nil when the write is already settled.
+type commit chan error
+
+// Wait blocks until the records covered by the commit are on disk.
+func (c commit) Wait() error {
+	if c == nil {
+		return nil
+	}
+	return <-c
+}
+
+type segmentLog struct {
+	dir      string
+	maxSize  int64
+	policy   syncPolicy
+	segments []*segment
+	active   *os.File
+	homes    map[string]placement
+	waiters  []commit    // appended but not synced yet, batch mode or while batching
+	batching int         // begin calls not ended yet
+	timer    *time.Timer // flushes waiters after policy.interval
+	stats    compactionStats
+	m        sync.Mutex
+}
+
+var errLogClosed = errors.New("queue log closed")
+
+func segmentPath(dir string, id uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%s", id, segmentExt))
+}
+
+// listSegments returns the ids of the segment files in dir, oldest first.
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ids := []uint64{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// openSegmentLog opens the log stored in dir, creating the directory when needed.
+// Existing segments are replayed oldest first and every valid record is passed to apply.
+// Writes always go to a fresh segment so sealed files are never appended again.
+func openSegmentLog(dir string, maxSize int64, policy syncPolicy, apply func(rec logRecord)) (*segmentLog, recoveryReport, error) {
+	report := recoveryReport{}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, report, err
+	}
+	if err := removeCompactionLeftovers(dir); err != nil {
+		return nil, report, err
+	}
+	ids, err := listSegments(dir)
+	if err != nil {
+		return nil, report, err
+	}
+	l := &segmentLog{
+		dir:      dir,
+		maxSize:  maxSize,
+		policy:   policy,
+		segments: []*segment{},
+		homes:    map[string]placement{},
+	}
+	for _, id := range ids {
+		seg := &segment{id: id, path: segmentPath(dir, id)}
+		if err := l.replaySegment(seg, apply, &report); err != nil {
+			return nil, report, err
+		}
+		if seg.size == 0 {
+			// left behind by a restart without writes
+			if err := os.Remove(seg.path); err != nil {
+				return nil, report, err
+			}
+			continue
+		}
+		report.Segments++
+		l.segments = append(l.segments, seg)
+	}
+	if err := l.roll(); err != nil {
+		return nil, report, err
+	}
+	return l, report, nil
+}
+
+func (l *segmentLog) activeSegment() *segment {
+	return l.segments[len(l.segments)-1]
+}
+
+// roll seals the active segment and starts a new one.
+func (l *segmentLog) roll() error {
+	var next uint64 = 1
+	if len(l.segments) > 0 {
+		next = l.activeSegment().id + 1
+	}
+	if l.active != nil {
+		if err := l.flushLocked(); err != nil {
+			return err
+		}
+		if err := l.active.Close(); err != nil {
+			return err
+		}
+		l.active = nil
+	}
+	path := segmentPath(l.dir, next)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	l.active = f
+	l.segments = append(l.segments, &segment{id: next, path: path})
+	return nil
+}
+
+// append writes one record to the active segment, rolling over first when
+// the record does not fit in it anymore. A failed write is cut off the segment,
+// the next records don't land after torn bytes.
+func (l *segmentLog) append(record []byte) (*segment, error) {
+	seg := l.activeSegment()
+	if seg.size > 0 && seg.size+int64(len(record)) > l.maxSize {
+		if err := l.roll(); err != nil {
+			return nil, err
+		}
+		seg = l.activeSegment()
+	}
+	if _, err := l.active.Write(record); err != nil {
+		if terr := l.active.Truncate(seg.size); terr != nil {
+			return nil, fmt.Errorf("%s, segment not truncated: %s", err, terr)
+		}
+		return nil, err
+	}
+	seg.size += int64(len(record))
+	seg.records++
+	return seg, nil
+}
+
+// Publish appends the full message to the log.
+func (l *segmentLog) Publish(msg *QMessage) (commit, error) {
+	if l == nil {
+		return nil, nil
+	}
+	// a record can't hold them, it would decode as garbage
+	if err := msg.CheckHeaders(); err != nil {
+		return nil, err
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	record := encodeRecord(recordPublish, encodePublishBody(msg))
+	seg, err := l.append(record)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(record))
+	seg.liveBytes += size
+	l.homes[msg.Id] = placement{seg: seg, size: size}
+	return l.settle()
+}
+
+// SetStatus appends a status change of a message already in the log.
+// Terminal statuses release the message, so its home segment loses liveness.
+func (l *segmentLog) SetStatus(msg *QMessage) (commit, error) {
+	if l == nil {
+		return nil, nil
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	home, ok := l.homes[msg.Id]
+	if !ok {
+		return nil, errors.New("QMessage not in log")
+	}
+	if _, err := l.append(encodeRecord(recordStatus, encodeStatusBody(msg, home.seg.id))); err != nil {
+		return nil, err
+	}
+	if isTerminalStatus(msg.Status) {
+		home.seg.liveBytes -= home.size
+		delete(l.homes, msg.Id)
+	}
+	return l.settle()
+}
+
+// settle applies the sync policy to the record just appended.
+// In batch mode the record joins the next group commit, which happens when
+// policy.batch records are waiting or policy.interval after the first one.
+func (l *segmentLog) settle() (commit, error) {
+	if l.batching > 0 && l.policy.mode != DURABILITY_NONE {
+		c := make(commit, 1)
+		l.waiters = append(l.waiters, c)
+		return c, nil
+	}
+	switch l.policy.mode {
+	case DURABILITY_ALWAYS:
+		return nil, l.flushLocked()
+	case DURABILITY_BATCH:
+		c := make(commit, 1)
+		l.waiters = append(l.waiters, c)
+		if len(l.waiters) >= l.policy.batch {
+			l.flushLocked() // nolint: the error goes to the waiters
+		} else if l.timer == nil {
+			l.timer = time.AfterFunc(l.policy.interval, l.flushTimer)
+		}
+		return c, nil
+	}
+	return nil, nil
+}
+
+// begin holds back the syncs of the records appended until end, which syncs them at once.
+// The queue lock comes first: begin and end are called with q.m held, so the holder of
+// a batch never waits for it.
+func (l *segmentLog) begin() {
+	if l == nil {
+		return
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.batching++
+}
+
+// end closes a begin, the last one syncs the records held back.
+func (l *segmentLog) end() {
+	if l == nil {
+		return
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.batching--
+	if l.batching == 0 && len(l.waiters) > 0 {
+		l.flushLocked() // nolint: the error goes to the waiters
+	}
+}
+
+func (l *segmentLog) flushTimer() {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.timer = nil
+	l.flushLocked() // nolint: the error goes to the waiters
+}
+
+// flushLocked syncs the active segment and releases the waiting commits.
+func (l *segmentLog) flushLocked() error {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	err := errLogClosed
+	if l.active != nil {
+		err = l.active.Sync()
+	}
+	for _, c := range l.waiters {
+		c <- err
+	}
+	l.waiters = nil
+	return err
+}
+
+// Sync flushes the active segment to disk.
+func (l *segmentLog) Sync() error {
+	if l == nil {
+		return nil
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.active == nil {
+		return nil
+	}
+	return l.flushLocked()
+}
+
+// Close syncs and closes the active segment.
+func (l *segmentLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.m.Lock()
+	defer l.m.Unlock()
+	if l.active == nil {
+		return nil
+	}
+	err := l.flushLocked()
+	if errClose := l.active.Close(); err == nil {
+		err = errClose
+	}
+	l.active = nil
+	return err
+}
+
+func isTerminalStatus(status int) bool {
+	return status == STATUS_MESSAGE_ACK || status == STATUS_MESSAGE_REJECTED || status == STATUS_MESSAGE_EXPIRED ||
+		status == STATUS_MESSAGE_PURGED
+}
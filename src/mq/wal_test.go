@@ -0,0 +1,149 @@
+package mq
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSegmentLog_RollOver(t *testing.T) {
+	dir := t.TempDir()
+	l, _, err := openSegmentLog(dir, 256, syncPolicy{}, func(logRecord) {})
+	assert.NoError(t, err)
+	defer l.Close() // nolint
+
+	for i := 0; i < 10; i++ {
+		msg := NewMessage("TEST", []byte(fmt.Sprintf("payload-%02d-%040d", i, i)))
+		_, err := l.Publish(&msg)
+		assert.NoError(t, err)
+	}
+	ids, err := listSegments(dir)
+	assert.NoError(t, err)
+	assert.Greater(t, len(ids), 1)
+	assert.Len(t, l.segments, len(ids))
+	for _, seg := range l.segments {
+		assert.LessOrEqual(t, seg.size, int64(256))
+	}
+}
+
+func TestSegmentLog_Liveness(t *testing.T) {
+	l, _, err := openSegmentLog(t.TempDir(), 1024*1024, syncPolicy{}, func(logRecord) {})
+	assert.NoError(t, err)
+	defer l.Close() // nolint
+
+	msgs := []QMessage{}
+	for i := 0; i < 4; i++ {
+		msg := NewMessage("TEST", []byte("data"))
+		_, err := l.Publish(&msg)
+		assert.NoError(t, err)
+		msgs = append(msgs, msg)
+	}
+	seg := l.activeSegment()
+	assert.Equal(t, seg.size, seg.liveBytes)
+
+	msgs[0].Status = STATUS_MESSAGE_UNACK
+	_, err = l.SetStatus(&msgs[0])
+	assert.NoError(t, err)
+	msgs[1].Status = STATUS_MESSAGE_ACK
+	_, err = l.SetStatus(&msgs[1])
+	assert.NoError(t, err)
+	msgs[2].Status = STATUS_MESSAGE_REJECTED
+	_, err = l.SetStatus(&msgs[2])
+	assert.NoError(t, err)
+
+	assert.Equal(t, 7, seg.records)
+	assert.Equal(t, 2*l.homes[msgs[0].Id].size, seg.liveBytes)
+	_, err = l.SetStatus(&msgs[1])
+	assert.Error(t, err)
+}
+
+func TestSegmentLog_GroupCommit(t *testing.T) {
+	l, _, err := openSegmentLog(t.TempDir(), 1024*1024, syncPolicy{mode: DURABILITY_BATCH, interval: time.Hour, batch: 3}, func(logRecord) {})
+	assert.NoError(t, err)
+	defer l.Close() // nolint
+
+	commits := []commit{}
+	for i := 0; i < 3; i++ {
+		msg := NewMessage("TEST", []byte("data"))
+		c, err := l.Publish(&msg)
+		assert.NoError(t, err)
+		assert.NotNil(t, c)
+		commits = append(commits, c)
+		if i < 2 {
+			assert.Len(t, l.waiters, i+1)
+			assert.NotNil(t, l.timer)
+		}
+	}
+	assert.Empty(t, l.waiters)
+	assert.Nil(t, l.timer)
+	for _, c := range commits {
+		assert.NoError(t, c.Wait())
+	}
+
+	l.policy.interval = time.Millisecond
+	msg := NewMessage("TEST", []byte("data"))
+	c, err := l.Publish(&msg)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Wait())
+}
+
+func TestSegmentLog_BeginEnd(t *testing.T) {
+	l, _, err := openSegmentLog(t.TempDir(), 1024*1024, syncPolicy{mode: DURABILITY_ALWAYS}, func(logRecord) {})
+	assert.NoError(t, err)
+	defer l.Close() // nolint
+
+	l.begin()
+	l.begin()
+	commits := []commit{}
+	for i := 0; i < 3; i++ {
+		msg := NewMessage("TEST", []byte("data"))
+		c, err := l.Publish(&msg)
+		assert.NoError(t, err)
+		assert.NotNil(t, c, "held back")
+		commits = append(commits, c)
+	}
+	l.end()
+	assert.Len(t, l.waiters, 3, "until the last end")
+	l.end()
+	assert.Empty(t, l.waiters)
+	for _, c := range commits {
+		assert.NoError(t, c.Wait())
+	}
+
+	msg := NewMessage("TEST", []byte("data"))
+	c, err := l.Publish(&msg)
+	assert.NoError(t, err)
+	assert.Nil(t, c)
+}
+
+func TestSegmentLog_SyncModes(t *testing.T) {
+	for _, mode := range []string{DURABILITY_ALWAYS, DURABILITY_NONE} {
+		l, _, err := openSegmentLog(t.TempDir(), 1024*1024, syncPolicy{mode: mode}, func(logRecord) {})
+		assert.NoError(t, err)
+		msg := NewMessage("TEST", []byte("data"))
+		c, err := l.Publish(&msg)
+		assert.NoError(t, err)
+		assert.Nil(t, c)
+		assert.Empty(t, l.waiters)
+		assert.NoError(t, l.Close())
+	}
+}
+
+func TestQueue_OptionsStored(t *testing.T) {
+	dir := t.TempDir()
+	opts := QueueOptions{Durability: DURABILITY_ALWAYS}
+	q, err := openQueue("AUDIT", dir, &opts)
+	assert.NoError(t, err)
+	assert.NoError(t, q.Close())
+
+	q2, err := openQueue("AUDIT", dir, nil)
+	assert.NoError(t, err)
+	defer q2.Close() // nolint
+	assert.Equal(t, DURABILITY_ALWAYS, q2.options.Durability)
+	assert.Equal(t, DefaultQueueOptions().SyncBatch, q2.options.SyncBatch)
+
+	_, err = openQueue("BAD", t.TempDir(), &QueueOptions{Durability: "sometimes"})
+	assert.Error(t, err)
+}
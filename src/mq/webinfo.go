@@ -2,6 +2,7 @@ package mq
 
 import (
 	"runtime"
+	"sort"
 	"strconv"
 )
 
@@ -15,23 +16,35 @@ type serverInfo struct {
 }
 
 type consumerInfo struct {
-	Ip     string `json:"ip"`
-	Status string `json:"status"`
+	Ip       string `json:"ip"`
+	Status   string `json:"status"`
+	Prefetch int    `json:"prefetch"`
+	InFlight int    `json:"in_flight"`
 }
 
 type QueueInfo struct {
-	Name             string         `json:"name"`
-	TotalMessages    int            `json:"total_messages"`
-	AckMessages      int            `json:"ack_messages"`
-	UnAckMessages    int            `json:"un_ack_messages"`
-	RejectedMessages int            `json:"rejected_messages"`
-	Consumers        []consumerInfo `json:"consumers"`
-	MemorySize       uintptr        `json:"memory_size"`
+	Name             string           `json:"name"`
+	TotalMessages    int              `json:"total_messages"`
+	AckMessages      int              `json:"ack_messages"`
+	UnAckMessages    int              `json:"un_ack_messages"`
+	RejectedMessages int              `json:"rejected_messages"`
+	Redelivered      int              `json:"redelivered_messages"` // pending messages distributed more than once
+	MaxDeliveries    int              `json:"max_delivery_count"`   // highest delivery count of a pending message
+	ExpiredMessages  int              `json:"expired_messages"`     // messages expired since startup
+	Scheduled        int              `json:"scheduled_messages"`   // messages waiting for their delivery time
+	Bytes            int64            `json:"bytes"`                // data size of the stored messages
+	DroppedMessages  int              `json:"dropped_messages"`     // messages dropped by overflows since startup
+	Options          QueueOptions     `json:"options"`
+	Consumers        []consumerInfo   `json:"consumers"`
+	MemorySize       uintptr          `json:"memory_size"`
+	Storage          logStats         `json:"storage"`
+	Transactions     TransactionStats `json:"transactions"`
 }
 
 type webInfo struct {
 	serverInfo `json:"serverInfo"`
 	Queues     map[string]QueueInfo `json:"queues"`
+	Exchanges  []exchange           `json:"exchanges"`
 }
 
 func bToMb(b uint64) uint64 {
@@ -50,32 +63,113 @@ func (qc *queuesControl) ServerInfo() webInfo {
 		MemorySys:    m.Sys,
 		MemoryGc:     uint64(m.NumGC),
 	}
-	qq := make(map[string]QueueInfo)
+	qc.m.Lock()
+	queues := make([]*queue, 0, len(qc.queues))
 	for _, q := range qc.queues {
-		consumersInfo := make([]consumerInfo, 0)
-		for _, con := range q.consumers {
-			ci := consumerInfo{
-				Ip:     con.session.Conn().RemoteAddr().String(),
-				Status: strconv.Itoa(con.status),
-			}
-			if ci.Ip != "" {
-				consumersInfo = append(consumersInfo, ci)
-			}
-
-		}
+		queues = append(queues, q)
+	}
+	qc.m.Unlock()
+	qq := make(map[string]QueueInfo)
+	for _, q := range queues {
+		total, memory := q.storageCounts()
+		redelivered, maxDeliveries, expired := q.deliveryCounts()
+		size, dropped := q.limitCounts()
+		acked, nacked, rejected, transactions := q.transactionCounts()
 		qq[q.name] = QueueInfo{
 			Name:             q.name,
-			TotalMessages:    q.TotalMesssages(),
-			AckMessages:      0,
-			UnAckMessages:    0,
-			RejectedMessages: 0,
-			Consumers:        consumersInfo,
-			MemorySize:       uintptr(q.GetStorageByteSize()),
+			TotalMessages:    total,
+			AckMessages:      acked,
+			UnAckMessages:    nacked,
+			RejectedMessages: rejected,
+			Redelivered:      redelivered,
+			MaxDeliveries:    maxDeliveries,
+			ExpiredMessages:  expired,
+			Scheduled:        q.TotalScheduled(),
+			Bytes:            size,
+			DroppedMessages:  dropped,
+			Options:          q.options,
+			Consumers:        q.consumerInfo(),
+			MemorySize:       uintptr(memory),
+			Storage:          q.log.Stats(),
+			Transactions:     transactions,
 		}
 	}
 	wi := webInfo{
 		serverInfo: si,
 		Queues:     qq,
+		Exchanges:  qc.exchangeInfo(),
 	}
 	return wi
 }
+
+// exchangeInfo returns a copy of the exchanges sorted by name.
+func (qc *queuesControl) exchangeInfo() []exchange {
+	qc.m.Lock()
+	defer qc.m.Unlock()
+	exchanges := make([]exchange, 0, len(qc.exchanges))
+	for _, e := range qc.exchanges {
+		copied := *e
+		copied.Bindings = append([]binding{}, e.Bindings...)
+		exchanges = append(exchanges, copied)
+	}
+	sort.Slice(exchanges, func(i, j int) bool { return exchanges[i].Name < exchanges[j].Name })
+	return exchanges
+}
+
+// consumerInfo describes the consumers of the queue.
+func (q *queue) consumerInfo() []consumerInfo {
+	q.m.Lock()
+	defer q.m.Unlock()
+	consumersInfo := make([]consumerInfo, 0)
+	for _, con := range q.consumers {
+		ci := consumerInfo{
+			Ip:       con.session.Conn().RemoteAddr().String(),
+			Status:   strconv.Itoa(con.status),
+			Prefetch: con.prefetch,
+			InFlight: len(con.inFlight),
+		}
+		if ci.Ip != "" {
+			consumersInfo = append(consumersInfo, ci)
+		}
+	}
+	return consumersInfo
+}
+
+// storageCounts returns how many messages are ready or in flight and their memory size.
+func (q *queue) storageCounts() (int, int64) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.TotalMesssages(), q.GetStorageByteSize()
+}
+
+// deliveryCounts returns how many pending messages were redelivered, the highest delivery count
+// and how many messages expired.
+func (q *queue) deliveryCounts() (int, int, int) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	redelivered, max := 0, 0
+	for _, msg := range q.storage {
+		if msg.Redelivered() {
+			redelivered++
+		}
+		if msg.DeliveryCount > max {
+			max = msg.DeliveryCount
+		}
+	}
+	return redelivered, max, q.expired
+}
+
+// transactionCounts returns how many deliveries were acked, are nacked and were rejected,
+// and the transaction counters.
+func (q *queue) transactionCounts() (int, int, int, TransactionStats) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.tm.acked, q.tm.nacked(), q.tm.rejected, q.tm.stats()
+}
+
+// limitCounts returns the data size of the queue and how many messages overflows dropped.
+func (q *queue) limitCounts() (int64, int) {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.bytes, q.dropped
+}
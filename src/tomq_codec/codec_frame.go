@@ -0,0 +1,274 @@
+package tomq_codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+/*
+A frame is a length-prefixed binary payload, integers are big endian:
+
+	[1]byte marker 0x00 | [1]byte version | fields...
+
+The marker can't start a text payload, so framed and legacy text requests
+can share an opcode. Each message type writes its fields in a fixed order:
+
+	uint8, uint16, uint32, uint64  fixed size
+	bool                           [1]byte 0 or 1
+	string                         [2]byte length | bytes
+	bytes                          [4]byte length | bytes
+	map                            [2]byte count | (string key | string value)... sorted by key
+	count                          [2]byte, of the fields repeated after it
+
+A string, map or count over FrameMaxCount, or bytes over 4GiB, fails the encoding
+with ErrFrameTooLong instead of writing a frame the reader would misread.
+
+A later version only appends fields: readers ignore what follows the fields they
+know and check FrameReader.Version before reading the fields added by a version.
+*/
+
+const (
+	FrameMarker  byte = 0x00
+	FrameVersion byte = 1
+
+	// FrameMaxCount bounds the string lengths, the map sizes and the counts.
+	FrameMaxCount = math.MaxUint16
+)
+
+var (
+	// ErrNotFramed is returned by Decode for a payload without the frame marker.
+	ErrNotFramed = errors.New("payload is not a frame")
+	// ErrFrameTruncated is returned for a frame shorter than its fields.
+	ErrFrameTruncated = errors.New("frame truncated")
+	// ErrFrameTooLong is returned by Encode for a field over its length prefix.
+	ErrFrameTooLong = errors.New("frame field too long")
+)
+
+// FrameEncoder is implemented by the values FrameCodec encodes.
+type FrameEncoder interface {
+	EncodeFrame(w *FrameWriter)
+}
+
+// FrameDecoder is implemented by the values FrameCodec decodes into.
+type FrameDecoder interface {
+	DecodeFrame(r *FrameReader)
+}
+
+var _ Codec = &FrameCodec{}
+
+// FrameCodec implements the Codec interface with versioned binary frames.
+type FrameCodec struct{}
+
+// IsFrame tells if data starts like a frame.
+func IsFrame(data []byte) bool {
+	return len(data) > 0 && data[0] == FrameMarker
+}
+
+// Encode implements the Codec Encode method.
+func (f *FrameCodec) Encode(v interface{}) ([]byte, error) {
+	e, ok := v.(FrameEncoder)
+	if !ok {
+		return nil, fmt.Errorf("v should be FrameEncoder but %T", v)
+	}
+	w := FrameWriter{buf: []byte{FrameMarker, FrameVersion}}
+	e.EncodeFrame(&w)
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w.buf, nil
+}
+
+// Decode implements the Codec Decode method.
+func (f *FrameCodec) Decode(data []byte, v interface{}) error {
+	d, ok := v.(FrameDecoder)
+	if !ok {
+		return fmt.Errorf("v should be FrameDecoder but %T", v)
+	}
+	if !IsFrame(data) {
+		return ErrNotFramed
+	}
+	if len(data) < 2 {
+		return ErrFrameTruncated
+	}
+	if data[1] == 0 {
+		return errors.New("bad frame version 0")
+	}
+	r := FrameReader{buf: data, pos: 2, Version: data[1]}
+	d.DecodeFrame(&r)
+	return r.err
+}
+
+// FrameWriter appends the fields of a frame.
+// The first field too long is kept and every following write is dropped.
+type FrameWriter struct {
+	buf []byte
+	err error
+}
+
+// fits records ErrFrameTooLong when n is over max.
+func (w *FrameWriter) fits(n int, max uint64, field string) bool {
+	if w.err == nil && uint64(n) > max {
+		w.err = fmt.Errorf("%w: %s of %d", ErrFrameTooLong, field, n)
+	}
+	return w.err == nil
+}
+
+func (w *FrameWriter) Uint8(v byte) {
+	w.buf = append(w.buf, v)
+}
+
+func (w *FrameWriter) Uint16(v uint16) {
+	w.buf = append(w.buf, 0, 0)
+	binary.BigEndian.PutUint16(w.buf[len(w.buf)-2:], v)
+}
+
+func (w *FrameWriter) Uint32(v uint32) {
+	w.buf = append(w.buf, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(w.buf[len(w.buf)-4:], v)
+}
+
+func (w *FrameWriter) Uint64(v uint64) {
+	w.buf = append(w.buf, 0, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(w.buf[len(w.buf)-8:], v)
+}
+
+func (w *FrameWriter) Bool(v bool) {
+	if v {
+		w.Uint8(1)
+	} else {
+		w.Uint8(0)
+	}
+}
+
+func (w *FrameWriter) String(s string) {
+	if !w.fits(len(s), FrameMaxCount, "string") {
+		return
+	}
+	w.Uint16(uint16(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *FrameWriter) Bytes(b []byte) {
+	if !w.fits(len(b), math.MaxUint32, "bytes") {
+		return
+	}
+	w.Uint32(uint32(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+// Count writes how many times the fields which follow are repeated.
+func (w *FrameWriter) Count(n int) {
+	if w.fits(n, FrameMaxCount, "count") {
+		w.Uint16(uint16(n))
+	}
+}
+
+func (w *FrameWriter) Map(m map[string]string) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if !w.fits(len(keys), FrameMaxCount, "map") {
+		return
+	}
+	w.Uint16(uint16(len(keys)))
+	for _, k := range keys {
+		w.String(k)
+		w.String(m[k])
+	}
+}
+
+// Err returns the first field too long met while writing.
+func (w *FrameWriter) Err() error {
+	return w.err
+}
+
+// FrameReader reads the fields written by FrameWriter.
+// The first short read is kept and every following read returns zero values.
+type FrameReader struct {
+	Version byte
+	buf     []byte
+	pos     int
+	err     error
+}
+
+func (r *FrameReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf)-r.pos < n {
+		r.err = ErrFrameTruncated
+		return nil
+	}
+	b := r.buf[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *FrameReader) Uint8() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *FrameReader) Uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *FrameReader) Uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *FrameReader) Uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *FrameReader) Bool() bool {
+	return r.Uint8() != 0
+}
+
+func (r *FrameReader) String() string {
+	return string(r.next(int(r.Uint16())))
+}
+
+func (r *FrameReader) Bytes() []byte {
+	b := r.next(int(r.Uint32()))
+	if b == nil {
+		return nil
+	}
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
+
+func (r *FrameReader) Map() map[string]string {
+	count := int(r.Uint16())
+	if count == 0 || r.err != nil {
+		return nil
+	}
+	m := make(map[string]string, count)
+	for i := 0; i < count && r.err == nil; i++ {
+		k := r.String()
+		m[k] = r.String()
+	}
+	return m
+}
+
+// Err returns the first error met while reading.
+func (r *FrameReader) Err() error {
+	return r.err
+}
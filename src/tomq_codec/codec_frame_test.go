@@ -0,0 +1,105 @@
+package tomq_codec
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type frameSample struct {
+	Name    string
+	Payload []byte
+	Count   uint32
+	Tags    map[string]string
+}
+
+func (s *frameSample) EncodeFrame(w *FrameWriter) {
+	w.String(s.Name)
+	w.Bytes(s.Payload)
+	w.Uint32(s.Count)
+	w.Map(s.Tags)
+}
+
+func (s *frameSample) DecodeFrame(r *FrameReader) {
+	s.Name = r.String()
+	s.Payload = r.Bytes()
+	s.Count = r.Uint32()
+	s.Tags = r.Map()
+}
+
+func TestFrameCodec(t *testing.T) {
+	c := &FrameCodec{}
+	item := &frameSample{Name: "name", Payload: []byte("with spaces"), Count: 3, Tags: map[string]string{"a": "1", "b": "2"}}
+	t.Run("when encode/decode with invalid params", func(t *testing.T) {
+		b, err := c.Encode(123)
+		assert.Error(t, err)
+		assert.Nil(t, b)
+
+		var v int
+		assert.Error(t, c.Decode([]byte{FrameMarker, FrameVersion}, &v))
+	})
+	t.Run("when the payload is text", func(t *testing.T) {
+		assert.False(t, IsFrame([]byte("GENERAL data")))
+		assert.Equal(t, ErrNotFramed, c.Decode([]byte("GENERAL data"), &frameSample{}))
+	})
+	t.Run("when the frame is truncated", func(t *testing.T) {
+		b, err := c.Encode(item)
+		assert.NoError(t, err)
+		for n := 1; n < len(b); n++ {
+			assert.Equal(t, ErrFrameTruncated, c.Decode(b[:n], &frameSample{}), "cut at %d", n)
+		}
+	})
+	t.Run("when the version is 0", func(t *testing.T) {
+		b, err := c.Encode(item)
+		assert.NoError(t, err)
+		b[1] = 0
+		assert.Error(t, c.Decode(b, &frameSample{}))
+	})
+	t.Run("when a later version appended fields", func(t *testing.T) {
+		b, err := c.Encode(item)
+		assert.NoError(t, err)
+		b[1] = FrameVersion + 1
+		w := FrameWriter{buf: b}
+		w.String("unknown")
+		w.Uint64(7)
+
+		itemDec := &frameSample{}
+		assert.NoError(t, c.Decode(w.buf, itemDec))
+		assert.Equal(t, item, itemDec)
+	})
+	t.Run("when succeed", func(t *testing.T) {
+		b, err := c.Encode(item)
+		assert.NoError(t, err)
+		assert.True(t, IsFrame(b))
+
+		itemDec := &frameSample{}
+		assert.NoError(t, c.Decode(b, itemDec))
+		assert.Equal(t, item, itemDec)
+	})
+}
+
+func TestFrameWriter_TooLong(t *testing.T) {
+	c := &FrameCodec{}
+	long := string(make([]byte, FrameMaxCount+1))
+	tags := map[string]string{}
+	for i := 0; i <= FrameMaxCount; i++ {
+		tags[fmt.Sprint(i)] = ""
+	}
+	for name, item := range map[string]*frameSample{
+		"string":    {Name: long},
+		"map key":   {Tags: map[string]string{long: "1"}},
+		"map value": {Tags: map[string]string{"a": long}},
+		"map":       {Tags: tags},
+	} {
+		b, err := c.Encode(item)
+		assert.ErrorIs(t, err, ErrFrameTooLong, name)
+		assert.Nil(t, b, name)
+	}
+
+	w := FrameWriter{}
+	w.Count(FrameMaxCount)
+	assert.NoError(t, w.Err())
+	w.Count(FrameMaxCount + 1)
+	assert.ErrorIs(t, w.Err(), ErrFrameTooLong)
+}
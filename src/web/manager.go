@@ -3,6 +3,7 @@ package web
 import (
 	// GIN
 	"net/http"
+	"strconv"
 	"tomqserver/src/mq"
 
 	"github.com/gin-gonic/gin"
@@ -15,17 +16,68 @@ func TaskQueue(c *gin.Context) {
 	c.IndentedJSON(http.StatusOK, res)
 }
 
-func RegisterAll(router gin.Engine) {
+// DeleteQueue removes a queue, if_empty=true and if_unused=true keep it when it has messages or consumers.
+func DeleteQueue(c *gin.Context) {
+	err := qc.Delete(c.Param("queue"), c.Query("if_empty") == "true", c.Query("if_unused") == "true")
+	switch err {
+	case nil:
+		c.IndentedJSON(http.StatusOK, gin.H{"deleted": c.Param("queue")})
+	case mq.ErrNoQueue:
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case mq.ErrQueueNotEmpty, mq.ErrQueueInUse:
+		c.IndentedJSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// PeekQueue shows the next messages of a queue with their properties and headers,
+// limit=N sets how many, 20 by default.
+func PeekQueue(c *gin.Context) {
+	limit := 20
+	if v := c.Query("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			c.IndentedJSON(http.StatusBadRequest, gin.H{"error": "bad limit"})
+			return
+		}
+		limit = n
+	}
+	q, err := qc.GetQueue(c.Param("queue"))
+	if err != nil {
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.IndentedJSON(http.StatusOK, q.Peek(limit))
+}
+
+// PurgeQueue drops the ready messages of a queue.
+func PurgeQueue(c *gin.Context) {
+	count, err := qc.Purge(c.Param("queue"))
+	switch err {
+	case nil:
+		c.IndentedJSON(http.StatusOK, gin.H{"purged": count})
+	case mq.ErrNoQueue:
+		c.IndentedJSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	default:
+		c.IndentedJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func RegisterAll(router *gin.Engine) {
 	// watch queue
 	router.GET("/qc", TaskQueue)
+	router.DELETE("/qc/:queue", DeleteQueue)
+	router.GET("/qc/:queue/messages", PeekQueue)
+	router.POST("/qc/:queue/purge", PurgeQueue)
 }
 
-func Serve(control *mq.QueuesControl) {
+func Serve(control *mq.QueuesControl, addr string) {
 	qc = *control
 	// default router
 	router := gin.Default()
 	// api blueprint
-	RegisterAll(*router)
+	RegisterAll(router)
 	// vrum vrum
-	router.Run("localhost:15896")
+	router.Run(addr)
 }
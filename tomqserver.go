@@ -1,13 +1,18 @@
 package main
 
 import (
-	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"os"
+	"strconv"
 	"sync"
 	"time"
+	"tomqserver/config"
 	"tomqserver/src/mq"
 	easytcp "tomqserver/src/server"
+	"tomqserver/src/tomq_codec"
 	"tomqserver/src/web"
 )
 
@@ -16,10 +21,11 @@ var sessions *SessionManager
 var qc mq.QueuesControl
 
 func init() {
-	qc = mq.InitQueuesControl()
 	sessions = &SessionManager{
 		nextId:  1,
 		storage: map[int64]easytcp.Session{},
+		framed:  map[int64]bool{},
+		confirm: map[int64]uint64{},
 	}
 }
 
@@ -27,27 +33,115 @@ type SessionManager struct {
 	nextId  int64
 	lock    sync.Mutex
 	storage map[int64]easytcp.Session
+	framed  map[int64]bool   // sessions which sent framed requests
+	confirm map[int64]uint64 // last publish sequence number of the sessions in confirm mode
+}
+
+// setFramed remembers that sess speaks framed payloads.
+func (sm *SessionManager) setFramed(sess easytcp.Session) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	sm.framed[sess.ID().(int64)] = true
+}
+
+// setConfirm turns the confirm mode of sess on or off.
+func (sm *SessionManager) setConfirm(sess easytcp.Session, on bool) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	id := sess.ID().(int64)
+	if _, ok := sm.confirm[id]; ok && on {
+		return
+	}
+	if on {
+		sm.confirm[id] = 0
+	} else {
+		delete(sm.confirm, id)
+	}
+}
+
+// nextSeq returns the sequence number of the next publish of sess,
+// false when it's not in confirm mode.
+func (sm *SessionManager) nextSeq(sess easytcp.Session) (uint64, bool) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	id := sess.ID().(int64)
+	seq, ok := sm.confirm[id]
+	if !ok {
+		return 0, false
+	}
+	seq++
+	sm.confirm[id] = seq
+	return seq, true
+}
+
+// confirming tells if sess is in confirm mode.
+func (sm *SessionManager) confirming(sess easytcp.Session) bool {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	_, ok := sm.confirm[sess.ID().(int64)]
+	return ok
+}
+
+// isFramed tells if sess sent framed requests.
+func (sm *SessionManager) isFramed(sess easytcp.Session) bool {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	return sm.framed[sess.ID().(int64)]
 }
 
 func main() {
+	cfg, err := config.Load(os.Args[0], os.Args[1:], os.Stderr)
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatalln("config error:", err)
+	}
+	config.Set(cfg)
+	qc = mq.InitQueuesControl()
 
 	// Create a new server with options.
 	s := easytcp.NewServer(&easytcp.ServerOption{
-		Packer: easytcp.NewDefaultPacker(), // use default packer
-		Codec:  nil,                        // don't use codec
+		SocketReadBufferSize:  cfg.Server.SocketReadBufferSize,
+		SocketWriteBufferSize: cfg.Server.SocketWriteBufferSize,
+		SocketSendDelay:       cfg.Server.SocketSendDelay,
+		ReadTimeout:           cfg.Server.ReadTimeout,
+		WriteTimeout:          cfg.Server.WriteTimeout,
+		RespQueueSize:         cfg.Server.RespQueueSize,
+		DoNotPrintRoutes:      cfg.Server.DoNotPrintRoutes,
+		WriteAttemptTimes:     cfg.Server.WriteAttemptTimes,
+		AsyncRouter:           cfg.Server.AsyncRouter,
+		Packer:                easytcp.NewDefaultPacker(), // use default packer
+		Codec:                 &tomq_codec.FrameCodec{},   // framed payloads, text ones are parsed by the handlers
 	})
 	qc.SetServerInstance(s)
 
-	err := qc.NewQueue("general")
+	err = qc.NewQueue("general")
 	if err != nil {
 		log.Println("error on second")
 	}
 
 	s.AddRoute(ConsumerRegisterTcpReq, RegisterConsumer)
 	s.AddRoute(MsgPublishTcpReq, PublishMsg)
+	s.AddRoute(ConsumerPublisherTcpReq, RegisterPublisher)
 	s.AddRoute(MsgAckTcpReq, AckMessage)
 	s.AddRoute(MsgNAckTcpReq, NAckMessage)
 	s.AddRoute(MsgRejectTcpReq, RejectMessage)
+	s.AddRoute(MsgDistributeTcpAck, DistributeReceived)
+	s.AddRoute(MsgPublishBatchTcpReq, PublishBatch)
+	s.AddRoute(MsgAckBatchTcpReq, AckBatch)
+	s.AddRoute(TxOpenTcpReq, TxOpen)
+	s.AddRoute(TxCommitTcpReq, TxCommit)
+	s.AddRoute(TxRollbackTcpReq, TxRollback)
+	s.AddRoute(ConsumerCreditTcpReq, ConsumerCredit)
+	s.AddRoute(MsgNextTcpReq, NextMessage)
+	s.AddRoute(ChannelCreateTcpReq, DeclareQueue)
+	s.AddRoute(ChannelDeleteTcpReq, DeleteQueue)
+	s.AddRoute(ChannelPurgeTcpReq, PurgeQueue)
+	s.AddRoute(ExchangeDeclareTcpReq, DeclareExchange)
+	s.AddRoute(ExchangeDeleteTcpReq, DeleteExchange)
+	s.AddRoute(ExchangeBindTcpReq, BindQueue)
+	s.AddRoute(ExchangeUnbindTcpReq, UnbindQueue)
 
 	s.OnSessionCreate = func(sess easytcp.Session) {
 		// store session
@@ -60,154 +154,522 @@ func main() {
 
 	s.OnSessionClose = func(sess easytcp.Session) {
 		// remove session
+		sessions.lock.Lock()
 		delete(sessions.storage, sess.ID().(int64))
+		delete(sessions.framed, sess.ID().(int64))
+		delete(sessions.confirm, sess.ID().(int64))
+		sessions.lock.Unlock()
 		qc.UnregisterConsumer(fmt.Sprint(sess.ID()))
 	}
 
-	go Distribute()
-	go web.Serve(&qc)
+	qc.SetDeliveryHandler(deliverMessage)
+	qc.SetCancelHandler(cancelConsumer)
+	go web.Serve(&qc, cfg.WebAddr)
 
 	// Listen and serve.
-	if err := s.Serve(":5896"); err != nil && err != easytcp.ErrServerStopped {
+	if err := s.Serve(cfg.Addr); err != nil && err != easytcp.ErrServerStopped {
 		fmt.Println("serve error: ", err.Error())
 	}
 
 }
 
-func Distribute() {
-	fmt.Println("Starting distribution")
-	// wait for server
-	time.Sleep(5000 * time.Millisecond)
-	for {
-		for _, queueName := range qc.List() {
-			//fmt.Println("Checking queue", queueName)
-			queue, err := qc.GetQueue(queueName)
-			if err != nil {
-				continue
-			}
-			queue.CheckDistributeTime()
-
-			for _, consumer := range queue.ListConsumers() {
-				msg, err2 := queue.GetQMessage()
-				if err2 != nil {
-					continue
-				}
-				//fmt.Println("found message", msg.Data)
-				if consumer.Status() == mq.CONSUMER_STATUS_IDLE {
-					respMsg := easytcp.NewTcpMessage(MsgDistributeTcpReq, msg.TcpData())
-					targetSession := consumer.Session()
-					msg.SetDistributed()
-					go func() {
-						fmt.Println("SENDING TO CONSUMER", targetSession.ID(), string(respMsg.Data()))
-						targetSession.AllocateContext().SetResponseTcpMessage(respMsg).Send()
-					}()
-					queue.UpdateConsumer(fmt.Sprint(consumer.Session().ID()), mq.CONSUMER_STATUS_WAITING_NACK)
-					continue
-				}
-			}
+// deliverMessage sends a message distributed by a queue to its consumer.
+func deliverMessage(sess easytcp.Session, msg mq.QMessage) bool {
+	ctx := sess.AllocateContext()
+	if sessions.isFramed(sess) {
+		if err := ctx.SetResponse(MsgDistributeTcpReq, newDistribute(msg)); err != nil {
+			log.Println("[server] distribute encoding failed:", err)
+			return false
 		}
-		time.Sleep(300 * time.Millisecond)
+	} else {
+		ctx.SetResponseTcpMessage(easytcp.NewTcpMessage(MsgDistributeTcpReq, msg.TcpData()))
 	}
+	return ctx.Send()
 }
 
-func RegisterConsumer(c easytcp.Context) {
-	// acquire request
-	req := c.Request()
+// sendConfirm tells a publisher in confirm mode its publish seq is stored as message id,
+// or why it's not when err is set.
+func sendConfirm(sess easytcp.Session, framed bool, seq uint64, id string, err error) {
+	ctx := sess.AllocateContext()
+	if framed {
+		confirm := &Confirm{Seq: seq, Code: errorCode(err), Value: id}
+		if err != nil {
+			confirm.Value = err.Error()
+		}
+		if err := ctx.SetResponse(MsgPublishTcpAck, confirm); err != nil {
+			log.Println("[server] confirm encoding failed:", err)
+			return
+		}
+	} else {
+		data := fmt.Sprintf("%d ack %s", seq, id)
+		if err != nil {
+			data = fmt.Sprintf("%d nack %s", seq, err)
+		}
+		ctx.SetResponseTcpMessage(easytcp.NewTcpMessage(MsgPublishTcpAck, []byte(data)))
+	}
+	if !ctx.Send() {
+		log.Println("[server] confirm", seq, "of session", sess.ID(), "not sent")
+	}
+}
 
-	// do things...
+// cancelConsumer tells a consumer its queue was deleted.
+func cancelConsumer(sess easytcp.Session, queueName string) {
+	ctx := sess.AllocateContext()
+	if sessions.isFramed(sess) {
+		if err := ctx.SetResponse(ConsumerCancelTcpReq, &ChannelRequest{Name: queueName}); err != nil {
+			log.Println("[server] cancel encoding failed:", err)
+			return
+		}
+	} else {
+		ctx.SetResponseTcpMessage(easytcp.NewTcpMessage(ConsumerCancelTcpReq, []byte(queueName)))
+	}
+	ctx.Send()
+}
 
+func RegisterConsumer(c easytcp.Context) {
+	req := RegisterRequest{}
+	framed, err := bindRequest(c, &req)
+	if err != nil {
+		respond(c, ConsumerRegisterTcpAck, framed, "", err)
+		return
+	}
 	s := c.Session()
 	consumer := mq.NewConsumer(s)
-	channelName := bytes.ToUpper(bytes.TrimSpace(req.Data()))
-	queue, _ := qc.GetOrCreate(string(channelName)) // get or create
-	err := queue.RegisterConsumer(*consumer)
+	if req.Prefetch > 0 {
+		consumer.SetPrefetch(int(req.Prefetch))
+	}
+	queue, err := qc.GetOrCreate(req.Channel) // get or create
+	if err != nil {
+		respond(c, ConsumerRegisterTcpAck, framed, "", err)
+		return
+	}
+	err = queue.RegisterConsumer(*consumer)
 	if err != nil {
-		c.SetResponseTcpMessage(easytcp.NewTcpMessage(ConsumerRegisterTcpAck, []byte("error")))
+		respond(c, ConsumerRegisterTcpAck, framed, "", err)
 		return
 	}
 	sid := fmt.Sprint(s.ID())
 	fmt.Println("[server] consumer registered: ", sid)
 	// set response
-	c.SetResponseTcpMessage(easytcp.NewTcpMessage(ConsumerRegisterTcpAck, []byte(sid)))
+	respond(c, ConsumerRegisterTcpAck, framed, sid, nil)
+}
+
+// ConsumerCredit lets a consumer hold more messages in flight.
+func ConsumerCredit(c easytcp.Context) {
+	req := CreditRequest{}
+	framed, err := bindRequest(c, &req)
+	if err != nil {
+		respond(c, ConsumerCreditTcpAck, framed, "", err)
+		return
+	}
+	queue, err := qc.GetQueue(req.Channel)
+	if err != nil {
+		respond(c, ConsumerCreditTcpAck, framed, "", err)
+		return
+	}
+	err = queue.Credit(fmt.Sprint(c.Session().ID()), int(req.Credit))
+	if err != nil && !errors.Is(err, mq.ErrNoConsumer) {
+		err = invalid(err)
+	}
+	respond(c, ConsumerCreditTcpAck, framed, "OK", err)
+}
+
+// NextMessage hands the next ready messages of a queue to a session pulling them,
+// waiting for one when asked to.
+func NextMessage(c easytcp.Context) {
+	req := NextRequest{}
+	framed, err := bindRequest(c, &req)
+	if err != nil {
+		respondNext(c, framed, nil, err)
+		return
+	}
+	queue, err := qc.GetOrCreate(req.Channel)
+	if err != nil {
+		respondNext(c, framed, nil, err)
+		return
+	}
+	limit := int(req.Max)
+	if limit == 0 {
+		limit = 1
+	}
+	if framed && limit > tomq_codec.FrameMaxCount {
+		limit = tomq_codec.FrameMaxCount // the response counts them on 16 bits
+	}
+	msgs, err := queue.Pull(fmt.Sprint(c.Session().ID()), limit, time.Duration(req.Wait)*time.Millisecond)
+	if err != nil && !errors.Is(err, mq.ErrExclusive) && !errors.Is(err, mq.ErrNoQueue) {
+		err = invalid(err)
+	}
+	respondNext(c, framed, msgs, err)
+}
+
+// DeclareQueue creates a queue with its properties, or checks an existing one has them.
+func DeclareQueue(c easytcp.Context) {
+	req := DeclareRequest{}
+	framed, err := bindRequest(c, &req)
+	if err != nil {
+		respond(c, ChannelCreateTcpAck, framed, "", err)
+		return
+	}
+	opts, err := req.options()
+	if err != nil {
+		respond(c, ChannelCreateTcpAck, framed, "", err)
+		return
+	}
+	err = qc.Declare(req.Channel, opts, fmt.Sprint(c.Session().ID()))
+	respond(c, ChannelCreateTcpAck, framed, "OK", err)
+}
+
+// DeleteQueue removes a queue, unless its if-empty or if-unused guard says otherwise.
+func DeleteQueue(c easytcp.Context) {
+	req := DeleteRequest{}
+	framed, err := bindRequest(c, &req)
+	if err != nil {
+		respond(c, ChannelDeleteTcpAck, framed, "", err)
+		return
+	}
+	err = qc.Delete(req.Channel, req.IfEmpty, req.IfUnused)
+	respond(c, ChannelDeleteTcpAck, framed, "OK", err)
+}
+
+// PurgeQueue drops the ready messages of a queue.
+func PurgeQueue(c easytcp.Context) {
+	req := ChannelRequest{}
+	framed, err := bindRequest(c, &req)
+	if err != nil {
+		respond(c, ChannelPurgeTcpAck, framed, "", err)
+		return
+	}
+	count, err := qc.Purge(req.Name)
+	respond(c, ChannelPurgeTcpAck, framed, strconv.Itoa(count), err)
+}
+
+// DeclareExchange creates an exchange: NAME TYPE.
+func DeclareExchange(c easytcp.Context) {
+	req := ExchangeRequest{}
+	framed, err := bindRequest(c, &req)
+	if err != nil {
+		respond(c, ExchangeDeclareTcpAck, framed, "", err)
+		return
+	}
+	err = qc.DeclareExchange(req.Name, req.Type)
+	if err != nil && !errors.Is(err, mq.ErrExchangeType) {
+		err = invalid(err)
+	}
+	respond(c, ExchangeDeclareTcpAck, framed, "OK", err)
+}
+
+// DeleteExchange removes an exchange with its bindings.
+func DeleteExchange(c easytcp.Context) {
+	req := ChannelRequest{}
+	framed, err := bindRequest(c, &req)
+	if err != nil {
+		respond(c, ExchangeDeleteTcpAck, framed, "", err)
+		return
+	}
+	err = qc.DeleteExchange(req.Name)
+	respond(c, ExchangeDeleteTcpAck, framed, "OK", err)
+}
+
+// BindQueue binds a queue to an exchange: EXCHANGE QUEUE [KEY] [HEADER=VALUE]...
+func BindQueue(c easytcp.Context) {
+	req := BindRequest{}
+	framed, err := bindRequest(c, &req)
+	if err != nil {
+		respond(c, ExchangeBindTcpAck, framed, "", err)
+		return
+	}
+	err = qc.Bind(req.Exchange, req.Channel, req.Key, req.Args)
+	if err != nil && errorCode(err) == CODE_INTERNAL {
+		err = invalid(err)
+	}
+	respond(c, ExchangeBindTcpAck, framed, "OK", err)
+}
+
+// UnbindQueue removes a binding: EXCHANGE QUEUE [KEY] [HEADER=VALUE]...
+func UnbindQueue(c easytcp.Context) {
+	req := BindRequest{}
+	framed, err := bindRequest(c, &req)
+	if err != nil {
+		respond(c, ExchangeUnbindTcpAck, framed, "", err)
+		return
+	}
+	err = qc.Unbind(req.Exchange, req.Channel, req.Key, req.Args)
+	respond(c, ExchangeUnbindTcpAck, framed, "OK", err)
 }
 
 func PublishMsg(c easytcp.Context) {
-	// acquire request
-	req := c.Request()
-	channel := bytes.ToUpper(bytes.TrimSpace(bytes.Split(req.Data(), []byte(" "))[0]))
-	data := bytes.TrimSpace(bytes.Split(req.Data(), []byte(" "))[1])
-	queue, _ := qc.GetOrCreate(string(channel)) // get or create
-	// do things...
-	fmt.Println("[server] new TcpMessage for channel " + string(channel))
-	msg := mq.NewMessage(string(channel), data)
-	err := queue.Publish(msg)
+	req := PublishRequest{}
+	framed, err := bindRequest(c, &req)
+	if seq, ok := sessions.nextSeq(c.Session()); ok {
+		publishConfirm(c.Session(), framed, seq, req, err)
+		return
+	}
+	if err != nil {
+		respond(c, MsgPublishTcpAck, framed, "", err)
+		return
+	}
+	msg, err := req.message()
+	if err != nil {
+		respond(c, MsgPublishTcpAck, framed, "", err)
+		return
+	}
+	if sid := fmt.Sprint(c.Session().ID()); qc.InTx(sid) {
+		if req.Exchange != "" {
+			_, err = qc.StagePublishTo(sid, req.Exchange, req.Channel, msg)
+		} else {
+			err = qc.StagePublish(sid, msg)
+		}
+		respond(c, MsgPublishTcpAck, framed, msg.Id, err)
+		return
+	}
+	if req.Exchange != "" {
+		_, err := qc.PublishTo(req.Exchange, req.Channel, msg)
+		respond(c, MsgPublishTcpAck, framed, msg.Id, err)
+		return
+	}
+	queue, err := qc.GetOrCreate(msg.Header.Channel) // get or create
 	if err != nil {
-		c.SetResponseTcpMessage(easytcp.NewTcpMessage(MsgPublishTcpAck, []byte("error")))
+		respond(c, MsgPublishTcpAck, framed, "", err)
 		return
 	}
+	err = queue.Publish(msg)
 	// set response
-	c.SetResponseTcpMessage(easytcp.NewTcpMessage(MsgPublishTcpAck, []byte(msg.Id)))
+	respond(c, MsgPublishTcpAck, framed, msg.Id, err)
+}
+
+// publishConfirm publishes req for a session in confirm mode, the publish is answered
+// by a confirm once the message is on disk. err is the error of the request decoding.
+func publishConfirm(sess easytcp.Session, framed bool, seq uint64, req PublishRequest, err error) {
+	if err != nil {
+		sendConfirm(sess, framed, seq, "", err)
+		return
+	}
+	msg, err := req.message()
+	if err != nil {
+		sendConfirm(sess, framed, seq, "", err)
+		return
+	}
+	confirm := func(err error) {
+		sendConfirm(sess, framed, seq, msg.Id, err)
+	}
+	if req.Exchange != "" {
+		qc.PublishToConfirm(req.Exchange, req.Channel, msg, confirm)
+		return
+	}
+	queue, err := qc.GetOrCreate(msg.Header.Channel)
+	if err != nil {
+		sendConfirm(sess, framed, seq, msg.Id, err)
+		return
+	}
+	queue.PublishConfirm(msg, confirm)
+}
+
+// RegisterPublisher turns the confirm mode of the session on or off.
+func RegisterPublisher(c easytcp.Context) {
+	req := PublisherRequest{}
+	framed, err := bindRequest(c, &req)
+	if err == nil && req.Confirm && qc.InTx(fmt.Sprint(c.Session().ID())) {
+		err = invalid(errors.New("session has a transaction open"))
+	}
+	if err == nil {
+		sessions.setConfirm(c.Session(), req.Confirm)
+	}
+	respond(c, ConsumerPublisherTcpAck, framed, "OK", err)
+}
+
+// TxOpen starts a transaction in the session, see TX OPEN in common.go.
+func TxOpen(c easytcp.Context) {
+	req := TxRequest{}
+	framed, err := bindRequest(c, &req)
+	if err == nil && sessions.confirming(c.Session()) {
+		err = invalid(errors.New("session is in confirm mode"))
+	}
+	if err == nil {
+		err = qc.Begin(fmt.Sprint(c.Session().ID()))
+	}
+	respond(c, TxOpenTcpAck, framed, "OK", err)
+}
+
+// TxCommit applies the transaction of the session.
+func TxCommit(c easytcp.Context) {
+	req := TxRequest{}
+	framed, err := bindRequest(c, &req)
+	if err == nil {
+		err = qc.Commit(fmt.Sprint(c.Session().ID()))
+	}
+	respond(c, TxCommitTcpAck, framed, "OK", err)
+}
+
+// TxRollback drops the transaction of the session.
+func TxRollback(c easytcp.Context) {
+	req := TxRequest{}
+	framed, err := bindRequest(c, &req)
+	if err == nil {
+		err = qc.Rollback(fmt.Sprint(c.Session().ID()))
+	}
+	respond(c, TxRollbackTcpAck, framed, "OK", err)
+}
+
+// PublishBatch publishes many messages at once, the ones to queues share the syncs.
+func PublishBatch(c easytcp.Context) {
+	req := PublishBatchRequest{}
+	framed, err := bindRequest(c, &req)
+	if err != nil {
+		respondBatch(c, MsgPublishBatchTcpAck, framed, nil, nil, err)
+		return
+	}
+	ids := make([]string, len(req.Messages))
+	errs := make([]error, len(req.Messages))
+	msgs := []mq.QMessage{}
+	positions := []int{} // of msgs in the batch
+	sid := fmt.Sprint(c.Session().ID())
+	staged := qc.InTx(sid)
+	for i, p := range req.Messages {
+		msg, err := p.message()
+		ids[i] = msg.Id
+		switch {
+		case err != nil:
+			errs[i] = err
+		case staged && p.Exchange != "":
+			_, errs[i] = qc.StagePublishTo(sid, p.Exchange, p.Channel, msg)
+		case staged:
+			errs[i] = qc.StagePublish(sid, msg)
+		case p.Exchange != "":
+			_, errs[i] = qc.PublishTo(p.Exchange, p.Channel, msg)
+		default:
+			msgs = append(msgs, msg)
+			positions = append(positions, i)
+		}
+	}
+	for i, err := range qc.PublishBatch(msgs, sessions.confirming(c.Session())) {
+		errs[positions[i]] = err
+	}
+	respondBatch(c, MsgPublishBatchTcpAck, framed, ids, errs, nil)
+}
+
+// AckBatch acks, nacks, rejects or requeues many messages at once.
+func AckBatch(c easytcp.Context) {
+	req := AckBatchRequest{}
+	framed, err := bindRequest(c, &req)
+	if err == nil && req.Mode > mq.SETTLE_REQUEUE {
+		err = invalid(fmt.Errorf("bad mode %d", req.Mode))
+	}
+	if err == nil && len(req.Ids) == 0 && req.UpTo == "" {
+		err = invalid(errors.New("no message to settle"))
+	}
+	if err != nil {
+		respondBatch(c, MsgAckBatchTcpAck, framed, nil, nil, err)
+		return
+	}
+	queue, err := qc.GetQueue(req.Channel)
+	if err != nil {
+		respondBatch(c, MsgAckBatchTcpAck, framed, nil, nil, err)
+		return
+	}
+	sid := fmt.Sprint(c.Session().ID())
+	ids := req.Ids
+	if req.UpTo != "" {
+		held, err := queue.HeldUpTo(sid, req.UpTo)
+		if err != nil {
+			respondBatch(c, MsgAckBatchTcpAck, framed, nil, nil, err)
+			return
+		}
+		listed := map[string]bool{}
+		for _, id := range ids {
+			listed[id] = true
+		}
+		for _, id := range held {
+			if !listed[id] {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if framed && len(ids) > tomq_codec.FrameMaxCount {
+		err := fmt.Errorf("%d messages to settle, %d at most", len(ids), tomq_codec.FrameMaxCount)
+		respondBatch(c, MsgAckBatchTcpAck, framed, nil, nil, invalid(err))
+		return
+	}
+	if req.Mode == mq.SETTLE_ACK && qc.InTx(sid) {
+		errs := make([]error, len(ids))
+		for i, id := range ids {
+			errs[i] = qc.StageAck(sid, req.Channel, id)
+		}
+		respondBatch(c, MsgAckBatchTcpAck, framed, ids, errs, nil)
+		return
+	}
+	errs := queue.SettleBatch(sid, ids, int(req.Mode))
+	respondBatch(c, MsgAckBatchTcpAck, framed, ids, errs, nil)
+}
+
+// DistributeReceived records that a consumer got a distributed message, it's not answered.
+func DistributeReceived(c easytcp.Context) {
+	req := MessageRequest{}
+	if _, err := bindRequest(c, &req); err != nil {
+		log.Println("[server] bad distribute ack:", err)
+		return
+	}
+	queue, err := qc.GetQueue(req.Channel)
+	if err == nil {
+		err = queue.Received(fmt.Sprint(c.Session().ID()), req.Id)
+	}
+	if err != nil {
+		log.Println("[server] distribute ack of", req.Id, "refused:", err)
+	}
 }
 
 func NAckMessage(c easytcp.Context) {
-	// acquire request
-	req := c.Request()
-	channel := bytes.ToUpper(bytes.TrimSpace(bytes.Split(req.Data(), []byte(" "))[0]))
-	msgId := bytes.TrimSpace(bytes.Split(req.Data(), []byte(" "))[1])
-	queue, err := qc.GetQueue(string(channel)) // get or create
+	req := MessageRequest{}
+	framed, err := bindRequest(c, &req)
 	if err != nil {
-		c.SetResponseTcpMessage(easytcp.NewTcpMessage(MsgNAckTcpAck, []byte(err.Error())))
+		respond(c, MsgNAckTcpAck, framed, "", err)
 		return
 	}
-	err = queue.UnAck(string(msgId))
-	queue.UpdateConsumer(fmt.Sprint(c.Session().ID()), mq.CONSUMER_STATUS_WORKING)
+	queue, err := qc.GetQueue(req.Channel)
 	if err != nil {
-		c.SetResponseTcpMessage(easytcp.NewTcpMessage(MsgNAckTcpAck, []byte("error")))
+		respond(c, MsgNAckTcpAck, framed, "", err)
 		return
 	}
+	err = queue.UnAck(fmt.Sprint(c.Session().ID()), req.Id)
 	// set response
-	c.SetResponseTcpMessage(easytcp.NewTcpMessage(MsgNAckTcpAck, []byte("OK")))
-
+	respond(c, MsgNAckTcpAck, framed, "OK", err)
 }
 
 func AckMessage(c easytcp.Context) {
-	// acquire request
-	req := c.Request()
-	channel := bytes.ToUpper(bytes.TrimSpace(bytes.Split(req.Data(), []byte(" "))[0]))
-	msgId := bytes.TrimSpace(bytes.Split(req.Data(), []byte(" "))[1])
-	queue, err := qc.GetQueue(string(channel)) // get or create
+	req := MessageRequest{}
+	framed, err := bindRequest(c, &req)
 	if err != nil {
-		c.SetResponseTcpMessage(easytcp.NewTcpMessage(MsgAckTcpAck, []byte(err.Error())))
+		respond(c, MsgAckTcpAck, framed, "", err)
+		return
+	}
+	sid := fmt.Sprint(c.Session().ID())
+	if qc.InTx(sid) {
+		err = qc.StageAck(sid, req.Channel, req.Id)
+		respond(c, MsgAckTcpAck, framed, "OK", err)
 		return
 	}
-	err = queue.Ack(string(msgId))
-	queue.UpdateConsumer(fmt.Sprint(c.Session().ID()), mq.CONSUMER_STATUS_IDLE)
+	queue, err := qc.GetQueue(req.Channel)
 	if err != nil {
-		c.SetResponseTcpMessage(easytcp.NewTcpMessage(MsgAckTcpAck, []byte("error")))
+		respond(c, MsgAckTcpAck, framed, "", err)
 		return
 	}
-
+	err = queue.Ack(sid, req.Id)
 	// set response
-	c.SetResponseTcpMessage(easytcp.NewTcpMessage(MsgAckTcpAck, []byte("OK")))
+	respond(c, MsgAckTcpAck, framed, "OK", err)
 }
 
 func RejectMessage(c easytcp.Context) {
-	// acquire request
-	req := c.Request()
-	channel := bytes.ToUpper(bytes.TrimSpace(bytes.Split(req.Data(), []byte(" "))[0]))
-	msgId := bytes.TrimSpace(bytes.Split(req.Data(), []byte(" "))[1])
-	queue, err := qc.GetQueue(string(channel)) // get or create
+	req := MessageRequest{}
+	framed, err := bindRequest(c, &req)
 	if err != nil {
-		c.SetResponseTcpMessage(easytcp.NewTcpMessage(MsgRejectTcpAck, []byte(err.Error())))
+		respond(c, MsgRejectTcpAck, framed, "", err)
 		return
 	}
-	err = queue.Reject(string(msgId))
-	queue.UpdateConsumer(fmt.Sprint(c.Session().ID()), mq.CONSUMER_STATUS_IDLE)
+	queue, err := qc.GetQueue(req.Channel)
 	if err != nil {
-		c.SetResponseTcpMessage(easytcp.NewTcpMessage(MsgRejectTcpAck, []byte("error")))
+		respond(c, MsgRejectTcpAck, framed, "", err)
 		return
 	}
-
+	err = queue.Reject(fmt.Sprint(c.Session().ID()), req.Id, req.Requeue)
 	// set response
-	c.SetResponseTcpMessage(easytcp.NewTcpMessage(MsgRejectTcpAck, []byte("OK")))
+	respond(c, MsgRejectTcpAck, framed, "OK", err)
 }